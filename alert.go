@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/PrasadG193/covaccine-notifier/pkg/logging"
+	"github.com/PrasadG193/covaccine-notifier/pkg/notify"
+)
+
+const (
+	defaultAlertAfter = 3
+
+	// The titles of the alerts, the subjects of the emails
+	failureTitle   = "Searching for vaccination slots fails"
+	recoveryTitle  = "Searching for vaccination slots works again"
+	heartbeatTitle = "covaccine-notifier is running"
+)
+
+var heartbeatCron *cronSchedule
+
+// failureAlerter notifies when the searches keep failing, when they work
+// again and, with --heartbeat, that the notifier is running
+type failureAlerter struct {
+	notifier notify.Notifier
+	// after is the number of consecutive failures to alert at, 0 to never alert
+	after int
+
+	failures    int
+	since       time.Time
+	lastErr     error
+	alerted     bool
+	lastSuccess time.Time
+}
+
+func newFailureAlerter(notifier notify.Notifier) *failureAlerter {
+	return &failureAlerter{notifier: notifier, after: alertAfter}
+}
+
+// failed records a failed search and alerts once there are enough in a row
+func (a *failureAlerter) failed(ctx context.Context, err error, now time.Time) {
+	if a.failures == 0 {
+		a.since = now
+	}
+	a.failures++
+	a.lastErr = err
+	logging.Error("Search failed, retrying later", "err", err, "failures", a.failures)
+	if a.after == 0 || a.alerted || a.failures < a.after {
+		return
+	}
+	msg := fmt.Sprintf("Searching for slots failed %s in a row since %s, slots are not notified until it works again. Last error: %v",
+		plural(a.failures, "time", "times"), formatClock(a.since, now), err)
+	if a.send(ctx, failureTitle, msg) {
+		a.alerted = true
+	}
+}
+
+// succeeded records a successful search and notifies the recovery when the failures were alerted
+func (a *failureAlerter) succeeded(ctx context.Context, now time.Time) {
+	a.lastSuccess = now
+	if a.failures == 0 {
+		return
+	}
+	if a.alerted {
+		a.send(ctx, recoveryTitle, fmt.Sprintf("Searching for slots works again after %s since %s",
+			plural(a.failures, "failure", "failures"), formatClock(a.since, now)))
+	}
+	logging.Info("Search recovered", "failures", a.failures)
+	a.failures, a.alerted, a.lastErr = 0, false, nil
+}
+
+// heartbeat notifies that the notifier is running
+func (a *failureAlerter) heartbeat(ctx context.Context, now time.Time) {
+	msg := fmt.Sprintf("covaccine-notifier is running for %s", searchArea())
+	if !a.lastSuccess.IsZero() {
+		msg += fmt.Sprintf(", last successful search at %s", formatClock(a.lastSuccess, now))
+	}
+	if a.failures != 0 {
+		msg += fmt.Sprintf(", the searches failed %s in a row since %s: %v",
+			plural(a.failures, "time", "times"), formatClock(a.since, now), a.lastErr)
+	}
+	a.send(ctx, heartbeatTitle, msg)
+}
+
+func (a *failureAlerter) send(ctx context.Context, title, msg string) bool {
+	logging.Info("Sending alert", "title", title, "message", msg)
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	if err := a.notifier.SendMessage(ctx, title, msg); err != nil {
+		logging.Error("Failed to send alert", "err", err)
+		return false
+	}
+	return true
+}
+
+// formatClock formats t with the date when it is not on the day of now
+func formatClock(t, now time.Time) string {
+	if truncateDay(t).Equal(truncateDay(now)) {
+		return t.Format("15:04")
+	}
+	return t.Format("02 Jan 15:04")
+}
+
+// checkAlertFlags validates the failure alert and heartbeat flags
+func checkAlertFlags() error {
+	if alertAfter < 0 {
+		return errors.New("Invalid alert after, please use a positive number of failures or 0 to disable the alerts")
+	}
+	heartbeatCron = nil
+	if len(heartbeatArg) == 0 {
+		return nil
+	}
+	minutes, err := parseHourOrClock(heartbeatArg)
+	if err != nil {
+		return errors.Errorf("Invalid heartbeat %q, please use a time like 09:00", heartbeatArg)
+	}
+	heartbeatCron, err = parseCron(fmt.Sprintf("%d %d * * *", minutes%60, minutes/60))
+	return err
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/PrasadG193/covaccine-notifier/pkg/notify/notifytest"
+)
+
+func TestFailureAlerter(t *testing.T) {
+	resetFlags(t)
+	pinCode = "444002"
+	ctx := context.Background()
+	start := time.Date(2021, 5, 20, 9, 0, 0, 0, time.Local)
+	errDown := errors.New("Request failed with statusCode: 503")
+
+	tests := []struct {
+		name  string
+		after int
+		// events are true for a successful search and false for a failed one
+		events []bool
+		want   []string
+	}{
+		{
+			name:   "no failures",
+			after:  3,
+			events: []bool{true, true, true},
+		},
+		{
+			name:   "fewer failures than the threshold",
+			after:  3,
+			events: []bool{false, false, true, false, false},
+		},
+		{
+			name:   "alert once and recover",
+			after:  2,
+			events: []bool{false, false, false, false, true},
+			want: []string{
+				"Searching for slots failed 2 times in a row since 09:00",
+				"Searching for slots works again after 4 failures since 09:00",
+			},
+		},
+		{
+			name:   "alerts disabled",
+			after:  0,
+			events: []bool{false, false, false, false, true},
+		},
+		{
+			name:   "alert again after recovering",
+			after:  1,
+			events: []bool{false, true, false},
+			want: []string{
+				"Searching for slots failed 1 time in a row since 09:00",
+				"Searching for slots works again after 1 failure since 09:00",
+				"Searching for slots failed 1 time in a row since 09:02",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := notifytest.NewRecorder(nil)
+			a := newFailureAlerter(rec)
+			a.after = tt.after
+			for i, ok := range tt.events {
+				now := start.Add(time.Duration(i) * time.Minute)
+				if ok {
+					a.succeeded(ctx, now)
+				} else {
+					a.failed(ctx, errDown, now)
+				}
+			}
+			got := rec.Messages()
+			if len(got) != len(tt.want) {
+				t.Fatalf("sent %q, want %d messages", got, len(tt.want))
+			}
+			titles := rec.Titles()
+			for i, want := range tt.want {
+				if !strings.HasPrefix(got[i], want) {
+					t.Errorf("message %d = %q, want it to start with %q", i, got[i], want)
+				}
+				wantTitle := failureTitle
+				if strings.Contains(want, "works again") {
+					wantTitle = recoveryTitle
+				}
+				if titles[i] != wantTitle {
+					t.Errorf("title %d = %q, want %q", i, titles[i], wantTitle)
+				}
+			}
+		})
+	}
+}
+
+func TestFailureAlerterRetriesFailedAlert(t *testing.T) {
+	resetFlags(t)
+	pinCode = "444002"
+	ctx := context.Background()
+	now := time.Date(2021, 5, 20, 9, 0, 0, 0, time.Local)
+	rec := notifytest.NewRecorder(errors.New("notifier down"))
+	a := newFailureAlerter(rec)
+	a.after = 1
+
+	a.failed(ctx, errors.New("timeout"), now)
+	rec.SetError(nil)
+	a.failed(ctx, errors.New("timeout"), now.Add(time.Minute))
+	a.failed(ctx, errors.New("timeout"), now.Add(2*time.Minute))
+
+	// The alert which could not be sent is sent on the next failure, once
+	if got := rec.Messages(); len(got) != 2 {
+		t.Fatalf("sent %q, want the failed alert and its retry", got)
+	}
+	if want := "Last error: timeout"; !strings.HasSuffix(rec.Last(), want) {
+		t.Errorf("alert = %q, want it to end with %q", rec.Last(), want)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	resetFlags(t)
+	pinCode = "444002"
+	ctx := context.Background()
+	now := time.Date(2021, 5, 20, 9, 0, 0, 0, time.Local)
+	rec := notifytest.NewRecorder(nil)
+	a := newFailureAlerter(rec)
+	a.after = 5
+
+	a.succeeded(ctx, now.Add(-24*time.Hour))
+	a.failed(ctx, errors.New("timeout"), now.Add(-time.Hour))
+	a.heartbeat(ctx, now)
+
+	want := "covaccine-notifier is running for 444002, last successful search at 19 May 09:00, " +
+		"the searches failed 1 time in a row since 08:00: timeout"
+	if got := rec.Last(); got != want {
+		t.Errorf("heartbeat = %q, want %q", got, want)
+	}
+	if titles := rec.Titles(); len(titles) != 1 || titles[0] != heartbeatTitle {
+		t.Errorf("titles = %q, want the heartbeat title only", titles)
+	}
+}
+
+func TestSendDigestTitle(t *testing.T) {
+	resetFlags(t)
+	pinCode = "444002"
+	prev := pstate
+	t.Cleanup(func() { pstate = prev })
+	pstate = pollerState{}
+	rec := notifytest.NewRecorder(nil)
+	now := time.Date(2021, 5, 20, 21, 0, 0, 0, time.Local)
+	if err := sendDigest(context.Background(), rec, now); err != nil {
+		t.Fatalf("sendDigest() = %v", err)
+	}
+	// A digest without slots must not read like a notification of slots
+	if titles := rec.Titles(); len(titles) != 1 || titles[0] != digestTitle {
+		t.Errorf("titles = %q, want %q", titles, digestTitle)
+	}
+	if want := "No slots found today in 444002"; !strings.HasPrefix(rec.Last(), want) {
+		t.Errorf("digest = %q, want it to start with %q", rec.Last(), want)
+	}
+}
+
+func TestRunAlertsOnlySearchFailures(t *testing.T) {
+	resetFlags(t)
+	age, pinCode, endpointArg, alertAfter = 18, "444002", calendarEndpoint, 1
+	calendar := serveCalendar(t)
+	down := true
+	startCowin(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		calendar(w, r)
+	}))
+	// With a cancelled context Run stops after the first search
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	notifier := notifytest.NewRecorder(errors.New("bot blocked"))
+	if err := Run(ctx, nil, notifier); err != nil {
+		t.Fatalf("Run() = %v, want the failed search to be retried", err)
+	}
+	if msgs := notifier.Messages(); len(msgs) != 1 || !strings.Contains(msgs[0], "Searching for slots failed") {
+		t.Errorf("sent %q, want the failure alert", msgs)
+	}
+
+	// A notification which cannot be sent does not stop the searches
+	down = false
+	notifier = notifytest.NewRecorder(errors.New("bot blocked"))
+	if err := Run(ctx, nil, notifier); err != nil {
+		t.Fatalf("Run() = %v, want the notification to be retried", err)
+	}
+	if msgs := notifier.Messages(); len(msgs) != 1 || strings.Contains(msgs[0], "failed") {
+		t.Errorf("sent %q, want only the slots and no failure alert", msgs)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// centerStats are the slot release patterns of a center. A drop is an
+// increase of the capacity of a session, when new slots are published.
+type centerStats struct {
+	CenterID int    `json:"center_id"`
+	Name     string `json:"name"`
+	District string `json:"district"`
+	Pincode  int    `json:"pincode"`
+	// Drops is the number of times slots were published
+	Drops int `json:"drops"`
+	// AverageCapacity is the average number of slots published by a drop
+	AverageCapacity float64 `json:"average_capacity"`
+	// TypicalHour is the hour of the day most drops happen at, -1 without drops
+	TypicalHour int `json:"typical_hour"`
+	// MedianLasts is the median time from a drop until the session is full, in seconds
+	MedianLasts int64 `json:"median_lasts_seconds"`
+	// Hours and Weekdays count the drops by hour of the day and day of the week
+	Hours    [24]int        `json:"hours"`
+	Weekdays map[string]int `json:"weekdays"`
+
+	lasts []time.Duration
+}
+
+type capacityRow struct {
+	sessionID string
+	centerID  int
+	takenAt   time.Time
+	total     float64
+}
+
+// Analyze reports the slot release patterns of the centers in the history database
+func Analyze(w io.Writer) error {
+	switch output {
+	case tableOutput, jsonOutput:
+	default:
+		return errors.New("Invalid output format, please use table or json")
+	}
+	if len(historyPath) == 0 {
+		return errors.New("Missing history database, please pass --history")
+	}
+	if _, err := os.Stat(historyPath); err != nil {
+		return errors.Wrap(err, "Failed to open history")
+	}
+	h, err := openHistory(historyPath)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	stats, err := h.analyze(intSet(centerIDs), since)
+	if err != nil {
+		return errors.Wrap(err, "Failed to analyze history")
+	}
+	return writeStats(w, output, stats)
+}
+
+// analyze computes the statistics of the centers, or of the given ones, from
+// the history recorded over the last period, or all of it when it is zero
+func (h *historyRecorder) analyze(centers map[int]bool, period time.Duration) ([]*centerStats, error) {
+	var from int64
+	if period > 0 {
+		from = time.Now().Add(-period).Unix()
+	}
+	// Sessions already open in the first poll a center appears in were published
+	// before its location was recorded, which can be long after the first poll
+	firstSeen := map[int]int64{}
+	rows, err := h.db.Query(`SELECT s.center_id, MIN(c.taken_at)
+		FROM capacities c JOIN sessions s ON s.session_id = c.session_id
+		GROUP BY s.center_id`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var centerID int
+		var takenAt int64
+		if err := rows.Scan(&centerID, &takenAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		firstSeen[centerID] = takenAt
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	byCenter := map[int]*centerStats{}
+	rows, err = h.db.Query(`SELECT center_id, name, district_name, pincode FROM centers`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		s := &centerStats{TypicalHour: -1, Weekdays: map[string]int{}}
+		if err := rows.Scan(&s.CenterID, &s.Name, &s.District, &s.Pincode); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if centers == nil || centers[s.CenterID] {
+			byCenter[s.CenterID] = s
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = h.db.Query(`SELECT c.session_id, s.center_id, c.taken_at, c.available_capacity
+		FROM capacities c JOIN sessions s ON s.session_id = c.session_id
+		ORDER BY c.session_id, c.taken_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var session []capacityRow
+	for rows.Next() {
+		var r capacityRow
+		var takenAt int64
+		if err := rows.Scan(&r.sessionID, &r.centerID, &takenAt, &r.total); err != nil {
+			return nil, err
+		}
+		r.takenAt = time.Unix(takenAt, 0)
+		if len(session) != 0 && session[0].sessionID != r.sessionID {
+			addDrops(byCenter[session[0].centerID], session, firstSeen[session[0].centerID], from)
+			session = session[:0]
+		}
+		session = append(session, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(session) != 0 {
+		addDrops(byCenter[session[0].centerID], session, firstSeen[session[0].centerID], from)
+	}
+
+	stats := make([]*centerStats, 0, len(byCenter))
+	for _, s := range byCenter {
+		s.summarize()
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Drops != stats[j].Drops {
+			return stats[i].Drops > stats[j].Drops
+		}
+		return stats[i].CenterID < stats[j].CenterID
+	})
+	return stats, nil
+}
+
+// addDrops counts the drops in the capacity changes of a session since from.
+// firstSeen is the first poll the center of the session was seen in.
+func addDrops(s *centerStats, rows []capacityRow, firstSeen, from int64) {
+	if s == nil {
+		return
+	}
+	prev := 0.0
+	for i, r := range rows {
+		increase := r.total - prev
+		prev = r.total
+		if increase <= 0 || r.takenAt.Unix() < from || (i == 0 && r.takenAt.Unix() <= firstSeen) {
+			continue
+		}
+		s.Drops++
+		s.AverageCapacity += increase
+		local := r.takenAt.Local()
+		s.Hours[local.Hour()]++
+		s.Weekdays[weekdayNames[local.Weekday()]]++
+		for _, next := range rows[i+1:] {
+			if next.total <= 0 {
+				s.lasts = append(s.lasts, next.takenAt.Sub(r.takenAt))
+				break
+			}
+		}
+	}
+}
+
+func (s *centerStats) summarize() {
+	if s.Drops == 0 {
+		return
+	}
+	s.AverageCapacity /= float64(s.Drops)
+	for h, n := range s.Hours {
+		if s.TypicalHour == -1 || n > s.Hours[s.TypicalHour] {
+			s.TypicalHour = h
+		}
+	}
+	if len(s.lasts) != 0 {
+		sort.Slice(s.lasts, func(i, j int) bool { return s.lasts[i] < s.lasts[j] })
+		s.MedianLasts = int64(s.lasts[len(s.lasts)/2] / time.Second)
+	}
+}
+
+// busiestWeekday returns the day of the week with most drops
+func (s *centerStats) busiestWeekday() string {
+	busiest := ""
+	for _, d := range weekdayNames {
+		if s.Weekdays[d] > s.Weekdays[busiest] {
+			busiest = d
+		}
+	}
+	return busiest
+}
+
+func writeStats(w io.Writer, format string, stats []*centerStats) error {
+	if format == jsonOutput {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(stats)
+	}
+	tw := tabwriter.NewWriter(w, 1, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tCENTER\tPINCODE\tDROPS\tAVG CAPACITY\tTYPICAL TIME\tLASTS\tBUSIEST DAY")
+	for _, s := range stats {
+		typical, lasts := "-", "-"
+		if s.TypicalHour >= 0 {
+			typical = fmt.Sprintf("%02d:00-%02d:00", s.TypicalHour, (s.TypicalHour+1)%24)
+		}
+		if s.MedianLasts > 0 {
+			lasts = (time.Duration(s.MedianLasts) * time.Second).String()
+		}
+		busiest := s.busiestWeekday()
+		if len(busiest) == 0 {
+			busiest = "-"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%d\t%.1f\t%s\t%s\t%s\n", s.CenterID, s.Name, s.Pincode, s.Drops,
+			s.AverageCapacity, typical, lasts, busiest)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAnalyzeLocationRecordedLater(t *testing.T) {
+	h, err := openHistory(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	center := func(id int, sessions map[string]float64) Appointments {
+		c := Center{CenterID: id, Name: "Center", DistrictName: "Akola", Pincode: 444001}
+		for sid, capacity := range sessions {
+			c.Sessions = append(c.Sessions, Session{SessionID: sid, Date: "22-05-2021", AvailableCapacity: capacity})
+		}
+		return Appointments{Centers: []Center{c}}
+	}
+	start := time.Date(2021, 5, 20, 9, 0, 0, 0, time.Local)
+	polls := []struct {
+		appnts Appointments
+		loc    location
+	}{
+		{appnts: center(1, map[string]float64{"a1": 10}), loc: location{DistrictID: 363}},
+		// The second district is only searched from the second poll on
+		{appnts: center(2, map[string]float64{"b1": 5}), loc: location{DistrictID: 364}},
+		{appnts: center(1, map[string]float64{"a1": 10, "a2": 7}), loc: location{DistrictID: 363}},
+		{appnts: center(2, map[string]float64{"b1": 5, "b2": 3}), loc: location{DistrictID: 364}},
+	}
+	for i, p := range polls {
+		if err := h.record(p.appnts, p.loc, start.Add(time.Duration(i)*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := h.analyze(nil, 0)
+	if err != nil {
+		t.Fatalf("analyze() = %v", err)
+	}
+	drops := map[int]int{}
+	for _, s := range stats {
+		drops[s.CenterID] = s.Drops
+	}
+	if drops[1] != 1 || drops[2] != 1 {
+		t.Errorf("drops = %v, want only the sessions published after the first poll of each center", drops)
+	}
+}
+
+func TestAnalyzeStats(t *testing.T) {
+	// 20-05-2021 is a Thursday
+	thu := func(hour, min int) time.Time { return time.Date(2021, 5, 20, hour, min, 0, 0, time.Local) }
+	type poll struct {
+		at       time.Time
+		sessions map[string]float64
+	}
+	tests := []struct {
+		name        string
+		polls       []poll
+		drops       int
+		typicalHour int
+		weekdays    map[string]int
+		medianLasts int64
+	}{
+		{
+			name: "no drops",
+			polls: []poll{
+				{at: thu(9, 0), sessions: map[string]float64{"a": 10}},
+				{at: thu(10, 0), sessions: map[string]float64{"a": 5}},
+			},
+			typicalHour: -1,
+			weekdays:    map[string]int{},
+		},
+		{
+			name: "full an hour after the drop",
+			polls: []poll{
+				{at: thu(9, 0), sessions: map[string]float64{"a": 0}},
+				{at: thu(10, 0), sessions: map[string]float64{"a": 10}},
+				{at: thu(11, 0), sessions: map[string]float64{"a": 0}},
+			},
+			drops:       1,
+			typicalHour: 10,
+			weekdays:    map[string]int{"thu": 1},
+			medianLasts: 3600,
+		},
+		{
+			name: "median of the sessions",
+			polls: []poll{
+				{at: thu(9, 0), sessions: map[string]float64{"a": 0, "b": 0, "c": 0}},
+				{at: thu(10, 0), sessions: map[string]float64{"a": 5, "b": 5, "c": 5}},
+				{at: thu(10, 30), sessions: map[string]float64{"a": 0}},
+				{at: thu(11, 0), sessions: map[string]float64{"b": 0}},
+				{at: thu(13, 0), sessions: map[string]float64{"c": 0}},
+			},
+			drops:       3,
+			typicalHour: 10,
+			weekdays:    map[string]int{"thu": 3},
+			medianLasts: 3600,
+		},
+		{
+			name: "busiest hour over the week",
+			polls: []poll{
+				{at: thu(8, 0), sessions: map[string]float64{"a": 0}},
+				{at: thu(9, 0), sessions: map[string]float64{"a": 2}},
+				{at: thu(9, 0).AddDate(0, 0, 1), sessions: map[string]float64{"a": 4}},
+				{at: thu(17, 0).AddDate(0, 0, 2), sessions: map[string]float64{"a": 7}},
+			},
+			drops:       3,
+			typicalHour: 9,
+			weekdays:    map[string]int{"thu": 1, "fri": 1, "sat": 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := openHistory(filepath.Join(t.TempDir(), "history.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer h.Close()
+			for _, p := range tt.polls {
+				if err := h.record(historySnapshot(p.sessions), location{PinCode: "444001"}, p.at); err != nil {
+					t.Fatal(err)
+				}
+			}
+			stats, err := h.analyze(nil, 0)
+			if err != nil || len(stats) != 1 {
+				t.Fatalf("analyze() = %v, %v, want the stats of one center", stats, err)
+			}
+			s := stats[0]
+			if s.Drops != tt.drops || s.TypicalHour != tt.typicalHour || s.MedianLasts != tt.medianLasts {
+				t.Errorf("drops, typical hour, median lasts = %d, %d, %d, want %d, %d, %d",
+					s.Drops, s.TypicalHour, s.MedianLasts, tt.drops, tt.typicalHour, tt.medianLasts)
+			}
+			if !reflect.DeepEqual(s.Weekdays, tt.weekdays) {
+				t.Errorf("weekdays = %v, want %v", s.Weekdays, tt.weekdays)
+			}
+		})
+	}
+}
+
+func TestWriteStats(t *testing.T) {
+	stats := []*centerStats{
+		{CenterID: 1, Name: "Akola Civil", District: "Akola", Pincode: 444001, Drops: 3, AverageCapacity: 5,
+			TypicalHour: 23, MedianLasts: 3600, Weekdays: map[string]int{"thu": 2, "fri": 1}},
+		{CenterID: 2, Name: "Idle", District: "Akola", Pincode: 444002, TypicalHour: -1, Weekdays: map[string]int{}},
+	}
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{
+			format: tableOutput,
+			want: `ID  CENTER       PINCODE  DROPS  AVG CAPACITY  TYPICAL TIME  LASTS   BUSIEST DAY
+1   Akola Civil  444001   3      5.0           23:00-00:00   1h0m0s  thu
+2   Idle         444002   0      0.0           -             -       -
+`,
+		},
+		{
+			format: jsonOutput,
+			want: `[{"center_id":1,"name":"Akola Civil","district":"Akola","pincode":444001,"drops":3,"average_capacity":5,` +
+				`"typical_hour":23,"median_lasts_seconds":3600,"hours":[0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0],` +
+				`"weekdays":{"fri":1,"thu":2}},` +
+				`{"center_id":2,"name":"Idle","district":"Akola","pincode":444002,"drops":0,"average_capacity":0,` +
+				`"typical_hour":-1,"median_lasts_seconds":0,"hours":[0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0],"weekdays":{}}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeStats(&buf, tt.format, stats); err != nil {
+				t.Fatalf("writeStats() = %v", err)
+			}
+			got := buf.String()
+			if tt.format == jsonOutput {
+				var compact bytes.Buffer
+				if err := json.Compact(&compact, buf.Bytes()); err != nil {
+					t.Fatalf("writeStats() wrote invalid JSON: %v", err)
+				}
+				got = compact.String()
+			}
+			if got != tt.want {
+				t.Errorf("writeStats() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
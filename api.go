@@ -0,0 +1,358 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/PrasadG193/covaccine-notifier/pkg/logging"
+)
+
+// availabilityResponse is the body of GET /availability
+type availabilityResponse struct {
+	Location location     `json:"location"`
+	TakenAt  time.Time    `json:"taken_at"`
+	Slots    []slotRecord `json:"slots"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/availability", authorized(s.handleAvailability))
+	mux.HandleFunc("/locations", authorized(s.handleLocations))
+	mux.HandleFunc("/subscriptions", authorized(s.handleSubscriptions))
+	mux.HandleFunc("/subscriptions/", authorized(s.handleSubscription))
+	mux.HandleFunc("/status", authorized(s.handleStatus))
+	mux.HandleFunc("/events", authorized(s.handleEvents))
+	mux.Handle("/", dashboardHandler())
+	return mux
+}
+
+// authorized requires the token of --api-token as a bearer token, if one is
+// set. The event stream also takes it as the access_token parameter, browsers
+// cannot send headers with an EventSource.
+func authorized(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(apiToken) == 0 {
+			h(w, r)
+			return
+		}
+		token := r.URL.Query().Get("access_token")
+		if auth := r.Header.Get("Authorization"); len(auth) != 0 || r.URL.Path != "/events" {
+			token = ""
+			if strings.HasPrefix(auth, "Bearer ") {
+				token = strings.TrimPrefix(auth, "Bearer ")
+			}
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(apiToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="covaccine-notifier"`)
+			writeError(w, http.StatusUnauthorized, errors.New("Missing or invalid API token"))
+			return
+		}
+		h(w, r)
+	}
+}
+
+// handleAvailability serves GET /availability?pincode=&district_id=&age=&dose=&vaccine=&fee=&min_capacity=
+// The location, age and dose default to the ones of the flags. Only the locations
+// searched by the poller are served, so that clients cannot make the server
+// search CoWIN beyond its rate budget.
+func (s *server) handleAvailability(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	sub, err := subscriptionFromQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(sub.PinCode) == 0 && sub.DistrictID == 0 {
+		loc, ok, err := flagLocation(r.Context())
+		if err != nil {
+			writeError(w, http.StatusBadGateway, err)
+			return
+		}
+		sub.PinCode, sub.DistrictID = loc.PinCode, loc.DistrictID
+		if !ok {
+			writeError(w, http.StatusBadRequest, errors.New("Please pass either a pincode or a district_id"))
+			return
+		}
+	}
+	if err := sub.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !s.monitored(r.Context(), sub.location()) {
+		writeError(w, http.StatusNotFound, errors.Errorf("The %s is not searched, please create a subscription for it", sub.location()))
+		return
+	}
+	s.writeAvailability(w, r, sub)
+}
+
+func (s *server) writeAvailability(w http.ResponseWriter, r *http.Request, sub *subscription) {
+	snap, err := s.get(r.Context(), sub.location())
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	s.mu.Lock()
+	slots := availableSlots(snap, sub)
+	s.mu.Unlock()
+	resp := availabilityResponse{Location: sub.location(), TakenAt: snap.takenAt, Slots: []slotRecord{}}
+	for _, slot := range slots {
+		resp.Slots = append(resp.Slots, newSlotRecord(slot))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// subscriptionFromQuery reads the search parameters of a request
+func subscriptionFromQuery(q url.Values) (*subscription, error) {
+	sub := &subscription{PinCode: q.Get("pincode"), Age: age, Dose: dose}
+	ints := []struct {
+		name  string
+		value *int
+	}{
+		{"district_id", &sub.DistrictID},
+		{"age", &sub.Age},
+		{"dose", &sub.Dose},
+		{"min_capacity", &sub.MinCapacity},
+	}
+	for _, p := range ints {
+		v := q.Get(p.name)
+		if len(v) == 0 {
+			continue
+		}
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, errors.Errorf("Invalid %s %q", p.name, v)
+		}
+		*p.value = i
+	}
+	sub.Vaccines = queryList(q, "vaccine")
+	sub.Fees = queryList(q, "fee")
+	return sub, nil
+}
+
+// queryList returns the values of a repeated or comma separated parameter
+func queryList(q url.Values, name string) []string {
+	var values []string
+	for _, v := range q[name] {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); len(s) != 0 {
+				values = append(values, s)
+			}
+		}
+	}
+	return values
+}
+
+// handleLocations serves GET /locations with the states, or the districts of
+// the state with ?state_id=
+func (s *server) handleLocations(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	if v := r.URL.Query().Get("state_id"); len(v) != 0 {
+		id, err := strconv.Atoi(v)
+		if err != nil || id <= 0 {
+			writeError(w, http.StatusBadRequest, errors.Errorf("Invalid state_id %q", v))
+			return
+		}
+		dl, err := locations.districts(r.Context(), id)
+		if err != nil {
+			writeError(w, http.StatusBadGateway, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, dl)
+		return
+	}
+	states, err := locations.states(r.Context())
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, states)
+}
+
+// handleSubscriptions serves GET /subscriptions to list them and POST to create one
+func (s *server) handleSubscriptions(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+	if r.Method == http.MethodGet {
+		s.mu.Lock()
+		subs := []*subscription{}
+		for _, sub := range s.sortedSubscriptions() {
+			subs = append(subs, sub.redacted())
+		}
+		s.mu.Unlock()
+		writeJSON(w, http.StatusOK, subs)
+		return
+	}
+	if !requireJSON(w, r) {
+		return
+	}
+	sub, err := decodeSubscription(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if sub.ID, err = newSubscriptionID(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	sub.CreatedAt = time.Now().UTC()
+	logging.AddSecret(sub.Webhook)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscriptions[sub.ID] = sub
+	if err := s.saveSubscriptions(); err != nil {
+		delete(s.subscriptions, sub.ID)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	logging.Info("Created subscription", "id", sub.ID, "location", sub.location().String())
+	w.Header().Set("Location", "/subscriptions/"+sub.ID)
+	writeJSON(w, http.StatusCreated, sub.redacted())
+}
+
+// handleSubscription serves GET, PUT and DELETE /subscriptions/{id} and
+// GET /subscriptions/{id}/availability
+func (s *server) handleSubscription(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/subscriptions/"), "/")
+	id := parts[0]
+	s.mu.Lock()
+	sub, ok := s.subscriptions[id]
+	s.mu.Unlock()
+	if !ok || len(parts) > 2 || (len(parts) == 2 && parts[1] != "availability") {
+		writeSubscriptionNotFound(w)
+		return
+	}
+	if len(parts) == 2 {
+		if allowMethods(w, r, http.MethodGet) {
+			s.writeAvailability(w, r, sub)
+		}
+		return
+	}
+	if !allowMethods(w, r, http.MethodGet, http.MethodPut, http.MethodDelete) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, sub.redacted())
+	case http.MethodPut:
+		if !requireJSON(w, r) {
+			return
+		}
+		update, err := decodeSubscription(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		// The subscription is looked up again and replaced under the same
+		// lock, so that a concurrent DELETE is not undone
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if sub, ok = s.subscriptions[id]; !ok {
+			writeSubscriptionNotFound(w)
+			return
+		}
+		update.ID, update.CreatedAt = sub.ID, sub.CreatedAt
+		// A client sending back the subscription it read keeps the webhook
+		if len(sub.Webhook) != 0 && update.Webhook == sub.redacted().Webhook {
+			update.Webhook = sub.Webhook
+		}
+		logging.AddSecret(update.Webhook)
+		s.subscriptions[id] = update
+		if err := s.saveSubscriptions(); err != nil {
+			s.subscriptions[id] = sub
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		delete(s.notified, id)
+		logging.Info("Updated subscription", "id", id)
+		writeJSON(w, http.StatusOK, update.redacted())
+	case http.MethodDelete:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if sub, ok = s.subscriptions[id]; !ok {
+			writeSubscriptionNotFound(w)
+			return
+		}
+		delete(s.subscriptions, id)
+		if err := s.saveSubscriptions(); err != nil {
+			s.subscriptions[id] = sub
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		delete(s.notified, id)
+		logging.Info("Deleted subscription", "id", id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func writeSubscriptionNotFound(w http.ResponseWriter) {
+	writeError(w, http.StatusNotFound, errors.New("Subscription not found"))
+}
+
+// decodeSubscription reads and validates the subscription in the request body
+func decodeSubscription(r *http.Request) (*subscription, error) {
+	dec := json.NewDecoder(io.LimitReader(r.Body, maxRequestBody))
+	dec.DisallowUnknownFields()
+	var sub subscription
+	if err := dec.Decode(&sub); err != nil {
+		return nil, errors.Wrap(err, "Invalid subscription")
+	}
+	if err := sub.validate(); err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
+
+// requireJSON replies 415 unless the body is JSON. Browsers send the other
+// types cross-origin without asking, so any web page could post to the API.
+func requireJSON(w http.ResponseWriter, r *http.Request) bool {
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil && mt == "application/json" {
+		return true
+	}
+	writeError(w, http.StatusUnsupportedMediaType, errors.New("Please send the subscription as application/json"))
+	return false
+}
+
+// allowMethods replies 405 unless the request uses one of the methods
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		logging.Debug("Failed to write response", "err", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
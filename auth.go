@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/PrasadG193/covaccine-notifier/pkg/logging"
+)
+
+const (
+	generateOTPURLFormat = "/v2/auth/public/generateOTP"
+	confirmOTPURLFormat  = "/v2/auth/public/confirmOTP"
+
+	tokenFileName = "token.json"
+
+	// defaultTokenLifetime is used when the expiry can not be read from the token
+	defaultTokenLifetime = 15 * time.Minute
+	// tokenExpiryMargin avoids using a token which expires during the requests
+	tokenExpiryMargin = 30 * time.Second
+	// refreshBackoff is the minimum time between two automatic logins
+	refreshBackoff = 5 * time.Minute
+)
+
+var mobileRegexp = regexp.MustCompile(`^[6-9][0-9]{9}$`)
+
+// storedToken is a CoWIN bearer token saved in the data directory
+type storedToken struct {
+	Token     string    `json:"token"`
+	Mobile    string    `json:"mobile"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (t *storedToken) valid(now time.Time) bool {
+	return t != nil && len(t.Token) != 0 && now.Add(tokenExpiryMargin).Before(t.ExpiresAt)
+}
+
+var (
+	tokenMu     sync.Mutex
+	tokenLoaded bool
+	authToken   *storedToken
+	tokenWarned bool
+	// tokenRejected is set once CoWIN refuses the token so that the public endpoints are used from then on
+	tokenRejected bool
+	// lastRefresh is the time of the last automatic login
+	lastRefresh time.Time
+)
+
+// currentToken returns the stored token when it is still valid. It warns once
+// when the token has expired, the public endpoints are used in that case.
+func currentToken() string {
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+	if !tokenLoaded {
+		tokenLoaded = true
+		t, err := loadToken()
+		if err != nil {
+			logging.Warn("Ignoring the stored CoWIN token", "err", err)
+		}
+		authToken = t
+		if t != nil {
+			logging.AddSecret(t.Token)
+		}
+	}
+	if authToken == nil {
+		return ""
+	}
+	if !authToken.valid(time.Now()) {
+		if !tokenWarned {
+			tokenWarned = true
+			logging.Warn("The CoWIN token has expired, using the public endpoints. Run the auth command or use --auto-login to renew it",
+				"expired_at", authToken.ExpiresAt.Format(time.RFC3339))
+		}
+		return ""
+	}
+	return authToken.Token
+}
+
+// setToken stores a new token, making the authenticated endpoints available again
+func setToken(t *storedToken) error {
+	logging.AddSecret(t.Token)
+	tokenMu.Lock()
+	authToken, tokenLoaded, tokenWarned, tokenRejected = t, true, false, false
+	tokenMu.Unlock()
+	return saveToken(t)
+}
+
+func loadToken() (*storedToken, error) {
+	if len(dataDir) == 0 {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dataDir, tokenFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	t := &storedToken{}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// saveToken writes the token to the data directory, readable by the current user only
+func saveToken(t *storedToken) error {
+	if len(dataDir) == 0 {
+		return errors.New("No data directory to store the CoWIN token, please pass --data-dir")
+	}
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dataDir, tokenFileName), data, 0600)
+}
+
+// tokenExpiry reads the expiry from the claims of the JWT token
+func tokenExpiry(token string, issuedAt time.Time) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) == 3 {
+		payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+		if err == nil {
+			var claims struct {
+				Exp int64 `json:"exp"`
+			}
+			if json.Unmarshal(payload, &claims) == nil && claims.Exp != 0 {
+				return time.Unix(claims.Exp, 0)
+			}
+		}
+	}
+	return issuedAt.Add(defaultTokenLifetime)
+}
+
+// hashOTP returns the SHA-256 hex digest CoWIN expects instead of the OTP itself
+func hashOTP(otp string) string {
+	sum := sha256.Sum256([]byte(otp))
+	return hex.EncodeToString(sum[:])
+}
+
+// generateOTP asks CoWIN to send an OTP to the mobile number and returns the transaction ID
+func generateOTP(ctx context.Context, mobile string) (string, error) {
+	response, err := postServer(ctx, generateOTPURLFormat, map[string]string{"mobile": mobile})
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to generate OTP")
+	}
+	var otp struct {
+		TxnID string `json:"txnId"`
+	}
+	if err := json.Unmarshal(response, &otp); err != nil || len(otp.TxnID) == 0 {
+		return "", errors.New("Failed to generate OTP: unexpected response")
+	}
+	return otp.TxnID, nil
+}
+
+// confirmOTP exchanges the OTP of the transaction for a bearer token
+func confirmOTP(ctx context.Context, txnID, otp string) (string, error) {
+	response, err := postServer(ctx, confirmOTPURLFormat, map[string]string{
+		"otp":   hashOTP(otp),
+		"txnId": txnID,
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to confirm OTP")
+	}
+	var confirmed struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(response, &confirmed); err != nil || len(confirmed.Token) == 0 {
+		return "", errors.New("Failed to confirm OTP: unexpected response")
+	}
+	return confirmed.Token, nil
+}
+
+// maskMobile hides all but the last digits of the mobile number in the logs
+func maskMobile(mobile string) string {
+	if len(mobile) <= 4 {
+		return strings.Repeat("*", len(mobile))
+	}
+	return strings.Repeat("*", len(mobile)-4) + mobile[len(mobile)-4:]
+}
+
+func checkMobile(mobile string) error {
+	if !mobileRegexp.MatchString(mobile) {
+		return errors.New("Invalid mobile number, please use the 10 digit number registered on CoWIN")
+	}
+	return nil
+}
+
+// authenticate logs in to CoWIN with the OTP provided by src and stores the token
+func authenticate(ctx context.Context, mobile string, src OTPSource) (*storedToken, error) {
+	sentAt := time.Now()
+	txnID, err := generateOTP(ctx, mobile)
+	if err != nil {
+		return nil, err
+	}
+	otpCtx, cancel := context.WithTimeout(ctx, otpTimeout)
+	defer cancel()
+	otp, err := src.ReadOTP(otpCtx, mobile, sentAt)
+	if err != nil {
+		return nil, err
+	}
+	token, err := confirmOTP(ctx, txnID, otp)
+	if err != nil {
+		return nil, err
+	}
+	t := &storedToken{
+		Token:     token,
+		Mobile:    mobile,
+		ExpiresAt: tokenExpiry(token, time.Now()),
+	}
+	return t, setToken(t)
+}
+
+// refreshToken logs in again with the OTP source when --auto-login is set and the
+// stored token is about to expire. Failures are logged and the public endpoints
+// are used until the next attempt.
+func refreshToken(ctx context.Context) {
+	if !autoLogin || len(cowinToken) != 0 {
+		return
+	}
+	currentToken()
+	tokenMu.Lock()
+	t := authToken
+	// Renew ahead of the expiry so that the next poll still has a valid token.
+	// CoWIN limits the OTPs sent to a number, do not retry a failed login right away.
+	if t.valid(time.Now().Add(time.Duration(interval)*time.Second)) || time.Since(lastRefresh) < refreshBackoff {
+		tokenMu.Unlock()
+		return
+	}
+	lastRefresh = time.Now()
+	tokenMu.Unlock()
+	src, err := getOTPSource()
+	if err != nil {
+		logging.Error("Failed to refresh the CoWIN token", "err", err)
+		return
+	}
+	logging.Info("Refreshing the CoWIN token", "mobile", maskMobile(mobile))
+	t, err = authenticate(ctx, mobile, src)
+	if err != nil {
+		logging.Error("Failed to refresh the CoWIN token", "err", err)
+		return
+	}
+	logging.Info("Refreshed the CoWIN token", "expires_at", t.ExpiresAt.Format(time.RFC3339))
+}
+
+func checkAuthFlags() error {
+	if !autoLogin {
+		return nil
+	}
+	if err := checkMobile(mobile); err != nil {
+		return err
+	}
+	if otpTimeout <= 0 {
+		return errors.New("Invalid OTP timeout, please use a positive duration")
+	}
+	_, err := getOTPSource()
+	return err
+}
+
+// Auth logs in to CoWIN so that the authenticated endpoints can be used
+func Auth(ctx context.Context) error {
+	// --mobile is a flag of the root command, so it is not marked as required on auth
+	if len(mobile) == 0 {
+		return errors.New("Missing mobile number, please pass --mobile")
+	}
+	if err := checkMobile(mobile); err != nil {
+		return err
+	}
+	src, err := getOTPSource()
+	if err != nil {
+		return err
+	}
+	t, err := authenticate(ctx, mobile, src)
+	if err != nil {
+		return err
+	}
+	logging.Info("Authenticated with CoWIN", "mobile", maskMobile(t.Mobile), "expires_at", t.ExpiresAt.Format(time.RFC3339))
+	return nil
+}
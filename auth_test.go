@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthMissingMobile(t *testing.T) {
+	resetFlags(t)
+	mobile = ""
+	err := Auth(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "--mobile") {
+		t.Errorf("Auth() = %v, want an error asking for --mobile", err)
+	}
+}
+
+func TestMaskMobile(t *testing.T) {
+	for mobile, want := range map[string]string{
+		"9876543210": "******3210",
+		"123":        "***",
+		"":           "",
+	} {
+		if got := maskMobile(mobile); got != want {
+			t.Errorf("maskMobile(%q) = %q, want %q", mobile, got, want)
+		}
+	}
+}
+
+func TestRefreshTokenBackoff(t *testing.T) {
+	resetFlags(t)
+	autoLogin, mobile, otpSource = true, "9876543210", "unknown"
+	prevSrc := otpSrc
+	otpSrc = nil
+	tokenMu.Lock()
+	prev := lastRefresh
+	lastRefresh = time.Time{}
+	tokenMu.Unlock()
+	t.Cleanup(func() {
+		otpSrc = prevSrc
+		tokenMu.Lock()
+		lastRefresh = prev
+		tokenMu.Unlock()
+	})
+
+	// The first attempt fails on the OTP source, the next one waits for the backoff
+	refreshToken(context.Background())
+	tokenMu.Lock()
+	first := lastRefresh
+	tokenMu.Unlock()
+	if first.IsZero() {
+		t.Fatal("refreshToken() did not try to login")
+	}
+	refreshToken(context.Background())
+	tokenMu.Lock()
+	second := lastRefresh
+	tokenMu.Unlock()
+	if !second.Equal(first) {
+		t.Errorf("refreshToken() tried again after %v, want to wait %v", second.Sub(first), refreshBackoff)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/PrasadG193/covaccine-notifier/pkg/logging"
+)
+
+const beneficiariesURLFormat = "/v2/appointment/beneficiaries"
+
+// Beneficiary is a person registered on the CoWIN account
+type Beneficiary struct {
+	ReferenceID       string        `json:"beneficiary_reference_id"`
+	Name              string        `json:"name"`
+	BirthYear         string        `json:"birth_year"`
+	Gender            string        `json:"gender"`
+	VaccinationStatus string        `json:"vaccination_status"`
+	Vaccine           string        `json:"vaccine"`
+	Dose1Date         string        `json:"dose1_date"`
+	Dose2Date         string        `json:"dose2_date"`
+	Appointments      []Appointment `json:"appointments"`
+}
+
+// Appointment is a booked vaccination of a beneficiary
+type Appointment struct {
+	AppointmentID string `json:"appointment_id"`
+	CenterID      int    `json:"center_id"`
+	Name          string `json:"name"`
+	Date          string `json:"date"`
+	Dose          int    `json:"dose"`
+	SessionID     string `json:"session_id"`
+	Slot          string `json:"slot"`
+}
+
+type beneficiaryList struct {
+	Beneficiaries []Beneficiary `json:"beneficiaries"`
+}
+
+// fetchBeneficiaries returns the beneficiaries of the authenticated account
+func fetchBeneficiaries(ctx context.Context) ([]Beneficiary, error) {
+	if len(bearerToken()) == 0 {
+		return nil, errors.New("Fetching beneficiaries needs a valid CoWIN token, please run the auth command")
+	}
+	response, err := queryServer(ctx, beneficiariesURLFormat)
+	if errors.Is(err, errUnauthorized) {
+		return nil, errUnauthenticated
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to fetch beneficiaries")
+	}
+	bl := beneficiaryList{}
+	if err := json.Unmarshal(response, &bl); err != nil {
+		return nil, errors.Wrap(err, "Failed to parse beneficiaries")
+	}
+	return bl.Beneficiaries, nil
+}
+
+// hasAppointment reports whether the beneficiary already booked the dose
+func (b Beneficiary) hasAppointment(dose int) bool {
+	for _, a := range b.Appointments {
+		if a.Dose == dose {
+			return true
+		}
+	}
+	return false
+}
+
+// lastBeneficiaries keeps the beneficiaries of the last successful fetch, used when CoWIN fails
+var lastBeneficiaries []Beneficiary
+
+// criteria returns the preferences matching the next dose of the beneficiary.
+// It returns false when the beneficiary is fully vaccinated or already has an
+// appointment for the next dose.
+func (b Beneficiary) criteria(now time.Time) (criteria, bool) {
+	c := criteria{
+		Vaccines:    vaccines,
+		MinCapacity: minCapacity,
+		Beneficiary: b.Name,
+	}
+	if year, err := strconv.Atoi(b.BirthYear); err == nil {
+		c.Age = now.Year() - year
+	}
+	switch {
+	case len(b.Dose1Date) == 0:
+		c.Dose = 1
+	case len(b.Dose2Date) == 0:
+		c.Dose = 2
+		// The second dose has to be the vaccine of the first one, any of the
+		// preferences when CoWIN does not tell it
+		if len(b.Vaccine) != 0 {
+			c.Vaccines = []string{b.Vaccine}
+		}
+		if first, err := parseDate(b.Dose1Date); err == nil {
+			c.FirstDose = first
+		}
+	default:
+		return c, false
+	}
+	if b.hasAppointment(c.Dose) {
+		return c, false
+	}
+	return c, true
+}
+
+// beneficiaryCriteria returns the criteria of the selected beneficiaries, or of
+// all the beneficiaries of the account when none is selected
+func beneficiaryCriteria(ctx context.Context) ([]criteria, error) {
+	all, err := fetchBeneficiaries(ctx)
+	if err != nil {
+		if lastBeneficiaries == nil {
+			return nil, err
+		}
+		logging.Warn("Using the previously fetched beneficiaries", "err", err)
+		all = lastBeneficiaries
+	}
+	lastBeneficiaries = all
+
+	selected := make(map[string]bool, len(beneficiaryIDs))
+	for _, id := range beneficiaryIDs {
+		selected[id] = true
+	}
+	now := time.Now()
+	var crits []criteria
+	for _, b := range all {
+		if len(selected) != 0 && !selected[b.ReferenceID] {
+			continue
+		}
+		c, ok := b.criteria(now)
+		if !ok {
+			logging.Debug("Skipping beneficiary without a pending dose", "beneficiary", b.Name)
+			continue
+		}
+		crits = append(crits, c)
+	}
+	return crits, nil
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/PrasadG193/covaccine-notifier/pkg/logging"
+)
+
+const (
+	captchaURLFormat  = "/v2/auth/getRecaptcha"
+	scheduleURLFormat = "/v2/appointment/schedule"
+
+	bookingsFileName = "bookings.json"
+	captchaFileName  = "captcha.svg"
+)
+
+// booking is an appointment scheduled by the book command
+type booking struct {
+	BeneficiaryID string    `json:"beneficiary_id"`
+	Confirmation  string    `json:"confirmation"`
+	CenterID      int       `json:"center_id"`
+	Center        string    `json:"center"`
+	SessionID     string    `json:"session_id"`
+	Date          string    `json:"date"`
+	Slot          string    `json:"slot"`
+	Dose          int       `json:"dose"`
+	BookedAt      time.Time `json:"booked_at"`
+}
+
+type scheduleRequest struct {
+	CenterID      int      `json:"center_id"`
+	SessionID     string   `json:"session_id"`
+	Slot          string   `json:"slot"`
+	Dose          int      `json:"dose"`
+	Beneficiaries []string `json:"beneficiaries"`
+	Captcha       string   `json:"captcha"`
+}
+
+// prompter asks questions on the terminal
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+func (p *prompter) ask(question string) (string, error) {
+	fmt.Fprint(p.out, question)
+	answer, err := p.in.ReadString('\n')
+	if err != nil && len(answer) == 0 {
+		return "", err
+	}
+	return strings.TrimSpace(answer), nil
+}
+
+func loadBookings() (map[string]booking, error) {
+	bookings := map[string]booking{}
+	if len(dataDir) == 0 {
+		return bookings, nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dataDir, bookingsFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return bookings, nil
+		}
+		return nil, errors.Wrap(err, "Failed to read bookings")
+	}
+	if err := json.Unmarshal(data, &bookings); err != nil {
+		return nil, errors.Wrap(err, "Failed to parse bookings")
+	}
+	return bookings, nil
+}
+
+func saveBookings(bookings map[string]booking) error {
+	if len(dataDir) == 0 {
+		return nil
+	}
+	data, err := json.MarshalIndent(bookings, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dataDir, bookingsFileName), data, 0600)
+}
+
+func checkBookFlags() error {
+	if !useBeneficiaries && dose != 1 && dose != 2 {
+		return errors.New("Booking needs a dose preference, please use --dose 1 or 2, or --use-beneficiaries")
+	}
+	if !dryRun && len(dataDir) == 0 {
+		return errors.New("Booking needs --data-dir to remember the booked beneficiaries")
+	}
+	return nil
+}
+
+// bookableBeneficiaries returns the selected beneficiaries which have no appointment for the dose
+// they are due yet, neither on CoWIN nor in the bookings made by this tool, and the dose to book.
+// A booking is for a single dose, so the beneficiaries have to be due the same one, the --dose
+// one without --use-beneficiaries.
+func bookableBeneficiaries(all []Beneficiary, ids []string, bookings map[string]booking, now time.Time) ([]Beneficiary, int, error) {
+	byID := make(map[string]Beneficiary, len(all))
+	for _, b := range all {
+		byID[b.ReferenceID] = b
+	}
+	var bookable []Beneficiary
+	bookDose := 0
+	for _, id := range ids {
+		b, ok := byID[id]
+		if !ok {
+			return nil, 0, errors.Errorf("Unknown beneficiary %s, please use one of the IDs listed on the account", id)
+		}
+		c, ok := b.criteria(now)
+		if !ok {
+			logging.Info("Skipping beneficiary without a pending dose or with an appointment for it", "beneficiary", b.Name)
+			continue
+		}
+		d := c.Dose
+		if !useBeneficiaries && d != dose {
+			logging.Warn("Skipping beneficiary due another dose than --dose", "beneficiary", b.Name, "due", d, "dose", dose)
+			continue
+		}
+		if prev, ok := bookings[id]; ok && prev.Dose == d {
+			logging.Info("Skipping beneficiary already booked", "beneficiary", b.Name, "confirmation", prev.Confirmation)
+			continue
+		}
+		if bookDose != 0 && d != bookDose {
+			return nil, 0, errors.New("The beneficiaries are due different doses, please book them separately with --beneficiary")
+		}
+		bookDose = d
+		bookable = append(bookable, b)
+	}
+	return bookable, bookDose, nil
+}
+
+// pickSlot returns the first slot with enough capacity of the dose for all the beneficiaries,
+// which also has to match the age, dose and vaccine of every beneficiary
+func pickSlot(slots []Slot, beneficiaries []Beneficiary, bookDose int, now time.Time) (Slot, bool) {
+	count := len(beneficiaries)
+	for _, slot := range slots {
+		if !availableFor(slot, beneficiaries, now) {
+			continue
+		}
+		capacity := slot.Session.AvailableCapacityDose1
+		if bookDose == 2 {
+			capacity = slot.Session.AvailableCapacityDose2
+		}
+		if capacity >= float64(count) && len(slot.Session.Slots) != 0 {
+			return slot, true
+		}
+	}
+	return Slot{}, false
+}
+
+// availableFor reports whether the slot matches the criteria of every beneficiary. The
+// search may be for the --age of the flags, the beneficiaries have their own.
+func availableFor(slot Slot, beneficiaries []Beneficiary, now time.Time) bool {
+	env := sessionEnv(slot.Center, slot.Session)
+	for _, b := range beneficiaries {
+		c, ok := b.criteria(now)
+		if !ok || !c.matches(slot.Session, env) {
+			return false
+		}
+	}
+	return true
+}
+
+// fetchCaptcha downloads the captcha of the schedule request and returns the path it is saved to
+func fetchCaptcha(ctx context.Context) (string, error) {
+	response, err := postServer(ctx, captchaURLFormat, struct{}{})
+	if errors.Is(err, errUnauthorized) {
+		return "", errUnauthenticated
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to fetch captcha")
+	}
+	var captcha struct {
+		Captcha string `json:"captcha"`
+	}
+	if err := json.Unmarshal(response, &captcha); err != nil || len(captcha.Captcha) == 0 {
+		return "", errors.New("Failed to fetch captcha: unexpected response")
+	}
+	dir := dataDir
+	if len(dir) == 0 {
+		dir = os.TempDir()
+	}
+	path, err := filepath.Abs(filepath.Join(dir, captchaFileName))
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to save captcha")
+	}
+	if err := writeFileAtomic(path, []byte(captcha.Captcha), 0600); err != nil {
+		return "", errors.Wrap(err, "Failed to save captcha")
+	}
+	return path, nil
+}
+
+func schedule(ctx context.Context, req scheduleRequest) (string, error) {
+	response, err := postServer(ctx, scheduleURLFormat, req)
+	if errors.Is(err, errUnauthorized) {
+		return "", errUnauthenticated
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to book appointment")
+	}
+	var confirmed struct {
+		Confirmation  string `json:"appointment_confirmation_no"`
+		AppointmentID string `json:"appointment_id"`
+	}
+	if err := json.Unmarshal(response, &confirmed); err != nil {
+		return "", errors.Wrap(err, "Failed to parse the booking confirmation")
+	}
+	if len(confirmed.Confirmation) == 0 {
+		confirmed.Confirmation = confirmed.AppointmentID
+	}
+	return confirmed.Confirmation, nil
+}
+
+// Book polls for a slot matching the preferences and books it for the selected
+// beneficiaries. Nothing is booked in dry-run mode, which is the default, and
+// every booking needs to be confirmed on the terminal.
+func Book(ctx context.Context, in io.Reader, out io.Writer) error {
+	if err := checkFlags(); err != nil {
+		return err
+	}
+	if err := checkBookFlags(); err != nil {
+		return err
+	}
+	defer closeHistory()
+	refreshToken(ctx)
+	all, err := fetchBeneficiaries(ctx)
+	if err != nil {
+		return err
+	}
+	if len(beneficiaryIDs) == 0 {
+		writeBeneficiaries(out, all)
+		return errors.New("Missing beneficiaries to book for, please pass --beneficiary with the IDs listed above")
+	}
+	bookings, err := loadBookings()
+	if err != nil {
+		return err
+	}
+	bookable, bookDose, err := bookableBeneficiaries(all, beneficiaryIDs, bookings, time.Now())
+	if err != nil {
+		return err
+	}
+	if len(bookable) == 0 {
+		logging.Info("No beneficiary is waiting for a dose to book")
+		return nil
+	}
+
+	ticker := time.NewTicker(time.Second * time.Duration(interval))
+	defer ticker.Stop()
+	for {
+		slots, err := checkSlots(ctx)
+		if err != nil {
+			return err
+		}
+		warnPreferences()
+		if slot, ok := pickSlot(slots, bookable, bookDose, time.Now()); ok {
+			return bookSlot(ctx, &prompter{in: bufio.NewReader(in), out: out}, slot, bookable, bookDose, bookings)
+		}
+		logging.Info("No slots available for booking, rechecking later", "beneficiaries", len(bookable), "interval", time.Duration(interval)*time.Second)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func writeBeneficiaries(w io.Writer, beneficiaries []Beneficiary) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tName\tBirth Year\tStatus\tVaccine")
+	for _, b := range beneficiaries {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", b.ReferenceID, b.Name, b.BirthYear, b.VaccinationStatus, b.Vaccine)
+	}
+	tw.Flush()
+}
+
+func bookSlot(ctx context.Context, p *prompter, slot Slot, beneficiaries []Beneficiary, bookDose int, bookings map[string]booking) error {
+	ids := make([]string, len(beneficiaries))
+	names := make([]string, len(beneficiaries))
+	for i, b := range beneficiaries {
+		ids[i], names[i] = b.ReferenceID, b.Name
+	}
+	c, s := slot.Center, slot.Session
+	fmt.Fprintf(p.out, "Found a slot for %s\n", strings.Join(names, ", "))
+	fmt.Fprintf(p.out, "  Center:  %s, %s, %s %d\n", c.Name, c.BlockName, c.DistrictName, c.Pincode)
+	fmt.Fprintf(p.out, "  Date:    %s\n", s.Date)
+	fmt.Fprintf(p.out, "  Time:    %s\n", s.Slots[0])
+	fmt.Fprintf(p.out, "  Vaccine: %s, dose %d, fee %s\n", s.Vaccine, bookDose, c.FeeType)
+	if dryRun {
+		fmt.Fprintln(p.out, "Dry run, nothing was booked. Pass --dry-run=false to book the slot.")
+		return nil
+	}
+	answer, err := p.ask("Book this slot? [y/N]: ")
+	if err != nil {
+		return errors.Wrap(err, "Failed to read confirmation")
+	}
+	if !strings.EqualFold(answer, "y") && !strings.EqualFold(answer, "yes") {
+		fmt.Fprintln(p.out, "Booking cancelled.")
+		return nil
+	}
+	path, err := fetchCaptcha(ctx)
+	if err != nil {
+		return err
+	}
+	// The captcha is an SVG image, which a terminal cannot show
+	fmt.Fprintf(p.out, "\nThe captcha is saved in %s, open it in a browser:\n\n  file://%s\n\n", path, filepath.ToSlash(path))
+	captcha, err := p.ask("Enter the captcha: ")
+	if err != nil {
+		return errors.Wrap(err, "Failed to read captcha")
+	}
+	confirmation, err := schedule(ctx, scheduleRequest{
+		CenterID:      c.CenterID,
+		SessionID:     s.SessionID,
+		Slot:          s.Slots[0],
+		Dose:          bookDose,
+		Beneficiaries: ids,
+		Captcha:       captcha,
+	})
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, id := range ids {
+		bookings[id] = booking{
+			BeneficiaryID: id,
+			Confirmation:  confirmation,
+			CenterID:      c.CenterID,
+			Center:        c.Name,
+			SessionID:     s.SessionID,
+			Date:          s.Date,
+			Slot:          s.Slots[0],
+			Dose:          bookDose,
+			BookedAt:      now,
+		}
+	}
+	if err := saveBookings(bookings); err != nil {
+		logging.Error("Failed to save bookings", "err", err)
+	}
+	logging.Info("Booked appointment", "confirmation", confirmation, "center", c.Name, "date", s.Date, "slot", s.Slots[0])
+	fmt.Fprintf(p.out, "Booked! Confirmation number: %s\n", confirmation)
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPickSlotForBeneficiaries(t *testing.T) {
+	resetFlags(t)
+	age, pinCode, useBeneficiaries = 18, "444002", true
+	if err := checkFlags(); err != nil {
+		t.Fatalf("checkFlags() = %v", err)
+	}
+	now := time.Date(2021, 5, 20, 9, 0, 0, 0, time.Local)
+	// Two beneficiaries of the account can have the same name
+	first := Beneficiary{ReferenceID: "1", Name: "Asha", BirthYear: "1990"}
+	second := Beneficiary{ReferenceID: "2", Name: "Asha", BirthYear: "1960", Vaccine: "COVAXIN", Dose1Date: "01-03-2021"}
+	unknown := Beneficiary{ReferenceID: "3", Name: "Ravi", BirthYear: "1960", Dose1Date: "01-03-2021"}
+	all := []Beneficiary{first, second, unknown}
+
+	if _, _, err := bookableBeneficiaries(all, []string{"1", "2"}, nil, now); err == nil {
+		t.Error("bookableBeneficiaries() = nil, want an error for beneficiaries due different doses")
+	}
+	bookable, bookDose, err := bookableBeneficiaries(all, []string{"2", "3"}, nil, now)
+	if err != nil || len(bookable) != 2 || bookDose != 2 {
+		t.Fatalf("bookableBeneficiaries() = %v, %d, %v, want both beneficiaries and dose 2", bookable, bookDose, err)
+	}
+
+	var crits []criteria
+	for _, b := range all {
+		c, _ := b.criteria(now)
+		crits = append(crits, c)
+	}
+	if crits[2].Vaccines != nil {
+		t.Errorf("vaccines of a second dose of an unknown vaccine = %q, want any", crits[2].Vaccines)
+	}
+	r := dateRange{From: mustParseDate(t, "20-05-2021"), To: mustParseDate(t, "26-05-2021")}
+	slots := getAvailableSessions(loadAppointments(t, "appointments.json"), r, crits)
+
+	slot, ok := pickSlot(slots, bookable, bookDose, now)
+	if !ok || slot.Session.SessionID != "s3" {
+		t.Errorf("pickSlot() = %s, %v, want the Covaxin session s3", slot.Session.SessionID, ok)
+	}
+	// A session matching the first Asha only is not available for the second one
+	if slot, ok := pickSlot(slots, []Beneficiary{second}, 1, now); ok {
+		t.Errorf("pickSlot() = %s, want no session with capacity of the first dose for the second Asha", slot.Session.SessionID)
+	}
+}
+
+func TestBookWithDoseFlag(t *testing.T) {
+	resetFlags(t)
+	age, pinCode, dose = 45, "444002", 1
+	if err := checkFlags(); err != nil {
+		t.Fatalf("checkFlags() = %v", err)
+	}
+	now := time.Date(2021, 5, 20, 9, 0, 0, 0, time.Local)
+	young := Beneficiary{ReferenceID: "1", Name: "Asha", BirthYear: "1990"}
+	vaccinated := Beneficiary{ReferenceID: "2", Name: "Ravi", BirthYear: "1960", Vaccine: "COVAXIN", Dose1Date: "01-03-2021"}
+	old := Beneficiary{ReferenceID: "3", Name: "Meera", BirthYear: "1960"}
+	all := []Beneficiary{young, vaccinated, old}
+
+	// The beneficiary due the second dose is not booked a first one
+	bookable, bookDose, err := bookableBeneficiaries(all, []string{"1", "2", "3"}, nil, now)
+	if err != nil || bookDose != 1 || len(bookable) != 2 || bookable[0].ReferenceID != "1" || bookable[1].ReferenceID != "3" {
+		t.Fatalf("bookableBeneficiaries() = %v, %d, %v, want Asha and Meera for dose 1", bookable, bookDose, err)
+	}
+
+	// The search is for --age 45, the sessions for 45+ are not for Asha
+	r := dateRange{From: mustParseDate(t, "20-05-2021"), To: mustParseDate(t, "26-05-2021")}
+	var senior []Slot
+	for _, slot := range getAvailableSessions(loadAppointments(t, "appointments.json"), r, []criteria{flagCriteria()}) {
+		if slot.Session.SessionID == "s7" {
+			senior = append(senior, slot)
+		}
+	}
+	if len(senior) != 1 {
+		t.Fatalf("found %d sessions s7, want the 45+ one", len(senior))
+	}
+	if _, ok := pickSlot(senior, []Beneficiary{young}, 1, now); ok {
+		t.Error("pickSlot() picked a 45+ session for a beneficiary of 31")
+	}
+	if _, ok := pickSlot(senior, []Beneficiary{old}, 1, now); !ok {
+		t.Error("pickSlot() = false, want the 45+ session for a beneficiary of 61")
+	}
+}
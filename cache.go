@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/PrasadG193/covaccine-notifier/pkg/logging"
+)
+
+const (
+	locationCacheFileName = "locations.json"
+
+	// defaultLocationTTL is used when CoWIN does not return a ttl
+	defaultLocationTTL = 24 * time.Hour
+)
+
+// locations caches the state and district lists for all the searches of the process
+var locations = newLocationCache("")
+
+type cachedStates struct {
+	FetchedAt time.Time `json:"fetched_at"`
+	List      StateList `json:"list"`
+}
+
+type cachedDistricts struct {
+	FetchedAt time.Time    `json:"fetched_at"`
+	List      DistrictList `json:"list"`
+}
+
+// locationCache keeps the state and district lists in memory and in a file in
+// the data directory until the ttl returned by CoWIN along with them expires
+type locationCache struct {
+	mu        sync.Mutex
+	path      string
+	loaded    bool
+	States    *cachedStates            `json:"states,omitempty"`
+	Districts map[int]*cachedDistricts `json:"districts,omitempty"`
+}
+
+// newLocationCache returns a cache persisted in dir, or only kept in memory when dir is empty
+func newLocationCache(dir string) *locationCache {
+	c := &locationCache{
+		Districts: map[int]*cachedDistricts{},
+	}
+	if len(dir) != 0 {
+		c.path = filepath.Join(dir, locationCacheFileName)
+	}
+	return c
+}
+
+// ttlDuration converts the ttl of a CoWIN location list, which is in hours
+func ttlDuration(ttl int) time.Duration {
+	if ttl <= 0 {
+		return defaultLocationTTL
+	}
+	return time.Duration(ttl) * time.Hour
+}
+
+func isFresh(fetchedAt time.Time, ttl int) bool {
+	return time.Since(fetchedAt) < ttlDuration(ttl)
+}
+
+// states returns the cached state list, fetching it when missing or expired
+func (c *locationCache) states(ctx context.Context) (StateList, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+	if c.States != nil && isFresh(c.States.FetchedAt, c.States.List.TTL) {
+		return c.States.List, nil
+	}
+	states, err := fetchStates(ctx)
+	if err != nil {
+		if c.States != nil {
+			logging.Warn("Using expired state list", "err", err)
+			return c.States.List, nil
+		}
+		return states, err
+	}
+	c.States = &cachedStates{FetchedAt: time.Now(), List: states}
+	c.save()
+	return states, nil
+}
+
+// districts returns the cached district list of a state, fetching it when missing or expired
+func (c *locationCache) districts(ctx context.Context, stateID int) (DistrictList, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+	cached := c.Districts[stateID]
+	if cached != nil && isFresh(cached.FetchedAt, cached.List.TTL) {
+		return cached.List, nil
+	}
+	dl, err := fetchDistricts(ctx, stateID)
+	if err != nil {
+		if cached != nil {
+			logging.Warn("Using expired district list", "state_id", stateID, "err", err)
+			return cached.List, nil
+		}
+		return dl, err
+	}
+	c.Districts[stateID] = &cachedDistricts{FetchedAt: time.Now(), List: dl}
+	c.save()
+	return dl, nil
+}
+
+// load reads the cache file once. A missing or corrupted file leaves the cache empty.
+func (c *locationCache) load() {
+	if c.loaded || len(c.path) == 0 {
+		return
+	}
+	c.loaded = true
+	data, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logging.Warn("Failed to read location cache", "path", c.path, "err", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		logging.Warn("Ignoring corrupted location cache", "path", c.path, "err", err)
+	}
+	if c.Districts == nil {
+		c.Districts = map[int]*cachedDistricts{}
+	}
+}
+
+func (c *locationCache) save() {
+	if len(c.path) == 0 {
+		return
+	}
+	data, err := json.Marshal(c)
+	if err == nil {
+		err = writeFileAtomic(c.path, data, 0644)
+	}
+	if err != nil {
+		logging.Warn("Failed to save location cache", "path", c.path, "err", err)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+
+	"github.com/PrasadG193/covaccine-notifier/pkg/logging"
+)
+
+const (
+	tableOutput = "table"
+	jsonOutput  = "json"
+	csvOutput   = "csv"
+
+	exitNoSlots = 1
+	exitError   = 2
+)
+
+// errNoSlots is returned by Check when no slot matches the preferences
+var errNoSlots = errors.New("No slots available")
+
+// slotRecord is the flattened form of a Slot used for the check output
+type slotRecord struct {
+	CenterID               int      `json:"center_id"`
+	Center                 string   `json:"center"`
+	State                  string   `json:"state"`
+	District               string   `json:"district"`
+	Block                  string   `json:"block"`
+	Pincode                int      `json:"pincode"`
+	FeeType                string   `json:"fee_type"`
+	SessionID              string   `json:"session_id"`
+	Date                   string   `json:"date"`
+	Vaccine                string   `json:"vaccine"`
+	MinAgeLimit            int      `json:"min_age_limit"`
+	AvailableCapacity      float64  `json:"available_capacity"`
+	AvailableCapacityDose1 float64  `json:"available_capacity_dose1"`
+	AvailableCapacityDose2 float64  `json:"available_capacity_dose2"`
+	Slots                  []string `json:"slots"`
+	Beneficiaries          []string `json:"beneficiaries,omitempty"`
+}
+
+var csvHeader = []string{"center_id", "center", "state", "district", "block", "pincode", "fee_type", "session_id",
+	"date", "vaccine", "min_age_limit", "available_capacity", "available_capacity_dose1", "available_capacity_dose2", "slots", "beneficiaries"}
+
+func newSlotRecord(slot Slot) slotRecord {
+	c, s := slot.Center, slot.Session
+	return slotRecord{
+		CenterID:               c.CenterID,
+		Center:                 c.Name,
+		State:                  c.StateName,
+		District:               c.DistrictName,
+		Block:                  c.BlockName,
+		Pincode:                c.Pincode,
+		FeeType:                c.FeeType,
+		SessionID:              s.SessionID,
+		Date:                   s.Date,
+		Vaccine:                s.Vaccine,
+		MinAgeLimit:            s.MinAgeLimit,
+		AvailableCapacity:      s.AvailableCapacity,
+		AvailableCapacityDose1: s.AvailableCapacityDose1,
+		AvailableCapacityDose2: s.AvailableCapacityDose2,
+		Slots:                  s.Slots,
+		Beneficiaries:          slot.Beneficiaries,
+	}
+}
+
+func checkOutputFlag() error {
+	switch output {
+	case tableOutput, jsonOutput, csvOutput:
+		return nil
+	}
+	return errors.New("Invalid output format, please use table, json or csv")
+}
+
+// Check searches the slots once and prints the matching ones to stdout.
+// It returns errNoSlots when nothing is available.
+func Check(ctx context.Context, args []string) error {
+	if err := checkFlags(); err != nil {
+		return err
+	}
+	if err := checkOutputFlag(); err != nil {
+		return err
+	}
+	if err := loadState(); err != nil {
+		logging.Warn("Ignoring the saved state", "err", err)
+	}
+	defer func() {
+		if err := saveState(); err != nil {
+			logging.Error("Failed to save state", "err", err)
+		}
+	}()
+	defer closeHistory()
+
+	slots, err := checkSlots(ctx)
+	if err != nil {
+		return err
+	}
+	if err := checkPreferences(); err != nil {
+		return err
+	}
+	if err := writeSlots(os.Stdout, output, slots); err != nil {
+		return err
+	}
+	if len(slots) == 0 {
+		logging.Info("No slots available", "min_capacity", minCapacity)
+		return errNoSlots
+	}
+	return nil
+}
+
+// writeSlots prints the slots to w in the given output format
+func writeSlots(w io.Writer, format string, slots []Slot) error {
+	records := make([]slotRecord, 0, len(slots))
+	for _, slot := range slots {
+		records = append(records, newSlotRecord(slot))
+	}
+	switch format {
+	case jsonOutput:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(records)
+	case csvOutput:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(csvHeader); err != nil {
+			return err
+		}
+		for _, r := range records {
+			if err := cw.Write([]string{
+				strconv.Itoa(r.CenterID), r.Center, r.State, r.District, r.Block, strconv.Itoa(r.Pincode), r.FeeType, r.SessionID,
+				r.Date, r.Vaccine, strconv.Itoa(r.MinAgeLimit), formatCapacity(r.AvailableCapacity),
+				formatCapacity(r.AvailableCapacityDose1), formatCapacity(r.AvailableCapacityDose2), strings.Join(r.Slots, ";"),
+				strings.Join(r.Beneficiaries, ";"),
+			}); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	default:
+		if len(records) == 0 {
+			return nil
+		}
+		tw := tabwriter.NewWriter(w, 1, 8, 2, ' ', 0)
+		header := "DATE\tCENTER\tPINCODE\tDISTRICT\tVACCINE\tFEE\tMIN AGE\tDOSE-1\tDOSE-2"
+		if useBeneficiaries {
+			header += "\tFOR"
+		}
+		fmt.Fprintln(tw, header)
+		for _, r := range records {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t%d\t%s\t%s", r.Date, r.Center, r.Pincode, r.District, r.Vaccine,
+				r.FeeType, r.MinAgeLimit, formatCapacity(r.AvailableCapacityDose1), formatCapacity(r.AvailableCapacityDose2))
+			if useBeneficiaries {
+				fmt.Fprintf(tw, "\t%s", strings.Join(r.Beneficiaries, ", "))
+			}
+			fmt.Fprintln(tw)
+		}
+		return tw.Flush()
+	}
+}
+
+func formatCapacity(c float64) string {
+	return strconv.FormatFloat(c, 'f', -1, 64)
+}
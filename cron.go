@@ -0,0 +1,184 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// cronSearchLimit bounds the search of the next time of an expression which
+// never matches, like the 30th of February
+const cronSearchLimit = 5 * 366 * 24 * time.Hour
+
+var (
+	cronMonths   = []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}
+	cronWeekdays = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+
+	cronAliases = map[string]string{
+		"@yearly":   "0 0 1 1 *",
+		"@annually": "0 0 1 1 *",
+		"@monthly":  "0 0 1 * *",
+		"@weekly":   "0 0 * * 0",
+		"@daily":    "0 0 * * *",
+		"@midnight": "0 0 * * *",
+		"@hourly":   "0 * * * *",
+	}
+)
+
+// cronSchedule is a cron expression with the fields minute, hour, day of the
+// month, month and day of the week, in local time
+type cronSchedule struct {
+	src                                string
+	minutes, hours, days, months, dows []bool
+	// A day matches either the day of the month or the day of the week when
+	// both are restricted, like in cron
+	anyDay, anyDow bool
+}
+
+type cronField struct {
+	name     string
+	min, max int
+	names    []string
+}
+
+var cronFields = []cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: cronMonths},
+	{name: "day of week", min: 0, max: 7, names: cronWeekdays},
+}
+
+// parseCron parses an expression like */30 8-20 * * MON-SAT or @hourly
+func parseCron(src string) (*cronSchedule, error) {
+	expr := strings.TrimSpace(src)
+	if alias, ok := cronAliases[strings.ToLower(expr)]; ok {
+		expr = alias
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, errors.Errorf("expected %d fields, got %d", len(cronFields), len(fields))
+	}
+	sets := make([][]bool, len(fields))
+	for i, f := range fields {
+		set, err := cronFields[i].parse(f)
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = set
+	}
+	// Sunday is both 0 and 7
+	if sets[4][7] {
+		sets[4][0] = true
+	}
+	return &cronSchedule{
+		src:     src,
+		minutes: sets[0],
+		hours:   sets[1],
+		days:    sets[2],
+		months:  sets[3],
+		dows:    sets[4],
+		anyDay:  strings.HasPrefix(fields[2], "*"),
+		anyDow:  strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+// parse returns the values matched by a comma separated list of *, values,
+// ranges and steps like 1-5, */15 or 8-20/2
+func (f cronField) parse(s string) ([]bool, error) {
+	set := make([]bool, f.max+1)
+	for _, part := range strings.Split(s, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return nil, errors.Errorf("invalid step in %s %q", f.name, part)
+			}
+			rng, step = part[:i], n
+		}
+		from, to := f.min, f.max
+		if rng != "*" {
+			bounds := strings.Split(rng, "-")
+			if len(bounds) > 2 {
+				return nil, errors.Errorf("invalid range in %s %q", f.name, part)
+			}
+			var err error
+			if from, err = f.value(bounds[0]); err != nil {
+				return nil, err
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = f.value(bounds[1]); err != nil {
+					return nil, err
+				}
+			} else if step > 1 {
+				// 5/15 means from 5 to the end every 15
+				to = f.max
+			}
+			if to < from {
+				return nil, errors.Errorf("invalid range in %s %q", f.name, part)
+			}
+		}
+		for v := from; v <= to; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+func (f cronField) value(s string) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(s, name) {
+			if f.min == 1 {
+				return i + 1, nil
+			}
+			return i, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, errors.Errorf("invalid %s %q", f.name, s)
+	}
+	return v, nil
+}
+
+func (c *cronSchedule) String() string {
+	return c.src
+}
+
+func (c *cronSchedule) matchesDay(t time.Time) bool {
+	day, dow := c.days[t.Day()], c.dows[t.Weekday()]
+	switch {
+	case c.anyDay && c.anyDow:
+		return true
+	case c.anyDay:
+		return dow
+	case c.anyDow:
+		return day
+	}
+	return day || dow
+}
+
+// Next returns the first minute after now matching the expression, or the
+// zero time if there is none in the next years
+func (c *cronSchedule) Next(now time.Time) time.Time {
+	t := now.Truncate(time.Minute).Add(time.Minute)
+	limit := now.Add(cronSearchLimit)
+	for t.Before(limit) {
+		switch {
+		case !c.months[t.Month()]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !c.hours[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !c.minutes[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	for _, src := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"1-2-3 * * * *",
+		"* * * FOO *",
+		"@often",
+	} {
+		if _, err := parseCron(src); err == nil {
+			t.Errorf("parseCron(%q) succeeded, want an error", src)
+		}
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	ist := time.FixedZone("IST", 5*3600+30*60)
+	// Thursday
+	now := time.Date(2021, 5, 20, 8, 10, 30, 0, ist)
+	tests := []struct {
+		src  string
+		now  time.Time
+		want time.Time
+	}{
+		{"* * * * *", now, time.Date(2021, 5, 20, 8, 11, 0, 0, ist)},
+		{"*/30 8-20 * * MON-SAT", now, time.Date(2021, 5, 20, 8, 30, 0, 0, ist)},
+		{"*/30 8-20 * * MON-SAT", time.Date(2021, 5, 20, 20, 30, 0, 0, ist), time.Date(2021, 5, 21, 8, 0, 0, 0, ist)},
+		{"*/30 8-20 * * MON-SAT", time.Date(2021, 5, 22, 21, 0, 0, 0, ist), time.Date(2021, 5, 24, 8, 0, 0, 0, ist)},
+		{"5/20 * * * *", now, time.Date(2021, 5, 20, 8, 25, 0, 0, ist)},
+		{"0 9,17 * * *", now, time.Date(2021, 5, 20, 9, 0, 0, 0, ist)},
+		{"@hourly", now, time.Date(2021, 5, 20, 9, 0, 0, 0, ist)},
+		{"@daily", now, time.Date(2021, 5, 21, 0, 0, 0, 0, ist)},
+		{"@weekly", now, time.Date(2021, 5, 23, 0, 0, 0, 0, ist)},
+		{"@monthly", now, time.Date(2021, 6, 1, 0, 0, 0, 0, ist)},
+		{"@yearly", now, time.Date(2022, 1, 1, 0, 0, 0, 0, ist)},
+		{"0 0 * * 7", now, time.Date(2021, 5, 23, 0, 0, 0, 0, ist)},
+		{"0 0 1 jan-mar *", now, time.Date(2022, 1, 1, 0, 0, 0, 0, ist)},
+		// Either the day of the month or the day of the week, like cron
+		{"0 0 25 * FRI", now, time.Date(2021, 5, 21, 0, 0, 0, 0, ist)},
+		{"0 0 25 * FRI", time.Date(2021, 5, 21, 0, 0, 0, 0, ist), time.Date(2021, 5, 25, 0, 0, 0, 0, ist)},
+		{"0 0 29 2 *", now, time.Date(2024, 2, 29, 0, 0, 0, 0, ist)},
+		// A step over every day restricts nothing, like cron
+		{"0 0 */1 * FRI", time.Date(2021, 5, 21, 0, 0, 0, 0, ist), time.Date(2021, 5, 28, 0, 0, 0, 0, ist)},
+		{"0 0 1 * */1", now, time.Date(2021, 6, 1, 0, 0, 0, 0, ist)},
+		// Never matches
+		{"0 0 30 2 *", now, time.Time{}},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.src)
+		if err != nil {
+			t.Errorf("parseCron(%q) = %v", tt.src, err)
+			continue
+		}
+		if got := c.Next(tt.now); !got.Equal(tt.want) {
+			t.Errorf("parseCron(%q).Next(%v) = %v, want %v", tt.src, tt.now, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// web has the dashboard served by serve on /
+//
+//go:embed web
+var web embed.FS
+
+// statusResponse is the body of GET /status, used by the dashboard
+type statusResponse struct {
+	Poller        pollerHealth         `json:"poller"`
+	Locations     []locationStatus     `json:"locations"`
+	Notifications []notificationRecord `json:"notifications"`
+}
+
+// locationStatus has the open sessions of a monitored location
+type locationStatus struct {
+	Location location     `json:"location"`
+	Name     string       `json:"name"`
+	TakenAt  time.Time    `json:"taken_at,omitempty"`
+	Error    string       `json:"error,omitempty"`
+	Sessions []slotRecord `json:"sessions"`
+}
+
+func dashboardHandler() http.Handler {
+	root, err := fs.Sub(web, "web")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServer(http.FS(root))
+}
+
+// handleStatus serves GET /status with the health of the poller, the open
+// sessions of every monitored location and the recent notifications
+func (s *server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp := statusResponse{Poller: s.health, Locations: []locationStatus{}, Notifications: []notificationRecord{}}
+	seen := map[location]bool{}
+	for loc := range s.snapshots {
+		seen[loc] = true
+	}
+	for loc := range s.locationErrors {
+		seen[loc] = true
+	}
+	for loc := range seen {
+		resp.Locations = append(resp.Locations, s.locationStatus(loc))
+	}
+	sort.Slice(resp.Locations, func(i, j int) bool {
+		return resp.Locations[i].Location.String() < resp.Locations[j].Location.String()
+	})
+	// The latest first
+	for i := len(s.notifications) - 1; i >= 0; i-- {
+		resp.Notifications = append(resp.Notifications, s.notifications[i])
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// locationStatus returns the sessions with capacity left in the last search
+// of the location, s.mu has to be held
+func (s *server) locationStatus(loc location) locationStatus {
+	st := locationStatus{Location: loc, Name: loc.String(), Error: s.locationErrors[loc], Sessions: []slotRecord{}}
+	snap, ok := s.snapshots[loc]
+	if !ok {
+		return st
+	}
+	st.TakenAt = snap.takenAt
+	for _, c := range snap.appnts.Centers {
+		if loc.DistrictID != 0 {
+			st.Name = c.DistrictName + ", " + c.StateName
+		}
+		for _, session := range c.Sessions {
+			if session.AvailableCapacity > 0 && snap.r.contains(session.Date) {
+				st.Sessions = append(st.Sessions, newSlotRecord(Slot{Center: c, Session: session}))
+			}
+		}
+	}
+	return st
+}
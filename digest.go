@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/PrasadG193/covaccine-notifier/pkg/logging"
+	"github.com/PrasadG193/covaccine-notifier/pkg/notify"
+)
+
+// digestTitle is the title of the digests, which may have found no slots
+const digestTitle = "Vaccination slots digest"
+
+// recordFound keeps track of the searches which found slots for the digest
+func recordFound(slots []Slot, now time.Time) {
+	if len(slots) == 0 {
+		return
+	}
+	pstate.LastFound = now
+	pstate.FoundSinceDigest++
+}
+
+// sendDigest notifies a summary of the searches since the previous digest
+func sendDigest(ctx context.Context, notifier notify.Notifier, now time.Time) error {
+	msg := digestMessage(now)
+	logging.Info("Sending digest", "message", msg)
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	if err := notifier.SendMessage(ctx, digestTitle, msg); err != nil {
+		return err
+	}
+	pstate.LastDigest = now
+	pstate.FoundSinceDigest = 0
+	return nil
+}
+
+func digestMessage(now time.Time) string {
+	period := "today"
+	if !pstate.LastDigest.IsZero() {
+		period = "since " + formatClock(pstate.LastDigest, now)
+	}
+	seen := "never seen so far"
+	if !pstate.LastFound.IsZero() {
+		seen = "last seen " + formatAgo(now.Sub(pstate.LastFound))
+	}
+	if pstate.FoundSinceDigest == 0 {
+		return fmt.Sprintf("No slots found %s in %s, %s", period, searchArea(), seen)
+	}
+	return fmt.Sprintf("Slots found by %s %s in %s, %s", plural(pstate.FoundSinceDigest, "search", "searches"), period, searchArea(), seen)
+}
+
+// searchArea describes the location searched by the flags
+func searchArea() string {
+	switch {
+	case len(pinCode) != 0:
+		return pinCode
+	case districtID != 0:
+		return fmt.Sprintf("district %d", districtID)
+	}
+	return fmt.Sprintf("%s, %s", district, state)
+}
+
+func formatAgo(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return plural(int(d/time.Minute), "minute", "minutes") + " ago"
+	case d < 48*time.Hour:
+		return plural(int(d/time.Hour), "hour", "hours") + " ago"
+	}
+	return plural(int(d/(24*time.Hour)), "day", "days") + " ago"
+}
+
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, one)
+	}
+	return fmt.Sprintf("%d %s", n, many)
+}
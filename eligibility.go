@@ -0,0 +1,71 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/PrasadG193/covaccine-notifier/pkg/logging"
+)
+
+// defaultDoseGaps is the minimum number of days between the first and the
+// second dose of a vaccine, as recommended by the government. The vaccines are
+// normalized like normalizeName does.
+var defaultDoseGaps = map[string]int{
+	"covishield": 84,
+	"covaxin":    28,
+	"sputnikv":   21,
+}
+
+// doseGaps holds the gaps set with --dose-gap over the default ones
+var doseGaps = map[string]int{}
+
+var firstDose time.Time
+
+// checkEligibilityFlags validates the first dose date and the dose gap flags
+func checkEligibilityFlags() error {
+	gaps := make(map[string]int, len(defaultDoseGaps)+len(doseGapArg))
+	for v, days := range defaultDoseGaps {
+		gaps[v] = days
+	}
+	for v, days := range doseGapArg {
+		if days < 0 {
+			return errors.Errorf("Invalid dose gap for %s, please use a positive number of days", v)
+		}
+		gaps[normalizeName(v)] = days
+	}
+	doseGaps = gaps
+
+	firstDose = time.Time{}
+	if len(firstDoseDate) == 0 {
+		return nil
+	}
+	d, err := parseDate(firstDoseDate)
+	if err != nil {
+		return errors.Errorf("Invalid first dose date %q, please use DD-MM-YYYY", firstDoseDate)
+	}
+	if dose != 2 {
+		return errors.New("The first dose date is only used for the second dose, please use --dose 2")
+	}
+	firstDose = d
+	return nil
+}
+
+// warnedDoseGaps avoids repeating the warning about a vaccine without a gap on every poll
+var warnedDoseGaps = map[string]bool{}
+
+// eligibleFrom returns the first day the second dose of the vaccine can be
+// taken after a first dose on the given day. It returns false when the gap of
+// the vaccine is unknown, it has to be set with --dose-gap.
+func eligibleFrom(first time.Time, vaccine string) (time.Time, bool) {
+	v := normalizeName(vaccine)
+	days, ok := doseGaps[v]
+	if !ok {
+		if !warnedDoseGaps[v] {
+			warnedDoseGaps[v] = true
+			logging.Warn("Skipping the sessions of a vaccine without a dose gap, please set it with --dose-gap", "vaccine", vaccine)
+		}
+		return time.Time{}, false
+	}
+	return first.AddDate(0, 0, days), true
+}
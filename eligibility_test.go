@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestEligibleFrom(t *testing.T) {
+	resetFlags(t)
+	doseGapArg = map[string]int{"zycov-d": 56}
+	if err := checkEligibilityFlags(); err != nil {
+		t.Fatalf("checkEligibilityFlags() = %v", err)
+	}
+	first := mustParseDate(t, "01-03-2021")
+	tests := []struct {
+		vaccine string
+		want    string
+		ok      bool
+	}{
+		{vaccine: "COVISHIELD", want: "24-05-2021", ok: true},
+		{vaccine: "Sputnik V", want: "22-03-2021", ok: true},
+		{vaccine: "ZYCOV-D", want: "26-04-2021", ok: true},
+		{vaccine: "CORBEVAX"},
+	}
+	for _, tt := range tests {
+		got, ok := eligibleFrom(first, tt.vaccine)
+		if ok != tt.ok || (ok && formatDate(got) != tt.want) {
+			t.Errorf("eligibleFrom(%s) = %s, %v, want %s, %v", tt.vaccine, formatDate(got), ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/PrasadG193/covaccine-notifier/pkg/logging"
+)
+
+const (
+	autoEndpoint          = "auto"
+	calendarEndpoint      = "calendar"
+	findEndpoint          = "find"
+	authenticatedEndpoint = "authenticated"
+
+	// rateLimitWindow is the window CoWIN applies its rate limit on, 100 calls per 5 minutes per IP
+	rateLimitWindow    = 300
+	defaultRateLimit   = 100
+	defaultEndpointArg = autoEndpoint
+)
+
+// errUnauthenticated is returned when an authenticated endpoint rejects the token
+var errUnauthenticated = errors.New("CoWIN rejected the authentication token")
+
+// location is the area to search, either a pin code or a district
+type location struct {
+	PinCode    string `json:"pincode,omitempty"`
+	DistrictID int    `json:"district_id,omitempty"`
+}
+
+func (l location) String() string {
+	if len(l.PinCode) != 0 {
+		return "pincode " + l.PinCode
+	}
+	return fmt.Sprintf("district %d", l.DistrictID)
+}
+
+// findSession is a session returned by the findByPin and findByDistrict
+// endpoints, which embed the center details in every session
+type findSession struct {
+	Session
+	CenterID     int     `json:"center_id"`
+	Name         string  `json:"name"`
+	StateName    string  `json:"state_name"`
+	DistrictName string  `json:"district_name"`
+	BlockName    string  `json:"block_name"`
+	Pincode      int     `json:"pincode"`
+	Lat          float64 `json:"lat"`
+	Long         float64 `json:"long"`
+	From         string  `json:"from"`
+	To           string  `json:"to"`
+	FeeType      string  `json:"fee_type"`
+	Fee          string  `json:"fee"`
+}
+
+type findSessions struct {
+	Sessions []findSession `json:"sessions"`
+}
+
+var (
+	// endpointMu guards the endpoint state below, serve searches from its handlers too
+	endpointMu   sync.Mutex
+	lastEndpoint string
+	rateWarned   bool
+)
+
+func checkEndpointFlags() error {
+	switch endpointArg {
+	case autoEndpoint, calendarEndpoint, findEndpoint:
+	case authenticatedEndpoint:
+		if len(bearerToken()) == 0 {
+			return errors.New("The authenticated endpoint needs a valid CoWIN token, please run the auth command or pass --cowin-token")
+		}
+	default:
+		return errors.New("Invalid endpoint, please use auto, calendar, find or authenticated")
+	}
+	if rateLimit <= 0 {
+		return errors.New("Invalid rate limit, please use a positive number of calls")
+	}
+	return nil
+}
+
+// bearerToken returns the CoWIN token to use for the authenticated endpoints, if any.
+// A token passed with --cowin-token takes precedence over the one stored by the auth command.
+func bearerToken() string {
+	tokenMu.Lock()
+	rejected := tokenRejected
+	tokenMu.Unlock()
+	if rejected {
+		return ""
+	}
+	if len(cowinToken) != 0 {
+		return cowinToken
+	}
+	return currentToken()
+}
+
+// callsPerPoll returns the number of CoWIN requests the endpoint needs to cover the date range
+func callsPerPoll(endpoint string, r dateRange) int {
+	days := int(r.To.Sub(r.From).Hours()/24) + 1
+	if days < 1 {
+		return 0
+	}
+	if endpoint == findEndpoint {
+		return days
+	}
+	return (days + calendarDays - 1) / calendarDays
+}
+
+// withinRateBudget reports whether polling the endpoint every interval stays under the rate limit
+func withinRateBudget(endpoint string, r dateRange, locations int) bool {
+	every := interval
+	if pi := getPollInterval(); pi > 0 {
+		every = pi
+	}
+	polls := (rateLimitWindow + every - 1) / every
+	return callsPerPoll(endpoint, r)*locations*polls <= rateLimit
+}
+
+// chooseEndpoint returns the endpoints to try in order. In auto mode the freshest
+// endpoint fitting in the rate budget comes first: the authenticated calendar when
+// a token is available, then the daily find endpoint and then the public calendar,
+// which can be up to 30 minutes late.
+func chooseEndpoint(r dateRange, locations int) []string {
+	switch endpointArg {
+	case calendarEndpoint:
+		return []string{calendarEndpoint}
+	case findEndpoint:
+		return []string{findEndpoint}
+	case authenticatedEndpoint:
+		return []string{authenticatedEndpoint, calendarEndpoint}
+	}
+	var endpoints []string
+	if len(bearerToken()) != 0 && withinRateBudget(authenticatedEndpoint, r, locations) {
+		endpoints = append(endpoints, authenticatedEndpoint)
+	}
+	if withinRateBudget(findEndpoint, r, locations) {
+		endpoints = append(endpoints, findEndpoint)
+	}
+	endpoints = append(endpoints, calendarEndpoint)
+	if !withinRateBudget(calendarEndpoint, r, locations) && warnRateOnce() {
+		logging.Warn("Polling exceeds the CoWIN rate budget, consider a longer interval or fewer days",
+			"calls_per_poll", callsPerPoll(calendarEndpoint, r)*locations, "interval", interval, "rate_limit", rateLimit)
+	}
+	return endpoints
+}
+
+// warnRateOnce reports whether the rate budget warning was not logged yet
+func warnRateOnce() bool {
+	endpointMu.Lock()
+	defer endpointMu.Unlock()
+	warn := !rateWarned
+	rateWarned = true
+	return warn
+}
+
+// fetchAppointments returns the sessions in the date range at the location
+// using the freshest endpoint available. locations is the number of locations
+// searched every interval, which all count in the rate budget.
+func fetchAppointments(ctx context.Context, r dateRange, loc location, locations int) (Appointments, error) {
+	endpoints := chooseEndpoint(r, locations)
+	var appnts Appointments
+	var err error
+	for _, endpoint := range endpoints {
+		endpointMu.Lock()
+		if endpoint != lastEndpoint {
+			logging.Info("Using CoWIN endpoint", "endpoint", endpoint)
+			lastEndpoint = endpoint
+		}
+		endpointMu.Unlock()
+		appnts, err = fetchFromEndpoint(ctx, endpoint, r, loc)
+		if !errors.Is(err, errUnauthenticated) {
+			return appnts, err
+		}
+		logging.Warn("Falling back to the public endpoints", "err", err)
+		tokenMu.Lock()
+		tokenRejected = true
+		tokenMu.Unlock()
+	}
+	return appnts, err
+}
+
+func fetchFromEndpoint(ctx context.Context, endpoint string, r dateRange, loc location) (Appointments, error) {
+	switch endpoint {
+	case authenticatedEndpoint:
+		if len(loc.PinCode) != 0 {
+			return fetchCalendar(ctx, r, calendarByPinURLFormat, loc.PinCode, true)
+		}
+		return fetchCalendar(ctx, r, calendarByDistrictURLFormat, loc.DistrictID, true)
+	case findEndpoint:
+		if len(loc.PinCode) != 0 {
+			return fetchDays(ctx, r, findByPinPublicURLFormat, loc.PinCode)
+		}
+		return fetchDays(ctx, r, findByDistrictPublicURLFormat, loc.DistrictID)
+	default:
+		if len(loc.PinCode) != 0 {
+			return fetchCalendar(ctx, r, calendarByPinPublicURLFormat, loc.PinCode, false)
+		}
+		return fetchCalendar(ctx, r, calendarByDistrictPublicURLFormat, loc.DistrictID, false)
+	}
+}
+
+// fetchDays queries the daily find endpoint for every day of the range and
+// groups the sessions by center
+func fetchDays(ctx context.Context, r dateRange, urlFormat string, location interface{}) (Appointments, error) {
+	merged := Appointments{}
+	for day := r.From; !day.After(r.To); day = day.AddDate(0, 0, 1) {
+		response, err := queryServer(ctx, fmt.Sprintf(urlFormat, location, formatDate(day)))
+		// Sometimes the public API returns "Unauthenticated access!", do not fail in that case
+		if errors.Is(err, errUnauthorized) {
+			logging.Warn("Received unexpected response, skipping the day", "date", formatDate(day))
+			continue
+		}
+		if err != nil {
+			return merged, errors.Wrap(err, "Failed to fetch appointment sessions")
+		}
+		found := findSessions{}
+		if err := json.Unmarshal(response, &found); err != nil {
+			return merged, errors.Wrap(err, "Failed to parse appointment sessions")
+		}
+		mergeAppointments(&merged, found.appointments())
+	}
+	return merged, nil
+}
+
+// appointments converts the sessions to the calendar format
+func (f findSessions) appointments() Appointments {
+	appnts := Appointments{}
+	index := map[int]int{}
+	for _, s := range f.Sessions {
+		i, ok := index[s.CenterID]
+		if !ok {
+			i = len(appnts.Centers)
+			index[s.CenterID] = i
+			appnts.Centers = append(appnts.Centers, Center{
+				CenterID:     s.CenterID,
+				Name:         s.Name,
+				StateName:    s.StateName,
+				DistrictName: s.DistrictName,
+				BlockName:    s.BlockName,
+				Pincode:      s.Pincode,
+				Lat:          s.Lat,
+				Long:         s.Long,
+				From:         s.From,
+				To:           s.To,
+				FeeType:      s.FeeType,
+			})
+		}
+		c := &appnts.Centers[i]
+		c.Sessions = append(c.Sessions, s.Session)
+		if len(s.Fee) != 0 && s.Fee != "0" && !hasVaccineFee(c.VaccineFees, s.Vaccine) {
+			c.VaccineFees = append(c.VaccineFees, VaccineFee{Vaccine: s.Vaccine, Fee: s.Fee})
+		}
+	}
+	return appnts
+}
+
+func hasVaccineFee(fees []VaccineFee, vaccine string) bool {
+	for _, f := range fees {
+		if f.Vaccine == vaccine {
+			return true
+		}
+	}
+	return false
+}
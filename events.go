@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/PrasadG193/covaccine-notifier/pkg/logging"
+)
+
+const (
+	slotAppeared = "slot-appeared"
+	slotChanged  = "slot-changed"
+	slotGone     = "slot-gone"
+
+	// maxRecentEvents is the number of events kept to replay them to the
+	// clients reconnecting with Last-Event-ID
+	maxRecentEvents = 256
+	// eventBuffer is the number of events a client can lag behind before it is disconnected
+	eventBuffer = 64
+	// keepAliveInterval keeps idle streams open through proxies
+	keepAliveInterval = 30 * time.Second
+	// reconnectDelay is the delay in milliseconds for the clients to reconnect after
+	reconnectDelay = 5000
+)
+
+// slotEvent is a change of an open session between two searches of a location
+type slotEvent struct {
+	ID       uint64     `json:"id"`
+	Type     string     `json:"type"`
+	Time     time.Time  `json:"time"`
+	Location location   `json:"location"`
+	Session  slotRecord `json:"session"`
+	// Previous is the session in the previous search, for slot-changed
+	Previous *slotRecord `json:"previous,omitempty"`
+}
+
+// diffSnapshots returns the sessions with capacity left which appeared,
+// changed or were gone from prev to next
+func diffSnapshots(loc location, prev, next snapshot) []slotEvent {
+	before, after := openSessions(prev), openSessions(next)
+	var events []slotEvent
+	for _, id := range after.order {
+		cur := after.records[id]
+		old, ok := before.records[id]
+		switch {
+		case !ok:
+			events = append(events, slotEvent{Type: slotAppeared, Session: cur})
+		case sessionChanged(old, cur):
+			events = append(events, slotEvent{Type: slotChanged, Session: cur, Previous: &old})
+		}
+	}
+	current := next.sessions()
+	for _, id := range before.order {
+		if _, ok := after.records[id]; !ok {
+			// The session is full or no longer listed
+			gone := before.records[id]
+			gone.AvailableCapacity, gone.AvailableCapacityDose1, gone.AvailableCapacityDose2 = 0, 0, 0
+			if s, ok := current[id]; ok {
+				gone = newSlotRecord(s)
+			}
+			events = append(events, slotEvent{Type: slotGone, Session: gone})
+		}
+	}
+	for i := range events {
+		events[i].Time = next.takenAt
+		events[i].Location = loc
+	}
+	return events
+}
+
+type sessionSet struct {
+	order   []string
+	records map[string]slotRecord
+}
+
+// openSessions returns the sessions of the snapshot with capacity left in its date range
+func openSessions(snap snapshot) sessionSet {
+	set := sessionSet{records: map[string]slotRecord{}}
+	for _, c := range snap.appnts.Centers {
+		for _, s := range c.Sessions {
+			if s.AvailableCapacity <= 0 || !snap.r.contains(s.Date) {
+				continue
+			}
+			if _, ok := set.records[s.SessionID]; !ok {
+				set.order = append(set.order, s.SessionID)
+			}
+			set.records[s.SessionID] = newSlotRecord(Slot{Center: c, Session: s})
+		}
+	}
+	return set
+}
+
+// sessions returns all the sessions of the snapshot by ID
+func (snap snapshot) sessions() map[string]Slot {
+	slots := map[string]Slot{}
+	for _, c := range snap.appnts.Centers {
+		for _, s := range c.Sessions {
+			slots[s.SessionID] = Slot{Center: c, Session: s}
+		}
+	}
+	return slots
+}
+
+func sessionChanged(a, b slotRecord) bool {
+	if a.AvailableCapacity != b.AvailableCapacity || a.AvailableCapacityDose1 != b.AvailableCapacityDose1 ||
+		a.AvailableCapacityDose2 != b.AvailableCapacityDose2 || a.Vaccine != b.Vaccine ||
+		a.MinAgeLimit != b.MinAgeLimit || len(a.Slots) != len(b.Slots) {
+		return true
+	}
+	for i := range a.Slots {
+		if a.Slots[i] != b.Slots[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// eventBroker fans the slot events out to the streaming clients
+type eventBroker struct {
+	mu      sync.Mutex
+	lastID  uint64
+	recent  []slotEvent
+	clients map[chan slotEvent]bool
+	closed  bool
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{clients: map[chan slotEvent]bool{}}
+}
+
+// publish numbers the events and sends them to the clients. A client too slow
+// to keep up is disconnected, it can reconnect and catch up with Last-Event-ID.
+func (b *eventBroker) publish(events []slotEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, e := range events {
+		b.lastID++
+		e.ID = b.lastID
+		b.recent = append(b.recent, e)
+		if len(b.recent) > maxRecentEvents {
+			b.recent = b.recent[len(b.recent)-maxRecentEvents:]
+		}
+		for ch := range b.clients {
+			select {
+			case ch <- e:
+			default:
+				logging.Warn("Disconnecting a slow event stream client")
+				delete(b.clients, ch)
+				close(ch)
+			}
+		}
+	}
+}
+
+// subscribe registers a client and returns the recent events after lastID
+func (b *eventBroker) subscribe(lastID uint64) (chan slotEvent, []slotEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan slotEvent, eventBuffer)
+	if b.closed {
+		close(ch)
+		return ch, nil
+	}
+	b.clients[ch] = true
+	var missed []slotEvent
+	for _, e := range b.recent {
+		if e.ID > lastID {
+			missed = append(missed, e)
+		}
+	}
+	return ch, missed
+}
+
+func (b *eventBroker) unsubscribe(ch chan slotEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.clients[ch] {
+		delete(b.clients, ch)
+		close(ch)
+	}
+}
+
+// close ends the streams, so that the server can shut down
+func (b *eventBroker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for ch := range b.clients {
+		delete(b.clients, ch)
+		close(ch)
+	}
+}
+
+// handleEvents streams the slot events as Server-Sent Events, optionally only
+// the ones of ?pincode= or ?district_id=
+func (s *server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("Streaming is not supported"))
+		return
+	}
+	q := r.URL.Query()
+	var filter location
+	filter.PinCode = q.Get("pincode")
+	if v := q.Get("district_id"); len(v) != 0 {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errors.Errorf("Invalid district_id %q", v))
+			return
+		}
+		filter.DistrictID = id
+	}
+	var lastID uint64
+	if v := r.Header.Get("Last-Event-ID"); len(v) != 0 {
+		lastID, _ = strconv.ParseUint(v, 10, 64)
+	}
+
+	ch, missed := s.events.subscribe(lastID)
+	defer s.events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", reconnectDelay)
+
+	send := func(e slotEvent) error {
+		if (len(filter.PinCode) != 0 && filter.PinCode != e.Location.PinCode) ||
+			(filter.DistrictID != 0 && filter.DistrictID != e.Location.DistrictID) {
+			return nil
+		}
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+		return err
+	}
+	for _, e := range missed {
+		if err := send(e); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := send(e); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
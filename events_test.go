@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDiffSnapshots(t *testing.T) {
+	loc := location{PinCode: "444002"}
+	r := dateRange{From: mustParseDate(t, "20-05-2021"), To: mustParseDate(t, "26-05-2021")}
+	prev := snapshot{appnts: loadAppointments(t, "appointments.json"), r: r, takenAt: time.Date(2021, 5, 20, 8, 0, 0, 0, time.UTC)}
+	next := snapshot{appnts: loadAppointments(t, "appointments.json"), r: r, takenAt: prev.takenAt.Add(time.Minute)}
+
+	if events := diffSnapshots(loc, prev, next); len(events) != 0 {
+		t.Errorf("diffSnapshots() of the same sessions = %+v, want no events", events)
+	}
+
+	sessions := func(snap snapshot, id string) *Session {
+		for _, c := range snap.appnts.Centers {
+			for i := range c.Sessions {
+				if c.Sessions[i].SessionID == id {
+					return &c.Sessions[i]
+				}
+			}
+		}
+		t.Fatalf("no session %s", id)
+		return nil
+	}
+	// s2 opens, s3 has fewer doses, s4 is full and s5 is no longer listed
+	sessions(next, "s2").AvailableCapacity = 8
+	sessions(next, "s3").AvailableCapacity = 1
+	sessions(next, "s4").AvailableCapacity = 0
+	for i := range next.appnts.Centers {
+		if next.appnts.Centers[i].CenterID == 2 {
+			next.appnts.Centers[i].Sessions = next.appnts.Centers[i].Sessions[:1]
+		}
+	}
+	// s6 is out of the date range in both
+	sessions(next, "s6").AvailableCapacity = 30
+
+	events := diffSnapshots(loc, prev, next)
+	want := []struct {
+		typ, id  string
+		capacity float64
+	}{
+		{slotAppeared, "s2", 8},
+		{slotChanged, "s3", 1},
+		{slotGone, "s4", 0},
+		{slotGone, "s5", 0},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("diffSnapshots() = %+v, want %d events", events, len(want))
+	}
+	for i, w := range want {
+		e := events[i]
+		if e.Type != w.typ || e.Session.SessionID != w.id || e.Session.AvailableCapacity != w.capacity {
+			t.Errorf("event %d = %s %s %v, want %s %s %v", i, e.Type, e.Session.SessionID, e.Session.AvailableCapacity,
+				w.typ, w.id, w.capacity)
+		}
+		if !e.Time.Equal(next.takenAt) || e.Location != loc {
+			t.Errorf("event %d at %v for %v, want %v for %v", i, e.Time, e.Location, next.takenAt, loc)
+		}
+	}
+	if p := events[1].Previous; p == nil || p.AvailableCapacity != 5 {
+		t.Errorf("previous session of slot-changed = %+v, want the capacity of 5", p)
+	}
+	if events[0].Previous != nil {
+		t.Errorf("previous session of slot-appeared = %+v, want none", events[0].Previous)
+	}
+}
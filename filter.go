@@ -0,0 +1,322 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/PrasadG193/covaccine-notifier/pkg/expr"
+)
+
+const (
+	// earthRadius is the mean radius of the earth in km
+	earthRadius = 6371.0
+
+	// slotLayout is the time format of the CoWIN slots like 09:00AM-11:00AM
+	slotLayout = "03:04PM"
+)
+
+// timeWindow is a range of minutes since midnight
+type timeWindow struct {
+	From, To int
+}
+
+func (w timeWindow) contains(o timeWindow) bool {
+	return o.From >= w.From && o.To <= w.To
+}
+
+// sessionFilter holds the center and session filters set by the flags
+type sessionFilter struct {
+	centers, excludeCenters map[int]bool
+	blocks, excludeBlocks   map[string]bool
+	lat, long, radius       float64
+	weekdays                map[time.Weekday]bool
+	windows                 []timeWindow
+	maxFee                  int
+}
+
+var filters sessionFilter
+
+// filterExpr is the --filter expression, nil when not set
+var filterExpr *expr.Expr
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// checkFilterFlags validates the center and session filter flags
+func checkFilterFlags() error {
+	f := sessionFilter{
+		centers:        intSet(centerIDs),
+		excludeCenters: intSet(excludeCenterIDs),
+		blocks:         nameSet(blocks),
+		excludeBlocks:  nameSet(excludeBlocks),
+		radius:         radius,
+		maxFee:         maxFee,
+	}
+	if len(near) != 0 {
+		lat, long, err := parseCoordinates(near)
+		if err != nil {
+			return err
+		}
+		if radius <= 0 {
+			return errors.New("Missing radius, please pass --radius in km with --near")
+		}
+		f.lat, f.long = lat, long
+	} else if radius != 0 {
+		return errors.New("Missing location, please pass --near LAT,LONG with --radius")
+	}
+	if len(daysOfWeek) != 0 {
+		f.weekdays = make(map[time.Weekday]bool, len(daysOfWeek))
+		for _, d := range daysOfWeek {
+			// Accept full names like monday as well
+			name := strings.ToLower(strings.TrimSpace(d))
+			if len(name) > 3 {
+				name = name[:3]
+			}
+			wd, ok := weekdays[name]
+			if !ok {
+				return errors.Errorf("Invalid day of week %q, please use mon, tue, wed, thu, fri, sat or sun", d)
+			}
+			f.weekdays[wd] = true
+		}
+	}
+	for _, s := range slotWindows {
+		w, err := parseTimeWindow(s)
+		if err != nil {
+			return errors.Errorf("Invalid slot window %q, please use a range like 09:00AM-01:00PM or 09:00-13:00", s)
+		}
+		f.windows = append(f.windows, w)
+	}
+	if maxFee < 0 {
+		return errors.New("Invalid maximum fee, please use a positive amount")
+	}
+	filters = f
+	return checkFilterExpr()
+}
+
+// checkFilterExpr compiles the --filter expression against the fields of the
+// sessions to report unknown fields and type errors before searching
+func checkFilterExpr() error {
+	filterExpr = nil
+	if len(strings.TrimSpace(filterArg)) == 0 {
+		return nil
+	}
+	schema := sessionEnv(Center{}, Session{})
+	schema["search"] = flagCriteria().env()
+	e, err := expr.CompileSchema(filterArg, schema)
+	if err != nil {
+		return errors.Wrap(err, "Invalid filter")
+	}
+	filterExpr = e
+	return nil
+}
+
+// sessionEnv returns the fields of the center and the session available to the expressions
+func sessionEnv(c Center, s Session) expr.Env {
+	fee, ok := sessionFee(c, s)
+	if !ok {
+		fee = -1
+	}
+	weekday := ""
+	if d, err := parseDate(s.Date); err == nil {
+		weekday = strings.ToLower(d.Weekday().String()[:3])
+	}
+	return expr.Env{
+		"center": expr.Env{
+			"center_id":     c.CenterID,
+			"name":          c.Name,
+			"state_name":    c.StateName,
+			"district_name": c.DistrictName,
+			"block_name":    c.BlockName,
+			"pincode":       c.Pincode,
+			"lat":           c.Lat,
+			"long":          c.Long,
+			"from":          c.From,
+			"to":            c.To,
+			"fee_type":      c.FeeType,
+		},
+		"session": expr.Env{
+			"session_id":               s.SessionID,
+			"date":                     s.Date,
+			"weekday":                  weekday,
+			"available_capacity":       s.AvailableCapacity,
+			"available_capacity_dose1": s.AvailableCapacityDose1,
+			"available_capacity_dose2": s.AvailableCapacityDose2,
+			"min_age_limit":            s.MinAgeLimit,
+			"vaccine":                  s.Vaccine,
+			"fee":                      fee,
+			"slots":                    s.Slots,
+		},
+	}
+}
+
+func intSet(values []int) map[int]bool {
+	if len(values) == 0 {
+		return nil
+	}
+	set := make(map[int]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
+
+func nameSet(values []string) map[string]bool {
+	if len(values) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[normalizeName(v)] = true
+	}
+	return set
+}
+
+func parseCoordinates(s string) (float64, float64, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) == 2 {
+		lat, err1 := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+		long, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err1 == nil && err2 == nil && math.Abs(lat) <= 90 && math.Abs(long) <= 180 {
+			return lat, long, nil
+		}
+	}
+	return 0, 0, errors.Errorf("Invalid location %q, please use LAT,LONG like 18.52,73.85", s)
+}
+
+// parseTimeWindow parses a range of times like 09:00AM-11:00AM or 09:00-11:00
+func parseTimeWindow(s string) (timeWindow, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return timeWindow{}, errors.New("invalid time range")
+	}
+	from, err := parseClock(parts[0])
+	if err != nil {
+		return timeWindow{}, err
+	}
+	to, err := parseClock(parts[1])
+	if err != nil {
+		return timeWindow{}, err
+	}
+	if to <= from {
+		return timeWindow{}, errors.New("invalid time range")
+	}
+	return timeWindow{From: from, To: to}, nil
+}
+
+// parseClock returns the minutes since midnight of a time like 09:00AM or 09:00
+func parseClock(s string) (int, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	t, err := time.Parse(slotLayout, s)
+	if err != nil {
+		if t, err = time.Parse("15:04", s); err != nil {
+			return 0, err
+		}
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// distance returns the great-circle distance in km between two coordinates
+func distance(lat1, long1, lat2, long2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLong := (long2 - long1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLong/2)*math.Sin(dLong/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// matchesCenter reports whether the center passes the center, block and radius filters
+func (f sessionFilter) matchesCenter(c Center) bool {
+	if f.centers != nil && !f.centers[c.CenterID] {
+		return false
+	}
+	if f.excludeCenters[c.CenterID] {
+		return false
+	}
+	block := normalizeName(c.BlockName)
+	if f.blocks != nil && !f.blocks[block] {
+		return false
+	}
+	if f.excludeBlocks[block] {
+		return false
+	}
+	if f.radius > 0 {
+		// Centers without coordinates can not be placed
+		if c.Lat == 0 && c.Long == 0 {
+			return false
+		}
+		if distance(f.lat, f.long, c.Lat, c.Long) > f.radius {
+			return false
+		}
+	}
+	return true
+}
+
+// filterSession applies the day of week, fee and slot window filters to the
+// session of the center. It returns the session with the slots in the windows.
+func (f sessionFilter) filterSession(c Center, s Session) (Session, bool) {
+	if f.weekdays != nil {
+		d, err := parseDate(s.Date)
+		if err != nil || !f.weekdays[d.Weekday()] {
+			return s, false
+		}
+	}
+	if f.maxFee > 0 {
+		amount, ok := sessionFee(c, s)
+		if !ok || amount > f.maxFee {
+			return s, false
+		}
+	}
+	if len(f.windows) != 0 {
+		var slots []string
+		for _, slot := range s.Slots {
+			if f.inWindows(slot) {
+				slots = append(slots, slot)
+			}
+		}
+		if len(slots) == 0 {
+			return s, false
+		}
+		s.Slots = slots
+	}
+	return s, true
+}
+
+func (f sessionFilter) inWindows(slot string) bool {
+	w, err := parseTimeWindow(slot)
+	if err != nil {
+		return false
+	}
+	for _, window := range f.windows {
+		if window.contains(w) {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionFee returns the fee of the session vaccine at the center. It returns
+// false when a paid center does not publish the fee.
+func sessionFee(c Center, s Session) (int, bool) {
+	if strings.EqualFold(c.FeeType, free) {
+		return 0, true
+	}
+	for _, vf := range c.VaccineFees {
+		if strings.EqualFold(vf.Vaccine, s.Vaccine) {
+			amount, err := strconv.Atoi(vf.Fee)
+			return amount, err == nil
+		}
+	}
+	return 0, false
+}
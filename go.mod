@@ -8,4 +8,5 @@ require (
 	github.com/pkg/errors v0.9.1
 	github.com/spf13/cobra v1.1.3
 	github.com/technoweenie/multipartstreamer v1.0.1 // indirect
+	modernc.org/sqlite v1.10.6
 )
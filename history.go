@@ -0,0 +1,239 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	// Pure Go SQLite driver, the releases are built without cgo
+	_ "modernc.org/sqlite"
+
+	"github.com/PrasadG193/covaccine-notifier/pkg/logging"
+)
+
+// isoDateLayout is used for the session dates in the history so that they sort
+const isoDateLayout = "2006-01-02"
+
+// historySchema keeps every poll, the centers and sessions seen and the
+// capacity of the sessions each time it changes. Times are unix seconds.
+var historySchema = []string{
+	`CREATE TABLE IF NOT EXISTS polls (
+		id INTEGER PRIMARY KEY,
+		taken_at INTEGER NOT NULL,
+		location TEXT NOT NULL,
+		centers INTEGER NOT NULL,
+		sessions INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS centers (
+		center_id INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		state_name TEXT NOT NULL,
+		district_name TEXT NOT NULL,
+		block_name TEXT NOT NULL,
+		pincode INTEGER NOT NULL,
+		lat REAL NOT NULL,
+		long REAL NOT NULL,
+		fee_type TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS sessions (
+		session_id TEXT PRIMARY KEY,
+		center_id INTEGER NOT NULL REFERENCES centers (center_id),
+		date TEXT NOT NULL,
+		vaccine TEXT NOT NULL,
+		min_age_limit INTEGER NOT NULL,
+		first_seen INTEGER NOT NULL,
+		last_seen INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS capacities (
+		session_id TEXT NOT NULL REFERENCES sessions (session_id),
+		poll_id INTEGER NOT NULL REFERENCES polls (id),
+		taken_at INTEGER NOT NULL,
+		available_capacity REAL NOT NULL,
+		available_capacity_dose1 REAL NOT NULL,
+		available_capacity_dose2 REAL NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS capacities_session ON capacities (session_id, taken_at)`,
+	`CREATE INDEX IF NOT EXISTS sessions_center ON sessions (center_id)`,
+}
+
+type capacity struct {
+	Total, Dose1, Dose2 float64
+}
+
+// recordedCapacity is the latest capacity recorded for a session on the date
+type recordedCapacity struct {
+	capacity
+	date string
+}
+
+// historyRecorder stores the CoWIN responses in a SQLite database
+type historyRecorder struct {
+	db *sql.DB
+	// last is the latest capacity recorded for each session, until the session date has passed
+	last map[string]recordedCapacity
+}
+
+var history *historyRecorder
+
+// openHistory opens the database at path, creating the tables when needed
+func openHistory(path string) (*historyRecorder, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, errors.Wrap(err, "Failed to open history")
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to open history")
+	}
+	// SQLite allows a single writer
+	db.SetMaxOpenConns(1)
+	for _, stmt := range append([]string{"PRAGMA journal_mode=WAL", "PRAGMA busy_timeout=5000"}, historySchema...) {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, errors.Wrap(err, "Failed to prepare history")
+		}
+	}
+	return &historyRecorder{db: db, last: map[string]recordedCapacity{}}, nil
+}
+
+// Close closes the database
+func (h *historyRecorder) Close() error {
+	return h.db.Close()
+}
+
+// record stores a snapshot of the centers and sessions returned for the location
+func (h *historyRecorder) record(appnts Appointments, loc location, takenAt time.Time) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	sessions := 0
+	for _, c := range appnts.Centers {
+		sessions += len(c.Sessions)
+	}
+	now := takenAt.Unix()
+	res, err := tx.Exec(`INSERT INTO polls (taken_at, location, centers, sessions) VALUES (?, ?, ?, ?)`,
+		now, loc.String(), len(appnts.Centers), sessions)
+	if err != nil {
+		return err
+	}
+	pollID, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	changed := map[string]recordedCapacity{}
+	for _, c := range appnts.Centers {
+		if _, err := tx.Exec(`INSERT INTO centers (center_id, name, state_name, district_name, block_name, pincode, lat, long, fee_type)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (center_id) DO UPDATE SET name = excluded.name, state_name = excluded.state_name,
+				district_name = excluded.district_name, block_name = excluded.block_name, pincode = excluded.pincode,
+				lat = excluded.lat, long = excluded.long, fee_type = excluded.fee_type`,
+			c.CenterID, c.Name, c.StateName, c.DistrictName, c.BlockName, c.Pincode, c.Lat, c.Long, c.FeeType); err != nil {
+			return err
+		}
+		for _, s := range c.Sessions {
+			date := s.Date
+			if d, err := parseDate(s.Date); err == nil {
+				date = d.Format(isoDateLayout)
+			}
+			if _, err := tx.Exec(`INSERT INTO sessions (session_id, center_id, date, vaccine, min_age_limit, first_seen, last_seen)
+				VALUES (?, ?, ?, ?, ?, ?, ?)
+				ON CONFLICT (session_id) DO UPDATE SET vaccine = excluded.vaccine,
+					min_age_limit = excluded.min_age_limit, last_seen = excluded.last_seen`,
+				s.SessionID, c.CenterID, date, s.Vaccine, s.MinAgeLimit, now, now); err != nil {
+				return err
+			}
+			cp := capacity{Total: s.AvailableCapacity, Dose1: s.AvailableCapacityDose1, Dose2: s.AvailableCapacityDose2}
+			prev, ok, err := h.lastCapacity(tx, s.SessionID, date)
+			if err != nil {
+				return err
+			}
+			// Only the changes are kept, the capacity in between is the one of the previous row
+			if ok && prev == cp {
+				continue
+			}
+			if _, err := tx.Exec(`INSERT INTO capacities (session_id, poll_id, taken_at, available_capacity, available_capacity_dose1, available_capacity_dose2)
+				VALUES (?, ?, ?, ?, ?, ?)`, s.SessionID, pollID, now, cp.Total, cp.Dose1, cp.Dose2); err != nil {
+				return err
+			}
+			changed[s.SessionID] = recordedCapacity{capacity: cp, date: date}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for id, cp := range changed {
+		h.last[id] = cp
+	}
+	// The sessions of the past days are not returned anymore
+	today := takenAt.Format(isoDateLayout)
+	for id, cp := range h.last {
+		if cp.date < today {
+			delete(h.last, id)
+		}
+	}
+	return nil
+}
+
+// lastCapacity returns the latest capacity recorded for the session on the
+// date, reading it from the database after a restart
+func (h *historyRecorder) lastCapacity(tx *sql.Tx, sessionID, date string) (capacity, bool, error) {
+	if cp, ok := h.last[sessionID]; ok {
+		return cp.capacity, true, nil
+	}
+	var cp capacity
+	err := tx.QueryRow(`SELECT available_capacity, available_capacity_dose1, available_capacity_dose2 FROM capacities
+		WHERE session_id = ? ORDER BY taken_at DESC LIMIT 1`, sessionID).Scan(&cp.Total, &cp.Dose1, &cp.Dose2)
+	if err == sql.ErrNoRows {
+		return cp, false, nil
+	}
+	if err != nil {
+		return cp, false, err
+	}
+	h.last[sessionID] = recordedCapacity{capacity: cp, date: date}
+	return cp, true, nil
+}
+
+// recordHistory stores the appointments in the history database when --history
+// is set. Failures are logged, the search goes on without recording.
+func recordHistory(appnts Appointments, loc location) {
+	if len(historyPath) == 0 {
+		return
+	}
+	h, err := getHistory()
+	if err != nil {
+		logging.Error("Failed to record history", "err", err)
+		return
+	}
+	if err := h.record(appnts, loc, time.Now()); err != nil {
+		logging.Error("Failed to record history", "err", err)
+	}
+}
+
+// getHistory returns the history database of --history, opening it on first use
+func getHistory() (*historyRecorder, error) {
+	if history != nil {
+		return history, nil
+	}
+	h, err := openHistory(historyPath)
+	if err != nil {
+		return nil, err
+	}
+	history = h
+	return h, nil
+}
+
+// closeHistory closes the history database if it was opened
+func closeHistory() {
+	if history == nil {
+		return
+	}
+	if err := history.Close(); err != nil {
+		logging.Error("Failed to close history", "err", err)
+	}
+	history = nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// historySnapshot is a center of Akola with the sessions and their capacity
+func historySnapshot(sessions map[string]float64) Appointments {
+	c := Center{CenterID: 1, Name: "Center", DistrictName: "Akola", Pincode: 444001}
+	for sid, capacity := range sessions {
+		c.Sessions = append(c.Sessions, Session{SessionID: sid, Date: "22-05-2021", AvailableCapacity: capacity})
+	}
+	return Appointments{Centers: []Center{c}}
+}
+
+func TestHistoryRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	h, err := openHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	loc := location{PinCode: "444001"}
+	start := time.Date(2021, 5, 20, 9, 0, 0, 0, time.Local)
+	for i, sessions := range []map[string]float64{
+		{"a": 10},
+		{"a": 10, "b": 4},
+		{"a": 6, "b": 4},
+	} {
+		if err := h.record(historySnapshot(sessions), loc, start.Add(time.Duration(i)*time.Hour)); err != nil {
+			t.Fatalf("record() = %v", err)
+		}
+	}
+
+	var polls, rows int
+	if err := h.db.QueryRow(`SELECT COUNT(*) FROM polls`).Scan(&polls); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.db.QueryRow(`SELECT COUNT(*) FROM capacities`).Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	// a is stored at 10 and 6, b once at 4
+	if polls != 3 || rows != 3 {
+		t.Errorf("%d polls and %d capacities recorded, want 3 polls and only the 3 changes", polls, rows)
+	}
+
+	// The sessions are pruned once their date has passed
+	if err := h.record(Appointments{}, loc, start.AddDate(0, 0, 3)); err != nil {
+		t.Fatalf("record() = %v", err)
+	}
+	if len(h.last) != 0 {
+		t.Errorf("%d sessions kept after their date, want none", len(h.last))
+	}
+}
+
+func TestHistoryLastCapacity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	h, err := openHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	takenAt := time.Date(2021, 5, 20, 9, 0, 0, 0, time.Local)
+	if err := h.record(historySnapshot(map[string]float64{"a": 10}), location{PinCode: "444001"}, takenAt); err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+
+	// After a restart the capacity is read from the database
+	h, err = openHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	tx, err := h.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	for _, tt := range []struct {
+		sessionID string
+		want      capacity
+		ok        bool
+	}{
+		{sessionID: "a", want: capacity{Total: 10}, ok: true},
+		{sessionID: "missing", ok: false},
+	} {
+		got, ok, err := h.lastCapacity(tx, tt.sessionID, "2021-05-22")
+		if err != nil || got != tt.want || ok != tt.ok {
+			t.Errorf("lastCapacity(%q) = %+v, %v, %v, want %+v, %v", tt.sessionID, got, ok, err, tt.want, tt.ok)
+		}
+	}
+	if cp, ok := h.last["a"]; !ok || cp.date != "2021-05-22" {
+		t.Errorf("last[a] = %+v, %v, want it cached with the session date", cp, ok)
+	}
+}
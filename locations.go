@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"unicode"
+
+	"github.com/pkg/errors"
+
+	"github.com/PrasadG193/covaccine-notifier/pkg/logging"
+)
+
+const maxSuggestions = 3
+
+type State struct {
+	StateID    int    `json:"state_id"`
+	StateName  string `json:"state_name"`
+	StateNameL string `json:"state_name_l"`
+}
+
+type StateList struct {
+	States []State `json:"states"`
+	TTL    int     `json:"ttl"`
+}
+
+type District struct {
+	StateID       int    `json:"state_id"`
+	DistrictID    int    `json:"district_id"`
+	DistrictName  string `json:"district_name"`
+	DistrictNameL string `json:"district_name_l"`
+}
+
+type DistrictList struct {
+	Districts []District `json:"districts"`
+	TTL       int        `json:"ttl"`
+}
+
+func fetchStates(ctx context.Context) (StateList, error) {
+	states := StateList{}
+	response, err := queryServer(ctx, listStatesURLFormat)
+	if err != nil {
+		return states, errors.Wrap(err, "Failed to list states")
+	}
+	if err := json.Unmarshal(response, &states); err != nil {
+		return states, errors.Wrap(err, "Failed to parse states")
+	}
+	return states, nil
+}
+
+func fetchDistricts(ctx context.Context, stateID int) (DistrictList, error) {
+	dl := DistrictList{}
+	response, err := queryServer(ctx, fmt.Sprintf(listDistrictsURLFormat, stateID))
+	if err != nil {
+		return dl, errors.Wrap(err, "Failed to list districts")
+	}
+	if err := json.Unmarshal(response, &dl); err != nil {
+		return dl, errors.Wrap(err, "Failed to parse districts")
+	}
+	return dl, nil
+}
+
+// resolveDistrictID returns the district ID passed with --district-id or
+// looks it up from the state and district names
+func resolveDistrictID(ctx context.Context) (int, error) {
+	if districtID != 0 {
+		return districtID, nil
+	}
+	stateID, err := getStateIDByName(ctx, state)
+	if err != nil {
+		return 0, err
+	}
+	return getDistrictIDByName(ctx, stateID, district)
+}
+
+func getStateIDByName(ctx context.Context, state string) (int, error) {
+	states, err := locations.states(ctx)
+	if err != nil {
+		return 0, err
+	}
+	names := make([]string, 0, len(states.States))
+	for _, s := range states.States {
+		if strings.EqualFold(s.StateName, state) {
+			logging.Debug("Found state", "id", s.StateID, "name", s.StateName)
+			return s.StateID, nil
+		}
+		names = append(names, s.StateName)
+	}
+	return 0, errors.New("Invalid state name passed" + didYouMean(state, names))
+}
+
+func getDistrictIDByName(ctx context.Context, stateID int, district string) (int, error) {
+	dl, err := locations.districts(ctx, stateID)
+	if err != nil {
+		return 0, err
+	}
+	names := make([]string, 0, len(dl.Districts))
+	for _, d := range dl.Districts {
+		if strings.EqualFold(d.DistrictName, district) {
+			logging.Debug("Found district", "id", d.DistrictID, "name", d.DistrictName)
+			return d.DistrictID, nil
+		}
+		names = append(names, d.DistrictName)
+	}
+	return 0, errors.New("Invalid district name passed" + didYouMean(district, names))
+}
+
+// didYouMean returns a hint listing the candidates closest to name, or an
+// empty string when none of them is similar enough
+func didYouMean(name string, candidates []string) string {
+	suggestions := suggest(name, candidates)
+	if len(suggestions) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(", did you mean %s? Use the list command to see all the names", quoteList(suggestions))
+}
+
+// suggest returns the candidates similar to name, closest first. A candidate is
+// similar when one name contains the other or when their edit distance is small
+// compared to their length.
+func suggest(name string, candidates []string) []string {
+	type match struct {
+		name     string
+		distance int
+	}
+	n := normalizeName(name)
+	if len(n) == 0 {
+		return nil
+	}
+	var matches []match
+	for _, c := range candidates {
+		cn := normalizeName(c)
+		if len(cn) == 0 {
+			continue
+		}
+		d := levenshtein(n, cn)
+		if strings.Contains(cn, n) || strings.Contains(n, cn) {
+			// Prefer partial names over typos of a similar length
+			d = 0
+		}
+		if d <= maxDistance(n, cn) {
+			matches = append(matches, match{c, d})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].distance < matches[j].distance })
+	var names []string
+	for i := 0; i < len(matches) && i < maxSuggestions; i++ {
+		names = append(names, matches[i].name)
+	}
+	return names
+}
+
+func maxDistance(a, b string) int {
+	l := len(a)
+	if len(b) < l {
+		l = len(b)
+	}
+	if l/3 > 2 {
+		return l / 3
+	}
+	return 2
+}
+
+// normalizeName lowercases s and drops everything but letters and digits so
+// that "Bangalore-Urban" and "bangalore urban" compare equal
+func normalizeName(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// levenshtein returns the number of single character edits needed to turn a into b
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func minInt(v int, vs ...int) int {
+	for _, x := range vs {
+		if x < v {
+			v = x
+		}
+	}
+	return v
+}
+
+func quoteList(names []string) string {
+	quoted := make([]string, len(names))
+	for i, n := range names {
+		quoted[i] = strconv.Quote(n)
+	}
+	if len(quoted) == 1 {
+		return quoted[0]
+	}
+	return strings.Join(quoted[:len(quoted)-1], ", ") + " or " + quoted[len(quoted)-1]
+}
+
+// ListStates prints all the states known to CoWIN
+func ListStates(ctx context.Context, w io.Writer) error {
+	if err := checkOutputFlag(); err != nil {
+		return err
+	}
+	states, err := locations.states(ctx)
+	if err != nil {
+		return err
+	}
+	var ids []int
+	var names []string
+	for _, s := range states.States {
+		ids = append(ids, s.StateID)
+		names = append(names, s.StateName)
+	}
+	return writeLocations(w, output, ids, names)
+}
+
+// ListDistricts prints the districts of the state passed with --state
+func ListDistricts(ctx context.Context, w io.Writer) error {
+	if len(state) == 0 {
+		return errors.New("Missing state name option")
+	}
+	if err := checkOutputFlag(); err != nil {
+		return err
+	}
+	stateID, err := getStateIDByName(ctx, state)
+	if err != nil {
+		return err
+	}
+	dl, err := locations.districts(ctx, stateID)
+	if err != nil {
+		return err
+	}
+	var ids []int
+	var names []string
+	for _, d := range dl.Districts {
+		ids = append(ids, d.DistrictID)
+		names = append(names, d.DistrictName)
+	}
+	return writeLocations(w, output, ids, names)
+}
+
+// writeLocations prints the id and name pairs to w in the given output format
+func writeLocations(w io.Writer, format string, ids []int, names []string) error {
+	switch format {
+	case jsonOutput:
+		type location struct {
+			ID   int    `json:"id"`
+			Name string `json:"name"`
+		}
+		locations := make([]location, len(ids))
+		for i := range ids {
+			locations[i] = location{ids[i], names[i]}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(locations)
+	case csvOutput:
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"id", "name"})
+		for i := range ids {
+			cw.Write([]string{strconv.Itoa(ids[i]), names[i]})
+		}
+		cw.Flush()
+		return cw.Error()
+	default:
+		tw := tabwriter.NewWriter(w, 1, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME")
+		for i := range ids {
+			fmt.Fprintf(tw, "%d\t%s\n", ids[i], names[i])
+		}
+		return tw.Flush()
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/PrasadG193/covaccine-notifier/pkg/logging"
+)
+
+const (
+	// dateLayout is the date format used by CoWIN
+	dateLayout = "02-01-2006"
+
+	// calendarDays is the number of days returned by a calendar endpoint
+	calendarDays = 7
+)
+
+// dateRange is the inclusive range of session dates to search
+type dateRange struct {
+	From, To time.Time
+}
+
+func truncateDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+func parseDate(s string) (time.Time, error) {
+	return time.ParseInLocation(dateLayout, s, time.Local)
+}
+
+func formatDate(t time.Time) string {
+	return t.Format(dateLayout)
+}
+
+// checkDateFlags validates the lookahead and date range flags
+func checkDateFlags() error {
+	if weeks < 0 || days < 0 {
+		return errors.New("Invalid lookahead, please use a positive number of days or weeks")
+	}
+	if weeks > 0 {
+		days = weeks * calendarDays
+	}
+	if days == 0 {
+		days = defaultDays
+	}
+	var from, to time.Time
+	var err error
+	if len(fromDate) != 0 {
+		if from, err = parseDate(fromDate); err != nil {
+			return errors.Errorf("Invalid from date %q, please use DD-MM-YYYY", fromDate)
+		}
+	}
+	if len(toDate) != 0 {
+		if to, err = parseDate(toDate); err != nil {
+			return errors.Errorf("Invalid to date %q, please use DD-MM-YYYY", toDate)
+		}
+	}
+	if !from.IsZero() && !to.IsZero() && to.Before(from) {
+		return errors.New("Invalid date range, the from date is after the to date")
+	}
+	// A search has to fit in the rate limit, even with the endpoint making the
+	// fewest requests. The window only gets shorter as the days go by.
+	endpoint := calendarEndpoint
+	if endpointArg == findEndpoint {
+		endpoint = findEndpoint
+	}
+	if calls := callsPerPoll(endpoint, searchWindow(time.Now())); calls > rateLimit {
+		return errors.Errorf("Invalid date range, searching it takes %d requests, more than the rate limit of %d, please use a shorter range", calls, rateLimit)
+	}
+	return nil
+}
+
+// searchWindow returns the range of dates to search on the given day. It
+// starts today or on the from date and ends on the to date if one is given,
+// or after the lookahead days otherwise.
+func searchWindow(now time.Time) dateRange {
+	r := dateRange{From: truncateDay(now)}
+	if len(fromDate) != 0 {
+		if from, err := parseDate(fromDate); err == nil && from.After(r.From) {
+			r.From = from
+		}
+	}
+	r.To = r.From.AddDate(0, 0, days-1)
+	if len(toDate) != 0 {
+		if to, err := parseDate(toDate); err == nil {
+			r.To = to
+		}
+	}
+	return r
+}
+
+// contains reports whether the CoWIN formatted date is in the range
+func (r dateRange) contains(date string) bool {
+	d, err := parseDate(date)
+	if err != nil {
+		return false
+	}
+	return !d.Before(r.From) && !d.After(r.To)
+}
+
+// fetchCalendar queries the weekly calendar endpoint for every week of the
+// range and merges the results. urlFormat takes the location and the start date.
+func fetchCalendar(ctx context.Context, r dateRange, urlFormat string, location interface{}, authenticated bool) (Appointments, error) {
+	merged := Appointments{}
+	if r.To.Before(r.From) {
+		return merged, nil
+	}
+	for start := r.From; !start.After(r.To); start = start.AddDate(0, 0, calendarDays) {
+		response, err := queryServer(ctx, fmt.Sprintf(urlFormat, location, formatDate(start)))
+		if errors.Is(err, errUnauthorized) {
+			if authenticated {
+				return merged, errUnauthenticated
+			}
+			// Sometimes the public API returns "Unauthenticated access!", do not fail in that case
+			logging.Warn("Received unexpected response, skipping the week", "from", formatDate(start))
+			continue
+		}
+		if err != nil {
+			return merged, errors.Wrap(err, "Failed to fetch appointment sessions")
+		}
+		week := Appointments{}
+		if err := json.Unmarshal(response, &week); err != nil {
+			return merged, errors.Wrap(err, "Failed to parse appointment sessions")
+		}
+		mergeAppointments(&merged, week)
+	}
+	return merged, nil
+}
+
+// mergeAppointments adds the centers and sessions of src missing in dst
+func mergeAppointments(dst *Appointments, src Appointments) {
+	index := make(map[int]int, len(dst.Centers))
+	for i, c := range dst.Centers {
+		index[c.CenterID] = i
+	}
+	for _, c := range src.Centers {
+		i, ok := index[c.CenterID]
+		if !ok {
+			index[c.CenterID] = len(dst.Centers)
+			dst.Centers = append(dst.Centers, c)
+			continue
+		}
+		known := make(map[string]bool, len(dst.Centers[i].Sessions))
+		for _, s := range dst.Centers[i].Sessions {
+			known[s.SessionID] = true
+		}
+		for _, s := range c.Sessions {
+			if !known[s.SessionID] {
+				dst.Centers[i].Sessions = append(dst.Centers[i].Sessions, s)
+			}
+		}
+	}
+}
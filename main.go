@@ -1,26 +1,65 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 
+	"github.com/PrasadG193/covaccine-notifier/pkg/logging"
 	"github.com/PrasadG193/covaccine-notifier/pkg/notify"
 )
 
 var (
-	pinCode, state, district, vaccine, fee   string
+	pinCode, state, district                 string
 	username, password, token, mattermostURL string
+	logLevel, logFormat, dataDir, output     string
+	fromDate, toDate, firstDoseDate          string
+	endpointArg, cowinToken, mobile          string
+	otpSource, otpListen, otpSecret, otpFile string
 	age, interval, minCapacity, dose         int
+	days, weeks, rateLimit                   int
+	autoLogin, dryRun, useBeneficiaries      bool
+	beneficiaryIDs                           []string
+	doseGapArg                               map[string]int
+	centerIDs, excludeCenterIDs              []int
+	blocks, excludeBlocks, daysOfWeek        []string
+	slotWindows, vaccines, fees              []string
+	near, filterArg, historyPath             string
+	radius                                   float64
+	maxFee, fastInterval                     int
+	adaptive                                 bool
+	activeHours, quietHours                  []string
+	scheduleArg, digestArg, heartbeatArg     string
+	listen, mockListen, recordDir, replayDir string
+	smtpServer, apiToken                     string
+	alertAfter                               int
+	scenarios                                []string
+	appearAfter                              time.Duration
+	failureRate                              float64
+	requestTimeout, otpTimeout, since        time.Duration
 
 	rootCmd = &cobra.Command{
 		Use:   "covaccine-notifier [FLAGS]",
 		Short: "CoWIN Vaccine availability notifier India",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			locations = newLocationCache(dataDir)
+			if err := setupLogging(); err != nil {
+				return err
+			}
+			if err := checkBaseURL(); err != nil {
+				return err
+			}
+			return setupRecording()
+		},
 	}
 
 	telegramCmd = &cobra.Command{
@@ -31,7 +70,7 @@ var (
 			if err != nil {
 				return err
 			}
-			return Run(args, notifier)
+			return Run(cmd.Context(), args, notifier)
 		},
 	}
 
@@ -43,7 +82,107 @@ var (
 			if err != nil {
 				return err
 			}
-			return Run(args, notifier)
+			return Run(cmd.Context(), args, notifier)
+		},
+	}
+
+	checkCmd = &cobra.Command{
+		Use:   "check [FLAGS]",
+		Short: "Search slots once and print them",
+		Long: `Search slots once and print them to stdout.
+
+The exit code is 0 when slots are found, 1 when no slot is available and 2 on errors.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := Check(cmd.Context(), args)
+			if errors.Is(err, errNoSlots) {
+				cmd.SilenceErrors = true
+				cmd.SilenceUsage = true
+			}
+			return err
+		},
+	}
+
+	listCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List the locations known to CoWIN",
+	}
+
+	listStatesCmd = &cobra.Command{
+		Use:   "states",
+		Short: "List the states",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return ListStates(cmd.Context(), os.Stdout)
+		},
+	}
+
+	listDistrictsCmd = &cobra.Command{
+		Use:   "districts --state STATE",
+		Short: "List the districts of a state",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return ListDistricts(cmd.Context(), os.Stdout)
+		},
+	}
+
+	authCmd = &cobra.Command{
+		Use:   "auth [FLAGS]",
+		Short: "Login to CoWIN with an OTP to use the authenticated endpoints",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return Auth(cmd.Context())
+		},
+	}
+
+	analyzeCmd = &cobra.Command{
+		Use:   "analyze --history PATH [FLAGS]",
+		Short: "Report when slots are usually published at each center",
+		Long: `Report the slot release patterns of each center from the history recorded with --history.
+
+A drop is an increase of the capacity of a session. For every center the report has the number
+of drops, the average capacity of a drop, the hour of the day most drops happen at, the median
+time until the session is full again and the day of the week with most drops.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return Analyze(os.Stdout)
+		},
+	}
+
+	serveCmd = &cobra.Command{
+		Use:   "serve [FLAGS]",
+		Short: "Serve the availability over an HTTP JSON API",
+		Long: `Search for slots in the background and serve them over an HTTP JSON API.
+
+The location of the flags, if any, and the ones of the subscriptions are searched every interval.
+The endpoints are GET /availability, GET /locations and GET, POST /subscriptions and
+GET, PUT, DELETE /subscriptions/{id}. The slots of a subscription with a webhook are posted
+to it when they change. A dashboard to follow the availability and manage the subscriptions
+is served on /, and the session changes are streamed on /events.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return Serve(cmd.Context())
+		},
+	}
+
+	mockServerCmd = &cobra.Command{
+		Use:   "mock-server [FLAGS]",
+		Short: "Serve a mock of the CoWIN API to try the notifier against",
+		Long: `Serve canned states, districts, sessions and beneficiaries like the CoWIN API.
+
+Point the other commands at it with --base-url http://localhost:8081/api. The scenarios are
+static, appearing for sessions which fill up and open again every --appear-after, flaky for
+session requests randomly failing with 401 or 403 and rate-limit for 429 beyond --rate-limit
+requests per 5 minutes. The OTP is 123456 and the captcha a7Kx2. With --replay the responses
+recorded with --record are served instead of the fixtures.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return MockServe(cmd.Context())
+		},
+	}
+
+	bookCmd = &cobra.Command{
+		Use:   "book [FLAGS]",
+		Short: "Book a slot for the beneficiaries of the CoWIN account",
+		Long: `Wait for a slot matching the preferences and book it for the beneficiaries.
+
+Nothing is booked unless --dry-run=false is passed, and every booking has to be
+confirmed and the captcha solved on the terminal. A beneficiary is booked once per dose.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return Book(cmd.Context(), os.Stdin, os.Stdout)
 		},
 	}
 
@@ -51,8 +190,11 @@ var (
 		Use:   "email [FLAGS]",
 		Short: "Notify slots availability using Email",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			notifier := notify.NewEmail(username, password)
-			return Run(args, notifier)
+			notifier, err := notify.NewSMTPEmail(username, password, smtpServer)
+			if err != nil {
+				return err
+			}
+			return Run(cmd.Context(), args, notifier)
 		},
 	}
 )
@@ -61,6 +203,7 @@ const (
 	pinCodeEnv        = "PIN_CODE"
 	stateNameEnv      = "STATE_NAME"
 	districtNameEnv   = "DISTRICT_NAME"
+	districtIDEnv     = "DISTRICT_ID"
 	ageEnv            = "AGE"
 	emailIDEnv        = "EMAIL_ID"
 	emailPasswordEnv  = "EMAIL_PASSOWORD"
@@ -74,35 +217,145 @@ const (
 	mmTokenEnv        = "MATTERMOST_TOKEN"
 	minCapacityEnv    = "MIN_CAPACITY"
 	doseEnv           = "DOSE"
+	logLevelEnv       = "LOG_LEVEL"
+	logFormatEnv      = "LOG_FORMAT"
+	requestTimeoutEnv = "REQUEST_TIMEOUT"
+	dataDirEnv        = "DATA_DIR"
+	outputEnv         = "OUTPUT"
+	daysEnv           = "DAYS"
+	weeksEnv          = "WEEKS"
+	fromDateEnv       = "FROM_DATE"
+	toDateEnv         = "TO_DATE"
+	endpointEnv       = "ENDPOINT"
+	rateLimitEnv      = "RATE_LIMIT"
+	cowinTokenEnv     = "COWIN_TOKEN"
+	mobileEnv         = "MOBILE_NUMBER"
+	autoLoginEnv      = "AUTO_LOGIN"
+	otpSourceEnv      = "OTP_SOURCE"
+	otpListenEnv      = "OTP_LISTEN"
+	otpSecretEnv      = "OTP_SECRET"
+	otpFileEnv        = "OTP_FILE"
+	otpTimeoutEnv     = "OTP_TIMEOUT"
+	beneficiaryEnv    = "BENEFICIARY_IDS"
+	beneficiariesEnv  = "USE_BENEFICIARIES"
+	firstDoseDateEnv  = "FIRST_DOSE_DATE"
+	doseGapEnv        = "DOSE_GAP"
+	centerIDsEnv      = "CENTER_IDS"
+	excludeCentersEnv = "EXCLUDE_CENTER_IDS"
+	blocksEnv         = "BLOCKS"
+	excludeBlocksEnv  = "EXCLUDE_BLOCKS"
+	nearEnv           = "NEAR"
+	radiusEnv         = "RADIUS"
+	daysOfWeekEnv     = "DAYS_OF_WEEK"
+	slotWindowsEnv    = "SLOT_WINDOWS"
+	maxFeeEnv         = "MAX_FEE"
+	filterEnv         = "FILTER"
+	historyEnv        = "HISTORY_DB"
+	adaptiveEnv       = "ADAPTIVE"
+	fastIntervalEnv   = "FAST_INTERVAL"
+	activeHoursEnv    = "ACTIVE_HOURS"
+	quietHoursEnv     = "QUIET_HOURS"
+	scheduleEnv       = "SCHEDULE"
+	digestEnv         = "DIGEST"
+	alertAfterEnv     = "ALERT_AFTER"
+	heartbeatEnv      = "HEARTBEAT"
+	listenEnv         = "LISTEN"
+	baseURLEnv        = "COWIN_BASE_URL"
+	recordEnv         = "RECORD_DIR"
+	replayEnv         = "REPLAY_DIR"
+	scenarioEnv       = "MOCK_SCENARIO"
+	smtpServerEnv     = "SMTP_SERVER"
+	apiTokenEnv       = "API_TOKEN"
 
 	defaultSearchInterval = 60
 	defaultMinCapacity    = 1
-
-	covishield = "covishield"
-	covaxin    = "covaxin"
+	defaultDays           = calendarDays
+	defaultLogLevel       = "info"
+	defaultLogFormat      = "logfmt"
+	defaultTimeout        = 30 * time.Second
 
 	free = "free"
-	paid = "paid"
 )
 
 func init() {
-	rootCmd.PersistentFlags().IntVarP(&age, "age", "a", getIntEnv(ageEnv), "Search appointment for age (required)")
-	rootCmd.MarkPersistentFlagRequired("age")
+	rootCmd.PersistentFlags().IntVarP(&age, "age", "a", getIntEnv(ageEnv), "Search appointment for age (required without --use-beneficiaries)")
 	rootCmd.PersistentFlags().StringVarP(&pinCode, "pincode", "c", os.Getenv(pinCodeEnv), "Search by pin code")
 	rootCmd.PersistentFlags().StringVarP(&state, "state", "s", os.Getenv(stateNameEnv), "Search by state name")
 	rootCmd.PersistentFlags().StringVarP(&district, "district", "d", os.Getenv(districtNameEnv), "Search by district name")
+	rootCmd.PersistentFlags().IntVar(&districtID, "district-id", getIntEnv(districtIDEnv), "Search by district ID, see the list districts command")
 	rootCmd.PersistentFlags().IntVarP(&interval, "interval", "i", getIntEnv(searchIntervalEnv), fmt.Sprintf("Interval to repeat the search. Default: (%v) second", defaultSearchInterval))
-	rootCmd.PersistentFlags().StringVarP(&vaccine, "vaccine", "v", os.Getenv(vaccineEnv), fmt.Sprintf("Vaccine preferences - covishield (or) covaxin. Default: No preference"))
-	rootCmd.PersistentFlags().StringVarP(&fee, "fee", "f", os.Getenv(feeEnv), fmt.Sprintf("Fee preferences - free (or) paid. Default: No preference"))
+	rootCmd.PersistentFlags().StringSliceVarP(&vaccines, "vaccine", "v", getSliceEnv(vaccineEnv), fmt.Sprintf("Vaccine preferences, like covishield,sputnik-v. Default: No preference"))
+	rootCmd.PersistentFlags().StringSliceVarP(&fees, "fee", "f", getSliceEnv(feeEnv), fmt.Sprintf("Fee preferences - free, paid. Default: No preference"))
 	rootCmd.PersistentFlags().IntVarP(&minCapacity, "min-capacity", "m", getIntEnv(minCapacityEnv), fmt.Sprintf("Filter by minimum vaccination capacity. Default: (%v)", defaultMinCapacity))
 	rootCmd.PersistentFlags().IntVarP(&dose, "dose", "o", getIntEnv(doseEnv), "Dose preference - 1 or 2. Default: 0 (both)")
+	rootCmd.PersistentFlags().StringVar(&firstDoseDate, "first-dose-date", os.Getenv(firstDoseDateEnv), "Date of the first dose (DD-MM-YYYY), skips second dose sessions before the dose gap")
+	rootCmd.PersistentFlags().StringToIntVar(&doseGapArg, "dose-gap", getMapEnv(doseGapEnv), "Days between the doses of a vaccine, like covishield=84,covaxin=28")
+	rootCmd.PersistentFlags().IntSliceVar(&centerIDs, "center", getIntSliceEnv(centerIDsEnv), "Only search the centers with the IDs")
+	rootCmd.PersistentFlags().IntSliceVar(&excludeCenterIDs, "exclude-center", getIntSliceEnv(excludeCentersEnv), "Skip the centers with the IDs")
+	rootCmd.PersistentFlags().StringSliceVar(&blocks, "block", getSliceEnv(blocksEnv), "Only search the centers in the blocks")
+	rootCmd.PersistentFlags().StringSliceVar(&excludeBlocks, "exclude-block", getSliceEnv(excludeBlocksEnv), "Skip the centers in the blocks")
+	rootCmd.PersistentFlags().StringVar(&near, "near", os.Getenv(nearEnv), "Search around the location (LAT,LONG), see --radius")
+	rootCmd.PersistentFlags().Float64Var(&radius, "radius", getFloatEnv(radiusEnv), "Distance in km from --near to search centers within")
+	rootCmd.PersistentFlags().StringSliceVar(&daysOfWeek, "days-of-week", getSliceEnv(daysOfWeekEnv), "Only search sessions on the days, like sat,sun")
+	rootCmd.PersistentFlags().StringSliceVar(&slotWindows, "slot-window", getSliceEnv(slotWindowsEnv), "Only search slots within the time ranges, like 09:00AM-11:00AM")
+	rootCmd.PersistentFlags().IntVar(&maxFee, "max-fee", getIntEnv(maxFeeEnv), "Maximum fee of the vaccine in INR. Default: No limit")
+	rootCmd.PersistentFlags().StringVar(&filterArg, "filter", os.Getenv(filterEnv), "Expression the center and session have to match, see the README")
+	rootCmd.PersistentFlags().IntVar(&days, "days", getIntEnv(daysEnv), fmt.Sprintf("Number of days to search ahead. Default: (%v)", defaultDays))
+	rootCmd.PersistentFlags().IntVar(&weeks, "weeks", getIntEnv(weeksEnv), "Number of weeks to search ahead, overrides --days")
+	rootCmd.PersistentFlags().StringVar(&fromDate, "from", os.Getenv(fromDateEnv), "Search sessions from the date (DD-MM-YYYY)")
+	rootCmd.PersistentFlags().StringVar(&toDate, "to", os.Getenv(toDateEnv), "Search sessions up to the date (DD-MM-YYYY), overrides --days")
+	rootCmd.PersistentFlags().StringVar(&endpointArg, "endpoint", getStringEnv(endpointEnv, defaultEndpointArg), "CoWIN endpoints to search - auto, calendar, find or authenticated")
+	rootCmd.PersistentFlags().IntVar(&rateLimit, "rate-limit", getIntEnv(rateLimitEnv), fmt.Sprintf("Maximum CoWIN requests per 5 minutes. Default: (%v)", defaultRateLimit))
+	rootCmd.PersistentFlags().StringVar(&cowinToken, "cowin-token", os.Getenv(cowinTokenEnv), "CoWIN bearer token for the authenticated endpoints")
+	rootCmd.PersistentFlags().StringVarP(&mobile, "mobile", "n", os.Getenv(mobileEnv), "Mobile number registered on CoWIN")
+	rootCmd.PersistentFlags().BoolVar(&autoLogin, "auto-login", getBoolEnv(autoLoginEnv), "Renew the CoWIN token with the OTP source when it expires")
+	rootCmd.PersistentFlags().StringVar(&otpSource, "otp-source", getStringEnv(otpSourceEnv, otpSourceStdin), "Where to read the OTP from - stdin, http or file")
+	rootCmd.PersistentFlags().StringVar(&otpListen, "otp-listen", os.Getenv(otpListenEnv), "Address to receive the OTP SMS on, for the http OTP source")
+	rootCmd.PersistentFlags().StringVar(&otpSecret, "otp-secret", os.Getenv(otpSecretEnv), "Secret the SMS forwarder must send, for the http OTP source")
+	rootCmd.PersistentFlags().StringVar(&otpFile, "otp-file", os.Getenv(otpFileEnv), "File or FIFO to read the OTP from, for the file OTP source")
+	rootCmd.PersistentFlags().DurationVar(&otpTimeout, "otp-timeout", getDurationEnv(otpTimeoutEnv, defaultOTPTimeout), "Time to wait for the OTP")
+	rootCmd.PersistentFlags().BoolVar(&useBeneficiaries, "use-beneficiaries", getBoolEnv(beneficiariesEnv), "Search for the age, dose and vaccine of the beneficiaries of the CoWIN account")
+	rootCmd.PersistentFlags().StringSliceVarP(&beneficiaryIDs, "beneficiary", "b", getSliceEnv(beneficiaryEnv), "Reference ID of a beneficiary to search or book for, can be repeated")
+	rootCmd.PersistentFlags().DurationVar(&requestTimeout, "timeout", getDurationEnv(requestTimeoutEnv, defaultTimeout), "Timeout for each request to CoWIN and the notifier")
+	rootCmd.PersistentFlags().StringVar(&historyPath, "history", os.Getenv(historyEnv), "SQLite database to record the availability history in. Default: Not recorded")
+	rootCmd.PersistentFlags().BoolVar(&adaptive, "adaptive", getBoolEnv(adaptiveEnv), "Search every fast interval around the times slots were released in the history")
+	rootCmd.PersistentFlags().IntVar(&fastInterval, "fast-interval", getIntEnv(fastIntervalEnv), fmt.Sprintf("Interval to repeat the search around the release times with --adaptive. Default: (%v) second", defaultFastInterval))
+	rootCmd.PersistentFlags().StringSliceVar(&activeHours, "active-hours", getSliceEnv(activeHoursEnv), "Time range to search in, e.g. 07:00-22:00, can be repeated. Default: All day")
+	rootCmd.PersistentFlags().StringSliceVar(&quietHours, "quiet-hours", getSliceEnv(quietHoursEnv), "Time range not to notify in, e.g. 23:00-07:00, can be repeated")
+	rootCmd.PersistentFlags().StringVar(&scheduleArg, "schedule", os.Getenv(scheduleEnv), "Cron expression to search at, e.g. \"*/30 8-20 * * MON-SAT\", overrides --interval")
+	rootCmd.PersistentFlags().StringVar(&digestArg, "digest", os.Getenv(digestEnv), "Cron expression to notify a summary of the searches at, e.g. \"0 21 * * *\". Default: No digest")
+	rootCmd.PersistentFlags().IntVar(&alertAfter, "alert-after", getIntEnvDefault(alertAfterEnv, defaultAlertAfter), "Number of consecutive failed searches to send an alert at, 0 to disable the alerts")
+	rootCmd.PersistentFlags().StringVar(&heartbeatArg, "heartbeat", os.Getenv(heartbeatEnv), "Time of the day to notify that the notifier is running at, e.g. 09:00. Default: No heartbeat")
+	rootCmd.PersistentFlags().StringVar(&baseURL, "base-url", getStringEnv(baseURLEnv, defaultBaseURL), "CoWIN API to query, e.g. the one of mock-server")
+	rootCmd.PersistentFlags().StringVar(&recordDir, "record", os.Getenv(recordEnv), "Directory to record the CoWIN responses in, for mock-server --replay")
+	rootCmd.PersistentFlags().StringVar(&dataDir, "data-dir", getStringEnv(dataDirEnv, defaultDataDir()), "Directory to persist the state and cache between runs")
+	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", getStringEnv(logLevelEnv, defaultLogLevel), "Log level - debug, info, warn or error")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", getStringEnv(logFormatEnv, defaultLogFormat), "Log format - logfmt or json")
+
+	rootCmd.AddCommand(emailCmd, telegramCmd, mattermostCmd, checkCmd, listCmd, authCmd, bookCmd, analyzeCmd, serveCmd, mockServerCmd)
+
+	checkCmd.Flags().StringVar(&output, "output", getStringEnv(outputEnv, tableOutput), "Output format - table, json or csv")
+
+	analyzeCmd.Flags().StringVar(&output, "output", getStringEnv(outputEnv, tableOutput), "Output format - table or json")
+	analyzeCmd.Flags().DurationVar(&since, "since", 0, "Only analyze the history recorded in the period, like 168h. Default: All of it")
+
+	serveCmd.Flags().StringVar(&listen, "listen", getStringEnv(listenEnv, defaultListen), "Address to serve the API on")
+	serveCmd.Flags().StringVar(&apiToken, "api-token", os.Getenv(apiTokenEnv), "Bearer token the API clients must send. Default: No authentication")
+	mockServerCmd.Flags().StringVar(&mockListen, "listen", getStringEnv(listenEnv, defaultMockListen), "Address to serve the mock CoWIN API on")
+	mockServerCmd.Flags().StringSliceVar(&scenarios, "scenario", getSliceEnv(scenarioEnv), "Scenarios to simulate - static, appearing, flaky or rate-limit, can be combined. Default: static")
+	mockServerCmd.Flags().DurationVar(&appearAfter, "appear-after", defaultAppearAfter, "Time the sessions stay full, then open, with the appearing scenario")
+	mockServerCmd.Flags().Float64Var(&failureRate, "failure-rate", defaultFailureRate, "Share of the session requests failing with the flaky scenario")
+	mockServerCmd.Flags().StringVar(&replayDir, "replay", os.Getenv(replayEnv), "Directory of the responses recorded with --record to serve")
+	bookCmd.Flags().BoolVar(&dryRun, "dry-run", true, "Only show the slot which would be booked")
 
-	rootCmd.AddCommand(emailCmd, telegramCmd, mattermostCmd)
+	listCmd.AddCommand(listStatesCmd, listDistrictsCmd)
+	listCmd.PersistentFlags().StringVar(&output, "output", getStringEnv(outputEnv, tableOutput), "Output format - table, json or csv")
 
 	emailCmd.PersistentFlags().StringVarP(&username, "username", "u", os.Getenv(emailIDEnv), "Email address to send notifications")
 	emailCmd.MarkPersistentFlagRequired("username")
 	emailCmd.PersistentFlags().StringVarP(&password, "password", "p", os.Getenv(emailPasswordEnv), "Email ID password for auth")
 	emailCmd.MarkPersistentFlagRequired("password")
+	emailCmd.PersistentFlags().StringVar(&smtpServer, "smtp-server", getStringEnv(smtpServerEnv, notify.DefaultSMTPServer), "SMTP server to send the emails with, as host:port")
 
 	telegramCmd.PersistentFlags().StringVarP(&username, "username", "u", os.Getenv(tgUsernameEnv), "telegram username")
 	telegramCmd.MarkPersistentFlagRequired("username")
@@ -117,40 +370,105 @@ func init() {
 	mattermostCmd.MarkFlagRequired("token")
 }
 
-// Execute executes the main command
+// Execute executes the main command. The context passed to the commands is
+// cancelled on SIGINT or SIGTERM, a second signal terminates the process right away.
 func Execute() error {
-	return rootCmd.Execute()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return rootCmd.ExecuteContext(ctx)
 }
 
 func checkFlags() error {
+	if age <= 0 && !useBeneficiaries {
+		return errors.New(`required flag(s) "age" not set`)
+	}
 	if len(pinCode) == 0 &&
+		districtID == 0 &&
 		len(state) == 0 &&
 		len(district) == 0 {
-		return errors.New("Please pass one of the pinCode or state & district name combination options")
+		return errors.New("Please pass one of the pinCode, district ID or state & district name combination options")
 	}
-	if len(pinCode) == 0 && (len(state) == 0 || len(district) == 0) {
+	if len(pinCode) == 0 && districtID == 0 && (len(state) == 0 || len(district) == 0) {
 		return errors.New("Missing state or district name option")
 	}
+	return checkOptionFlags()
+}
+
+// checkOptionFlags validates the flags other than the age and location and
+// fills in their defaults
+func checkOptionFlags() error {
 	if interval == 0 {
 		interval = defaultSearchInterval
 	}
-	if !(vaccine == "" || vaccine == covishield || vaccine == covaxin) {
-		return errors.New("Invalid vaccine, please use covaxin or covishield")
-	}
-	if !(fee == "" || fee == free || fee == paid) {
-		return errors.New("Invalid fee preference, please use free or paid")
-	}
 	if minCapacity == 0 {
 		minCapacity = defaultMinCapacity
 	}
 	if dose < 0 || dose > 2 {
 		return errors.New("Invalid dose preference, please use 1 or 2")
 	}
+	if rateLimit == 0 {
+		rateLimit = defaultRateLimit
+	}
+	if err := checkAuthFlags(); err != nil {
+		return err
+	}
+	if err := checkEndpointFlags(); err != nil {
+		return err
+	}
+	if requestTimeout <= 0 {
+		return errors.New("Invalid timeout, please use a positive duration")
+	}
+	if err := checkEligibilityFlags(); err != nil {
+		return err
+	}
+	if err := checkFilterFlags(); err != nil {
+		return err
+	}
+	if err := checkScheduleFlags(); err != nil {
+		return err
+	}
+	if err := checkAlertFlags(); err != nil {
+		return err
+	}
+	return checkDateFlags()
+}
+
+// setupLogging configures the default logger from the flags and registers
+// the credentials passed on the command line so that they never get logged
+func setupLogging() error {
+	level, err := logging.ParseLevel(logLevel)
+	if err != nil {
+		return err
+	}
+	format, err := logging.ParseFormat(logFormat)
+	if err != nil {
+		return err
+	}
+	logging.SetLevel(level)
+	logging.SetFormat(format)
+	logging.AddSecret(password)
+	logging.AddSecret(token)
+	logging.AddSecret(cowinToken)
+	logging.AddSecret(otpSecret)
+	logging.AddSecret(apiToken)
+
+	// Route the messages logged by the dependencies through the same logger
+	log.SetFlags(0)
+	log.SetOutput(logging.Default().Writer(logging.InfoLevel))
 	return nil
 }
 
 func main() {
-	Execute()
+	if err := Execute(); err != nil {
+		if errors.Is(err, errNoSlots) {
+			os.Exit(exitNoSlots)
+		}
+		os.Exit(exitError)
+	}
 }
 
 func getIntEnv(envVar string) int {
@@ -160,34 +478,245 @@ func getIntEnv(envVar string) int {
 	}
 	i, err := strconv.Atoi(v)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal("Invalid integer value in environment", "env", envVar, "err", err)
 	}
 	return i
 }
 
-func Run(args []string, notifier notify.Notifier) error {
+// getIntEnvDefault is getIntEnv for the flags where 0 is not the default
+func getIntEnvDefault(envVar string, defaultValue int) int {
+	if len(os.Getenv(envVar)) == 0 {
+		return defaultValue
+	}
+	return getIntEnv(envVar)
+}
+
+func getDurationEnv(envVar string, defaultValue time.Duration) time.Duration {
+	v := os.Getenv(envVar)
+	if len(v) == 0 {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		logging.Fatal("Invalid duration value in environment", "env", envVar, "err", err)
+	}
+	return d
+}
+
+func getBoolEnv(envVar string) bool {
+	v := os.Getenv(envVar)
+	if len(v) == 0 {
+		return false
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		logging.Fatal("Invalid boolean value in environment", "env", envVar, "err", err)
+	}
+	return b
+}
+
+func getStringEnv(envVar, defaultValue string) string {
+	if v := os.Getenv(envVar); len(v) != 0 {
+		return v
+	}
+	return defaultValue
+}
+
+// getSliceEnv splits a comma separated environment variable
+func getSliceEnv(envVar string) []string {
+	v := os.Getenv(envVar)
+	if len(v) == 0 {
+		return nil
+	}
+	var values []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); len(s) != 0 {
+			values = append(values, s)
+		}
+	}
+	return values
+}
+
+// getIntSliceEnv splits a comma separated list of integers
+func getIntSliceEnv(envVar string) []int {
+	var values []int
+	for _, v := range getSliceEnv(envVar) {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			logging.Fatal("Invalid integer value in environment", "env", envVar, "err", err)
+		}
+		values = append(values, i)
+	}
+	return values
+}
+
+func getFloatEnv(envVar string) float64 {
+	v := os.Getenv(envVar)
+	if len(v) == 0 {
+		return 0
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		logging.Fatal("Invalid number value in environment", "env", envVar, "err", err)
+	}
+	return f
+}
+
+// getMapEnv parses a comma separated list of name=days pairs
+func getMapEnv(envVar string) map[string]int {
+	m := map[string]int{}
+	for _, pair := range getSliceEnv(envVar) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			logging.Fatal("Invalid name=value pair in environment", "env", envVar, "value", pair)
+		}
+		i, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil {
+			logging.Fatal("Invalid integer value in environment", "env", envVar, "err", err)
+		}
+		m[strings.TrimSpace(kv[0])] = i
+	}
+	return m
+}
+
+// Run searches for the slots every interval, or as scheduled by --schedule,
+// --adaptive and --active-hours, and notifies the available ones, the digests
+// and the failure alerts until ctx is cancelled. The search in progress,
+// including the notification, is completed before returning and the state is
+// persisted for the next run.
+func Run(ctx context.Context, args []string, notifier notify.Notifier) (err error) {
 	if err := checkFlags(); err != nil {
 		return err
 	}
-	if err := checkSlots(notifier); err != nil {
-		return err
+	if err := loadState(); err != nil {
+		logging.Warn("Ignoring the saved state", "err", err)
+	}
+	defer func() {
+		if serr := saveState(); serr != nil {
+			logging.Error("Failed to save state", "err", serr)
+		}
+	}()
+	defer closeHistory()
+
+	// The searches are not bound to ctx so that a shutdown does not interrupt the
+	// one in progress, each request has its own timeout instead. A failed search
+	// is retried at the next scheduled time.
+	workCtx := context.Background()
+	alerts := newFailureAlerter(notifier)
+	// A preference matching no known value stops the first search, it is
+	// likely a typo. Later on the values seen by then are only warned about.
+	first := true
+	search := func() error {
+		slots, err := checkSlots(workCtx)
+		if err != nil {
+			alerts.failed(workCtx, err, time.Now())
+		} else {
+			alerts.succeeded(workCtx, time.Now())
+			// Only the searches are alerted about, an alert would go through the
+			// same broken notifier. The slots still open are notified again by
+			// the next search.
+			if err := notifyFound(workCtx, notifier, slots); err != nil {
+				logging.Error("Failed to send the notification, retrying at the next search", "err", err)
+			}
+		}
+		// Until CoWIN answers there is nothing to check the preferences against
+		if first && len(pstate.Vaccines)+len(pstate.FeeTypes) != 0 {
+			first = false
+			return checkPreferences()
+		}
+		warnPreferences()
+		return nil
+	}
+	// With --schedule the searches only run at the times of the expression
+	if searchCron == nil && inRanges(activeRanges, time.Now()) {
+		if err := search(); err != nil {
+			return err
+		}
 	}
-	ticker := time.NewTicker(time.Second * time.Duration(interval))
-	defer ticker.Stop()
+	sched := newScheduler()
+	next := sched.Next(time.Now())
+	nextDigest := nextRun(digestCron, time.Now())
+	nextHeartbeat := nextRun(heartbeatCron, time.Now())
 	for {
+		now := time.Now()
+		setPollInterval(next, now)
+		logging.Debug("Scheduled the next search", "at", next.Format(time.RFC3339))
+		wake := next
+		for _, t := range []time.Time{nextDigest, nextHeartbeat} {
+			if !t.IsZero() && t.Before(wake) {
+				wake = t
+			}
+		}
+		timer := time.NewTimer(wake.Sub(now))
 		select {
-		case <-ticker.C:
-			if err := checkSlots(notifier); err != nil {
+		case <-ctx.Done():
+			timer.Stop()
+			logging.Info("Shutting down", "reason", ctx.Err())
+			return nil
+		case <-timer.C:
+		}
+		now = time.Now()
+		if !nextDigest.IsZero() && !now.Before(nextDigest) {
+			if err := sendDigest(workCtx, notifier, now); err != nil {
+				logging.Error("Failed to send digest", "err", err)
+			}
+			nextDigest = nextRun(digestCron, now)
+		}
+		if !nextHeartbeat.IsZero() && !now.Before(nextHeartbeat) {
+			alerts.heartbeat(workCtx, now)
+			nextHeartbeat = nextRun(heartbeatCron, now)
+		}
+		if !now.Before(next) {
+			if err := search(); err != nil {
 				return err
 			}
+			next = sched.Next(time.Now())
 		}
 	}
 }
 
-func checkSlots(notifier notify.Notifier) error {
+// nextRun returns the next time of the schedule, or the zero time without one
+func nextRun(c *cronSchedule, now time.Time) time.Time {
+	if c == nil {
+		return time.Time{}
+	}
+	return c.Next(now)
+}
+
+// notifyFound notifies the slots found by a search, unless during quiet hours
+func notifyFound(ctx context.Context, notifier notify.Notifier, slots []Slot) error {
+	recordFound(slots, time.Now())
+	if len(slots) == 0 {
+		logging.Info("No slots available, rechecking later", "min_capacity", minCapacity)
+		return nil
+	}
+	if quiet(time.Now()) {
+		logging.Info("Slots found during quiet hours, not notifying", "slots", len(slots))
+		return nil
+	}
+	return notifySlots(ctx, notifier, slots)
+}
+
+func checkSlots(ctx context.Context) ([]Slot, error) {
+	defer func() {
+		pstate.LastChecked = time.Now()
+	}()
+	refreshToken(ctx)
+	crits := []criteria{flagCriteria()}
+	if useBeneficiaries {
+		var err error
+		if crits, err = beneficiaryCriteria(ctx); err != nil {
+			return nil, err
+		}
+		if len(crits) == 0 {
+			logging.Info("No beneficiary is waiting for a dose")
+			return nil, nil
+		}
+	}
 	// Search for slots
+	r := searchWindow(time.Now())
 	if len(pinCode) != 0 {
-		return searchByPincode(notifier, pinCode)
+		return searchByPincode(ctx, r, pinCode, crits)
 	}
-	return searchByStateDistrict(notifier, state, district)
+	return searchByStateDistrict(ctx, r, crits)
 }
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// resetFlags sets the flags to the defaults of the command line, with the
+// data directory in a temporary directory
+func resetFlags(t *testing.T) {
+	t.Helper()
+	pinCode, state, district, districtID = "", "", "", 0
+	age, interval, minCapacity, dose = 0, 0, 0, 0
+	days, weeks, rateLimit = 0, 0, 0
+	fromDate, toDate, firstDoseDate = "", "", ""
+	endpointArg, cowinToken, mobile = defaultEndpointArg, "", ""
+	otpSource, otpListen, otpSecret, otpFile = otpSourceStdin, "", "", ""
+	autoLogin, useBeneficiaries = false, false
+	requestTimeout, otpTimeout = defaultTimeout, defaultOTPTimeout
+	vaccines, fees, beneficiaryIDs = nil, nil, nil
+	doseGapArg = nil
+	centerIDs, excludeCenterIDs = nil, nil
+	blocks, excludeBlocks, daysOfWeek, slotWindows = nil, nil, nil, nil
+	near, radius, maxFee, filterArg = "", 0, 0, ""
+	historyPath, adaptive, fastInterval = "", false, 0
+	listen, apiToken = defaultListen, ""
+	activeHours, quietHours = nil, nil
+	scheduleArg, digestArg, heartbeatArg = "", "", ""
+	alertAfter = defaultAlertAfter
+	dataDir = t.TempDir()
+
+	// No stored CoWIN token
+	tokenMu.Lock()
+	tokenLoaded, authToken, tokenRejected = true, nil, false
+	tokenMu.Unlock()
+	endpointMu.Lock()
+	pollInterval, rateWarned = 0, true
+	endpointMu.Unlock()
+}
+
+func TestCheckFlags(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags func()
+		err   string
+	}{
+		{
+			name:  "pincode",
+			flags: func() { age, pinCode = 18, "444002" },
+		},
+		{
+			name:  "district id",
+			flags: func() { age, districtID = 45, 391 },
+		},
+		{
+			name:  "state and district",
+			flags: func() { age, state, district = 18, "Maharashtra", "Akola" },
+		},
+		{
+			name:  "beneficiaries without age",
+			flags: func() { useBeneficiaries, pinCode = true, "444002" },
+		},
+		{
+			name:  "missing age",
+			flags: func() { pinCode = "444002" },
+			err:   `required flag(s) "age" not set`,
+		},
+		{
+			name:  "missing location",
+			flags: func() { age = 18 },
+			err:   "Please pass one of the pinCode",
+		},
+		{
+			name:  "missing district",
+			flags: func() { age, state = 18, "Maharashtra" },
+			err:   "Missing state or district name option",
+		},
+		{
+			name:  "invalid dose",
+			flags: func() { age, pinCode, dose = 18, "444002", 3 },
+			err:   "Invalid dose preference",
+		},
+		{
+			name:  "invalid endpoint",
+			flags: func() { age, pinCode, endpointArg = 18, "444002", "fastest" },
+			err:   "Invalid endpoint",
+		},
+		{
+			name:  "authenticated endpoint without token",
+			flags: func() { age, pinCode, endpointArg = 18, "444002", authenticatedEndpoint },
+			err:   "needs a valid CoWIN token",
+		},
+		{
+			name:  "authenticated endpoint",
+			flags: func() { age, pinCode, endpointArg, cowinToken = 18, "444002", authenticatedEndpoint, "token" },
+		},
+		{
+			name:  "auto login with invalid mobile",
+			flags: func() { age, pinCode, autoLogin, mobile = 18, "444002", true, "12345" },
+			err:   "Invalid mobile number",
+		},
+		{
+			name:  "negative rate limit",
+			flags: func() { age, pinCode, rateLimit = 18, "444002", -1 },
+			err:   "Invalid rate limit",
+		},
+		{
+			name:  "invalid timeout",
+			flags: func() { age, pinCode, requestTimeout = 18, "444002", 0 },
+			err:   "Invalid timeout",
+		},
+		{
+			name:  "first dose date for the first dose",
+			flags: func() { age, pinCode, firstDoseDate, dose = 18, "444002", "01-03-2021", 1 },
+			err:   "only used for the second dose",
+		},
+		{
+			name:  "invalid first dose date",
+			flags: func() { age, pinCode, firstDoseDate, dose = 18, "444002", "2021-03-01", 2 },
+			err:   "Invalid first dose date",
+		},
+		{
+			name:  "negative dose gap",
+			flags: func() { age, pinCode, doseGapArg = 18, "444002", map[string]int{"covaxin": -1} },
+			err:   "Invalid dose gap for covaxin",
+		},
+		{
+			name:  "near without radius",
+			flags: func() { age, pinCode, near = 18, "444002", "20.7,77.0" },
+			err:   "Missing radius",
+		},
+		{
+			name:  "radius without near",
+			flags: func() { age, pinCode, radius = 18, "444002", 5 },
+			err:   "Missing location",
+		},
+		{
+			name:  "invalid coordinates",
+			flags: func() { age, pinCode, near, radius = 18, "444002", "120,77", 5 },
+			err:   "Invalid location",
+		},
+		{
+			name:  "invalid day of week",
+			flags: func() { age, pinCode, daysOfWeek = 18, "444002", []string{"sat", "funday"} },
+			err:   `Invalid day of week "funday"`,
+		},
+		{
+			name:  "invalid slot window",
+			flags: func() { age, pinCode, slotWindows = 18, "444002", []string{"11:00AM-09:00AM"} },
+			err:   "Invalid slot window",
+		},
+		{
+			name:  "negative maximum fee",
+			flags: func() { age, pinCode, maxFee = 18, "444002", -100 },
+			err:   "Invalid maximum fee",
+		},
+		{
+			name:  "invalid filter",
+			flags: func() { age, pinCode, filterArg = 18, "444002", "session.capacity > 1" },
+			err:   "Invalid filter",
+		},
+		{
+			name:  "unknown field of a filter branch not evaluated",
+			flags: func() { age, pinCode, filterArg = 18, "444002", `false && session.capacity > 1` },
+			err:   "unknown field session.capacity",
+		},
+		{
+			name: "filter",
+			flags: func() {
+				age, pinCode, filterArg = 18, "444002", `session.vaccine in ["COVAXIN"] && center.pincode != 444001`
+			},
+		},
+		{
+			name:  "invalid active hours",
+			flags: func() { age, pinCode, activeHours = 18, "444002", []string{"7-25"} },
+			err:   "Invalid active hours",
+		},
+		{
+			name:  "adaptive without history",
+			flags: func() { age, pinCode, adaptive = 18, "444002", true },
+			err:   "please pass --history",
+		},
+		{
+			name: "schedule and adaptive",
+			flags: func() {
+				age, pinCode, adaptive, historyPath, scheduleArg = 18, "444002", true, "history.db", "*/5 * * * *"
+			},
+			err: "either --schedule or --adaptive",
+		},
+		{
+			name:  "invalid schedule",
+			flags: func() { age, pinCode, scheduleArg = 18, "444002", "*/5 * * *" },
+			err:   "Invalid schedule",
+		},
+		{
+			name:  "digest never matching",
+			flags: func() { age, pinCode, digestArg = 18, "444002", "0 9 31 2 *" },
+			err:   "it never matches",
+		},
+		{
+			name:  "negative alert after",
+			flags: func() { age, pinCode, alertAfter = 18, "444002", -1 },
+			err:   "Invalid alert after",
+		},
+		{
+			name:  "invalid heartbeat",
+			flags: func() { age, pinCode, heartbeatArg = 18, "444002", "9am" },
+			err:   "Invalid heartbeat",
+		},
+		{
+			name:  "negative lookahead",
+			flags: func() { age, pinCode, days = 18, "444002", -1 },
+			err:   "Invalid lookahead",
+		},
+		{
+			name:  "from after to",
+			flags: func() { age, pinCode, fromDate, toDate = 18, "444002", "20-05-2021", "19-05-2021" },
+			err:   "the from date is after the to date",
+		},
+		{
+			name:  "date range over the rate limit",
+			flags: func() { age, pinCode, toDate = 18, "444002", "31-12-2099" },
+			err:   "more than the rate limit of 100",
+		},
+		{
+			name:  "lookahead over the rate limit of the find endpoint",
+			flags: func() { age, pinCode, days, endpointArg, rateLimit = 18, "444002", 30, findEndpoint, 20 },
+			err:   "more than the rate limit of 20",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetFlags(t)
+			tt.flags()
+			err := checkFlags()
+			if len(tt.err) == 0 {
+				if err != nil {
+					t.Fatalf("checkFlags() = %v, want no error", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("checkFlags() = %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCheckFlagsDefaults(t *testing.T) {
+	resetFlags(t)
+	age, pinCode, weeks = 18, "444002", 2
+	if err := checkFlags(); err != nil {
+		t.Fatalf("checkFlags() = %v", err)
+	}
+	defaults := []struct {
+		name      string
+		got, want int
+	}{
+		{"interval", interval, defaultSearchInterval},
+		{"min capacity", minCapacity, defaultMinCapacity},
+		{"rate limit", rateLimit, defaultRateLimit},
+		{"fast interval", fastInterval, defaultFastInterval},
+		{"days", days, 2 * calendarDays},
+	}
+	for _, d := range defaults {
+		if d.got != d.want {
+			t.Errorf("%s = %d, want %d", d.name, d.got, d.want)
+		}
+	}
+}
+
+func TestChooseEndpoint(t *testing.T) {
+	resetFlags(t)
+	interval, rateLimit = 60, defaultRateLimit
+	r := dateRange{From: mustParseDate(t, "20-05-2021"), To: mustParseDate(t, "26-05-2021")}
+	tests := []struct {
+		locations int
+		want      string
+	}{
+		// 7 find calls per location every minute are 35 calls per 5 minutes
+		{locations: 1, want: findEndpoint},
+		{locations: 2, want: findEndpoint},
+		{locations: 3, want: calendarEndpoint},
+	}
+	for _, tt := range tests {
+		if got := chooseEndpoint(r, tt.locations); got[0] != tt.want {
+			t.Errorf("chooseEndpoint(%d locations) = %v, want %s first", tt.locations, got, tt.want)
+		}
+	}
+}
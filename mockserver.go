@@ -0,0 +1,563 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"embed"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/PrasadG193/covaccine-notifier/pkg/logging"
+)
+
+const (
+	defaultMockListen  = "localhost:8081"
+	defaultAppearAfter = time.Minute
+	defaultFailureRate = 0.2
+
+	staticScenario    = "static"
+	appearingScenario = "appearing"
+	flakyScenario     = "flaky"
+	rateLimitScenario = "rate-limit"
+
+	// mockOTP is the OTP accepted for every mobile number
+	mockOTP = "123456"
+	// mockCaptcha is the text of the captcha to solve for booking
+	mockCaptcha       = "a7Kx2"
+	mockTokenLifetime = 15 * time.Minute
+	mockAPIPrefix     = "/api"
+)
+
+// mockData has the fixtures served by mock-server. The sessions of
+// centers.json have a day relative to the current one instead of a date.
+//
+//go:embed mockdata
+var mockData embed.FS
+
+// mockConfig is the behaviour of the mock CoWIN API
+type mockConfig struct {
+	Scenarios []string
+	// AppearAfter is the time the sessions stay full, then open, with the appearing scenario
+	AppearAfter time.Duration
+	// FailureRate is the share of the session requests failing with the flaky scenario
+	FailureRate float64
+	// RateLimit is the number of requests a client can send in the rate limit
+	// window with the rate-limit scenario
+	RateLimit int
+	// Replay has the recorded responses to serve instead of the fixtures, if any
+	Replay *replayStore
+}
+
+type mockSession struct {
+	Session
+	// Day is the date of the session, in days from the current one
+	Day int `json:"day"`
+}
+
+type mockCenter struct {
+	Center
+	DistrictID int           `json:"district_id"`
+	Sessions   []mockSession `json:"sessions"`
+}
+
+// mockServer serves the fixtures like the CoWIN API
+type mockServer struct {
+	cfg       mockConfig
+	scenarios map[string]bool
+	start     time.Time
+	states    StateList
+	districts DistrictList
+	centers   []mockCenter
+	// beneficiaries is the response of the beneficiaries endpoint
+	beneficiaries json.RawMessage
+
+	mu     sync.Mutex
+	rand   *mathrand.Rand
+	txns   map[string]bool
+	tokens map[string]time.Time
+	// booked has the number of bookings of every session for dose 1 and 2
+	booked   map[string][2]int
+	requests map[string][]time.Time
+}
+
+func newMockServer(cfg mockConfig) (*mockServer, error) {
+	s := &mockServer{
+		cfg:       cfg,
+		scenarios: map[string]bool{},
+		start:     time.Now(),
+		rand:      mathrand.New(mathrand.NewSource(time.Now().UnixNano())),
+		txns:      map[string]bool{},
+		tokens:    map[string]time.Time{},
+		booked:    map[string][2]int{},
+		requests:  map[string][]time.Time{},
+	}
+	for _, sc := range cfg.Scenarios {
+		switch sc {
+		case staticScenario, appearingScenario, flakyScenario, rateLimitScenario:
+			s.scenarios[sc] = true
+		default:
+			return nil, errors.Errorf("Invalid scenario %q, please use static, appearing, flaky or rate-limit", sc)
+		}
+	}
+	if s.scenarios[appearingScenario] && cfg.AppearAfter <= 0 {
+		return nil, errors.New("Invalid appear after, please use a positive duration")
+	}
+	if s.scenarios[flakyScenario] && (cfg.FailureRate < 0 || cfg.FailureRate > 1) {
+		return nil, errors.New("Invalid failure rate, please use a number between 0 and 1")
+	}
+	if s.scenarios[rateLimitScenario] && cfg.RateLimit <= 0 {
+		return nil, errors.New("Invalid rate limit, please use a positive number of calls")
+	}
+	var centers struct {
+		Centers []mockCenter `json:"centers"`
+	}
+	fixtures := []struct {
+		name string
+		v    interface{}
+	}{
+		{"states.json", &s.states},
+		{"districts.json", &s.districts},
+		{"centers.json", &centers},
+		{"beneficiaries.json", &s.beneficiaries},
+	}
+	for _, f := range fixtures {
+		data, err := mockData.ReadFile("mockdata/" + f.name)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, f.v); err != nil {
+			return nil, errors.Wrapf(err, "Failed to parse fixture %s", f.name)
+		}
+	}
+	s.centers = centers.Centers
+	return s, nil
+}
+
+func (s *mockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, mockAPIPrefix)
+	logging.Debug("Mock request", "method", r.Method, "path", path, "query", r.URL.RawQuery)
+	if s.scenarios[rateLimitScenario] && !s.allow(r) {
+		logging.Info("Rate limiting the request", "path", path)
+		w.Header().Set("Retry-After", strconv.Itoa(rateLimitWindow))
+		writeMockText(w, http.StatusTooManyRequests, "Too Many Requests")
+		return
+	}
+	if strings.HasPrefix(path, "/v2/appointment/sessions/") && s.scenarios[flakyScenario] {
+		// CoWIN sometimes rejects the requests for no reason, with 401 or
+		// with 403 from its firewall
+		switch s.failure() {
+		case http.StatusUnauthorized:
+			logging.Info("Failing the request with 401", "path", path)
+			writeMockText(w, http.StatusUnauthorized, "Unauthenticated access!")
+			return
+		case http.StatusForbidden:
+			logging.Info("Failing the request with 403", "path", path)
+			writeMockText(w, http.StatusForbidden, "Request blocked")
+			return
+		}
+	}
+	if s.cfg.Replay != nil {
+		u := *r.URL
+		u.Path = path
+		if rec, ok := s.cfg.Replay.lookup(r.Method, &u); ok {
+			writeRecorded(w, rec)
+			return
+		}
+	}
+
+	switch {
+	case path == "/v2/admin/location/states":
+		if allowMethods(w, r, http.MethodGet) {
+			writeJSON(w, http.StatusOK, s.states)
+		}
+	case strings.HasPrefix(path, "/v2/admin/location/districts/"):
+		if allowMethods(w, r, http.MethodGet) {
+			s.handleDistricts(w, strings.TrimPrefix(path, "/v2/admin/location/districts/"))
+		}
+	case strings.HasPrefix(path, "/v2/appointment/sessions/"):
+		if allowMethods(w, r, http.MethodGet) {
+			s.handleSessions(w, r, strings.TrimPrefix(path, "/v2/appointment/sessions/"))
+		}
+	case path == "/v2/auth/public/generateOTP":
+		if allowMethods(w, r, http.MethodPost) {
+			s.handleGenerateOTP(w, r)
+		}
+	case path == "/v2/auth/public/confirmOTP":
+		if allowMethods(w, r, http.MethodPost) {
+			s.handleConfirmOTP(w, r)
+		}
+	case path == "/v2/appointment/beneficiaries":
+		if allowMethods(w, r, http.MethodGet) && s.authenticated(w, r) {
+			writeJSON(w, http.StatusOK, s.beneficiaries)
+		}
+	case path == "/v2/auth/getRecaptcha":
+		if allowMethods(w, r, http.MethodPost) && s.authenticated(w, r) {
+			svg := `<svg xmlns="http://www.w3.org/2000/svg" width="150" height="50"><text x="20" y="35" font-size="30">` + mockCaptcha + `</text></svg>`
+			writeJSON(w, http.StatusOK, map[string]string{"captcha": svg})
+		}
+	case path == "/v2/appointment/schedule":
+		if allowMethods(w, r, http.MethodPost) && s.authenticated(w, r) {
+			s.handleSchedule(w, r)
+		}
+	default:
+		writeCowinError(w, http.StatusNotFound, "APPOIN0404", "Not found")
+	}
+}
+
+// allow counts the request of the client and reports whether it is within the rate limit
+func (s *mockServer) allow(r *http.Request) bool {
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var recent []time.Time
+	for _, t := range s.requests[client] {
+		if now.Sub(t) < rateLimitWindow*time.Second {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= s.cfg.RateLimit {
+		s.requests[client] = recent
+		return false
+	}
+	s.requests[client] = append(recent, now)
+	return true
+}
+
+// failure returns the status to fail a request with for the flaky scenario, or 0
+func (s *mockServer) failure() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rand.Float64() >= s.cfg.FailureRate {
+		return 0
+	}
+	if s.rand.Intn(2) == 0 {
+		return http.StatusUnauthorized
+	}
+	return http.StatusForbidden
+}
+
+func (s *mockServer) handleDistricts(w http.ResponseWriter, id string) {
+	stateID, err := strconv.Atoi(id)
+	if err != nil {
+		writeCowinError(w, http.StatusBadRequest, "APPOIN0001", "Invalid state_id")
+		return
+	}
+	dl := DistrictList{Districts: []District{}, TTL: s.districts.TTL}
+	for _, d := range s.districts.Districts {
+		if d.StateID == stateID {
+			dl.Districts = append(dl.Districts, d)
+		}
+	}
+	writeJSON(w, http.StatusOK, dl)
+}
+
+// handleSessions serves the calendar and find endpoints, the public ones and
+// the ones needing a token
+func (s *mockServer) handleSessions(w http.ResponseWriter, r *http.Request, endpoint string) {
+	public := strings.HasPrefix(endpoint, "public/")
+	endpoint = strings.TrimPrefix(endpoint, "public/")
+	calendar := strings.HasPrefix(endpoint, "calendar")
+	if !calendar && (!public || !strings.HasPrefix(endpoint, "find")) {
+		writeCowinError(w, http.StatusNotFound, "APPOIN0404", "Not found")
+		return
+	}
+	if !public && !s.authenticated(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	day, err := parseDate(q.Get("date"))
+	if err != nil {
+		writeCowinError(w, http.StatusBadRequest, "APPOIN0012", "Invalid date")
+		return
+	}
+	var match func(c mockCenter) bool
+	switch {
+	case strings.HasSuffix(endpoint, "ByPin"):
+		pin, err := strconv.Atoi(q.Get("pincode"))
+		if err != nil {
+			writeCowinError(w, http.StatusBadRequest, "APPOIN0018", "Invalid Pincode")
+			return
+		}
+		match = func(c mockCenter) bool { return c.Pincode == pin }
+	case strings.HasSuffix(endpoint, "ByDistrict"):
+		id, err := strconv.Atoi(q.Get("district_id"))
+		if err != nil {
+			writeCowinError(w, http.StatusBadRequest, "APPOIN0013", "Invalid district_id")
+			return
+		}
+		match = func(c mockCenter) bool { return c.DistrictID == id }
+	default:
+		writeCowinError(w, http.StatusNotFound, "APPOIN0404", "Not found")
+		return
+	}
+	days := 1
+	if calendar {
+		days = calendarDays
+	}
+	appnts := s.appointments(time.Now(), day, day.AddDate(0, 0, days-1), match)
+	if calendar {
+		writeJSON(w, http.StatusOK, appnts)
+		return
+	}
+	found := findSessions{Sessions: []findSession{}}
+	for _, c := range appnts.Centers {
+		for _, session := range c.Sessions {
+			fee := "0"
+			for _, f := range c.VaccineFees {
+				if f.Vaccine == session.Vaccine {
+					fee = f.Fee
+				}
+			}
+			found.Sessions = append(found.Sessions, findSession{
+				Session: session, CenterID: c.CenterID, Name: c.Name, StateName: c.StateName,
+				DistrictName: c.DistrictName, BlockName: c.BlockName, Pincode: c.Pincode, Lat: c.Lat,
+				Long: c.Long, From: c.From, To: c.To, FeeType: c.FeeType, Fee: fee,
+			})
+		}
+	}
+	writeJSON(w, http.StatusOK, found)
+}
+
+// appointments returns the sessions of the matching centers from one day to
+// another, with the capacity left at now
+func (s *mockServer) appointments(now, from, to time.Time, match func(c mockCenter) bool) Appointments {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.appointmentsLocked(now, from, to, match)
+}
+
+// appointmentsLocked is appointments with s.mu held
+func (s *mockServer) appointmentsLocked(now, from, to time.Time, match func(c mockCenter) bool) Appointments {
+	// With the appearing scenario the sessions are full first, then open
+	// and so on every AppearAfter
+	full := s.scenarios[appearingScenario] && int(now.Sub(s.start)/s.cfg.AppearAfter)%2 == 0
+	today := truncateDay(now)
+	appnts := Appointments{Centers: []Center{}}
+	for _, mc := range s.centers {
+		if !match(mc) {
+			continue
+		}
+		c := mc.Center
+		c.Sessions = nil
+		for _, ms := range mc.Sessions {
+			date := today.AddDate(0, 0, ms.Day)
+			if date.Before(from) || date.After(to) {
+				continue
+			}
+			session := ms.Session
+			session.Date = formatDate(date)
+			if full {
+				session.AvailableCapacity, session.AvailableCapacityDose1, session.AvailableCapacityDose2 = 0, 0, 0
+			}
+			booked := s.booked[session.SessionID]
+			session.AvailableCapacityDose1 = nonNegative(session.AvailableCapacityDose1 - float64(booked[0]))
+			session.AvailableCapacityDose2 = nonNegative(session.AvailableCapacityDose2 - float64(booked[1]))
+			session.AvailableCapacity = nonNegative(session.AvailableCapacity - float64(booked[0]+booked[1]))
+			c.Sessions = append(c.Sessions, session)
+		}
+		if len(c.Sessions) != 0 {
+			appnts.Centers = append(appnts.Centers, c)
+		}
+	}
+	return appnts
+}
+
+func nonNegative(f float64) float64 {
+	if f < 0 {
+		return 0
+	}
+	return f
+}
+
+func (s *mockServer) handleGenerateOTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Mobile string `json:"mobile"`
+	}
+	if err := decodeMockRequest(r, &req); err != nil || checkMobile(req.Mobile) != nil {
+		writeCowinError(w, http.StatusBadRequest, "USRAUT0001", "Invalid mobile number")
+		return
+	}
+	txnID := newMockID()
+	s.mu.Lock()
+	s.txns[txnID] = true
+	s.mu.Unlock()
+	logging.Info("Sent the mock OTP "+mockOTP, "mobile", req.Mobile)
+	writeJSON(w, http.StatusOK, map[string]string{"txnId": txnID})
+}
+
+func (s *mockServer) handleConfirmOTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		OTP   string `json:"otp"`
+		TxnID string `json:"txnId"`
+	}
+	if err := decodeMockRequest(r, &req); err != nil {
+		writeCowinError(w, http.StatusBadRequest, "USRAUT0001", "Invalid request")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.txns[req.TxnID] || req.OTP != hashOTP(mockOTP) {
+		writeCowinError(w, http.StatusBadRequest, "USRAUT0014", "Invalid OTP")
+		return
+	}
+	delete(s.txns, req.TxnID)
+	expiry := time.Now().Add(mockTokenLifetime)
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	claims := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"txnId":%q,"exp":%d}`, req.TxnID, expiry.Unix())))
+	token := header + "." + claims + "." + newMockID()
+	s.tokens[token] = expiry
+	writeJSON(w, http.StatusOK, map[string]string{"token": token})
+}
+
+// authenticated replies 401 unless the request has a valid token from confirmOTP
+func (s *mockServer) authenticated(w http.ResponseWriter, r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	s.mu.Lock()
+	expiry, ok := s.tokens[token]
+	s.mu.Unlock()
+	if !ok || time.Now().After(expiry) {
+		writeMockText(w, http.StatusUnauthorized, "Unauthenticated access!")
+		return false
+	}
+	return true
+}
+
+func (s *mockServer) handleSchedule(w http.ResponseWriter, r *http.Request) {
+	var req scheduleRequest
+	if err := decodeMockRequest(r, &req); err != nil || len(req.Beneficiaries) == 0 {
+		writeCowinError(w, http.StatusBadRequest, "APPOIN0001", "Invalid request")
+		return
+	}
+	if req.Dose != 1 && req.Dose != 2 {
+		writeCowinError(w, http.StatusBadRequest, "APPOIN0001", "Invalid dose")
+		return
+	}
+	if req.Captcha != mockCaptcha {
+		writeCowinError(w, http.StatusBadRequest, "APPOIN0045", "Invalid Captcha")
+		return
+	}
+	// The capacity is checked and booked under the same lock so that two
+	// requests cannot both book the last doses
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	appnts := s.appointmentsLocked(time.Now(), time.Time{}, time.Now().AddDate(1, 0, 0), func(c mockCenter) bool {
+		return c.CenterID == req.CenterID
+	})
+	var session *Session
+	for _, c := range appnts.Centers {
+		for i := range c.Sessions {
+			if c.Sessions[i].SessionID == req.SessionID {
+				session = &c.Sessions[i]
+			}
+		}
+	}
+	if session == nil {
+		writeCowinError(w, http.StatusBadRequest, "APPOIN0011", "Invalid session")
+		return
+	}
+	capacity := session.AvailableCapacityDose1
+	if req.Dose == 2 {
+		capacity = session.AvailableCapacityDose2
+	}
+	if capacity < float64(len(req.Beneficiaries)) {
+		writeCowinError(w, http.StatusConflict, "APPOIN0040", "This vaccination center is completely booked for the selected date")
+		return
+	}
+	booked := s.booked[req.SessionID]
+	booked[req.Dose-1] += len(req.Beneficiaries)
+	s.booked[req.SessionID] = booked
+	confirmation := newMockID()
+	logging.Info("Booked mock appointment", "session_id", req.SessionID, "beneficiaries", len(req.Beneficiaries), "confirmation", confirmation)
+	writeJSON(w, http.StatusOK, map[string]string{"appointment_confirmation_no": confirmation})
+}
+
+func decodeMockRequest(r *http.Request, v interface{}) error {
+	return json.NewDecoder(io.LimitReader(r.Body, maxRequestBody)).Decode(v)
+}
+
+func newMockID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// writeCowinError replies with an error in the format of CoWIN
+func writeCowinError(w http.ResponseWriter, status int, code, msg string) {
+	writeJSON(w, status, map[string]string{"errorCode": code, "error": msg})
+}
+
+func writeMockText(w http.ResponseWriter, status int, text string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	io.WriteString(w, text)
+}
+
+func writeRecorded(w http.ResponseWriter, rec recordedResponse) {
+	var text string
+	if json.Unmarshal(rec.Body, &text) == nil {
+		writeMockText(w, rec.Status, text)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(rec.Status)
+	w.Write(rec.Body)
+}
+
+// MockServe serves a mock of the CoWIN API for trying out the notifier, see
+// --base-url to point the other commands at it
+func MockServe(ctx context.Context) error {
+	if rateLimit == 0 {
+		rateLimit = defaultRateLimit
+	}
+	if len(scenarios) == 0 {
+		scenarios = []string{staticScenario}
+	}
+	cfg := mockConfig{Scenarios: scenarios, AppearAfter: appearAfter, FailureRate: failureRate, RateLimit: rateLimit}
+	if len(replayDir) != 0 {
+		store, err := loadReplay(replayDir)
+		if err != nil {
+			return err
+		}
+		cfg.Replay = store
+	}
+	s, err := newMockServer(cfg)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(mockAPIPrefix+"/", s)
+	srv := &http.Server{Addr: mockListen, Handler: mux}
+	errCh := make(chan error, 1)
+	go func() {
+		logging.Info("Serving the mock CoWIN API", "listen", mockListen, "base_url", "http://"+mockListen+mockAPIPrefix,
+			"scenarios", strings.Join(scenarios, ","))
+		errCh <- srv.ListenAndServe()
+	}()
+	select {
+	case <-ctx.Done():
+		logging.Info("Shutting down", "reason", ctx.Err())
+	case err := <-errCh:
+		return errors.Wrap(err, "Failed to serve the mock CoWIN API")
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
+}
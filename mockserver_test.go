@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestMockServer(t *testing.T, cfg mockConfig) *mockServer {
+	t.Helper()
+	s, err := newMockServer(cfg)
+	if err != nil {
+		t.Fatalf("newMockServer() = %v", err)
+	}
+	return s
+}
+
+func mockRequest(s *mockServer, method, target, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if len(token) != 0 {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+// mockLogin returns a token of the mock server
+func mockLogin(t *testing.T, s *mockServer) string {
+	t.Helper()
+	w := mockRequest(s, http.MethodPost, "/api/v2/auth/public/generateOTP", "", `{"mobile":"9999999999"}`)
+	var txn struct {
+		TxnID string `json:"txnId"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &txn); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("generateOTP = %d %s", w.Code, w.Body)
+	}
+	w = mockRequest(s, http.MethodPost, "/api/v2/auth/public/confirmOTP", "",
+		`{"otp":"`+hashOTP(mockOTP)+`","txnId":"`+txn.TxnID+`"}`)
+	var token struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &token); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("confirmOTP = %d %s", w.Code, w.Body)
+	}
+	return token.Token
+}
+
+func TestMockServerScenarios(t *testing.T) {
+	today := formatDate(time.Now())
+	sessions := "/api/v2/appointment/sessions/public/calendarByPin?pincode=444001&date=" + today
+
+	t.Run("static", func(t *testing.T) {
+		s := newTestMockServer(t, mockConfig{Scenarios: []string{staticScenario}})
+		w := mockRequest(s, http.MethodGet, sessions, "", "")
+		var appnts Appointments
+		if err := json.Unmarshal(w.Body.Bytes(), &appnts); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("sessions = %d %s", w.Code, w.Body)
+		}
+		if len(appnts.Centers) != 1 || appnts.Centers[0].Sessions[0].Date != today {
+			t.Errorf("sessions = %+v, want the center of 444001 today", appnts.Centers)
+		}
+		if w := mockRequest(s, http.MethodGet, "/api/v2/appointment/beneficiaries", "", ""); w.Code != http.StatusUnauthorized {
+			t.Errorf("beneficiaries without a token = %d, want 401", w.Code)
+		}
+		if w := mockRequest(s, http.MethodGet, "/api/v2/appointment/beneficiaries", mockLogin(t, s), ""); w.Code != http.StatusOK {
+			t.Errorf("beneficiaries with a token = %d %s, want 200", w.Code, w.Body)
+		}
+	})
+
+	t.Run("flaky", func(t *testing.T) {
+		s := newTestMockServer(t, mockConfig{Scenarios: []string{flakyScenario}, FailureRate: 1})
+		seen := map[int]bool{}
+		for i := 0; i < 50; i++ {
+			seen[mockRequest(s, http.MethodGet, sessions, "", "").Code] = true
+		}
+		if len(seen) != 2 || !seen[http.StatusUnauthorized] || !seen[http.StatusForbidden] {
+			t.Errorf("session requests failed with %v, want 401 and 403", seen)
+		}
+		// Only the session requests fail
+		if w := mockRequest(s, http.MethodGet, "/api/v2/admin/location/states", "", ""); w.Code != http.StatusOK {
+			t.Errorf("states = %d, want 200", w.Code)
+		}
+	})
+
+	t.Run("rate-limit", func(t *testing.T) {
+		s := newTestMockServer(t, mockConfig{Scenarios: []string{rateLimitScenario}, RateLimit: 3})
+		for i := 0; i < 3; i++ {
+			if w := mockRequest(s, http.MethodGet, sessions, "", ""); w.Code != http.StatusOK {
+				t.Fatalf("request %d = %d, want 200", i, w.Code)
+			}
+		}
+		w := mockRequest(s, http.MethodGet, sessions, "", "")
+		if w.Code != http.StatusTooManyRequests {
+			t.Fatalf("request over the limit = %d, want 429", w.Code)
+		}
+		if got := w.Header().Get("Retry-After"); got != strconv.Itoa(rateLimitWindow) {
+			t.Errorf("Retry-After = %q, want %d", got, rateLimitWindow)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, cfg := range []mockConfig{
+			{Scenarios: []string{"busy"}},
+			{Scenarios: []string{appearingScenario}},
+			{Scenarios: []string{flakyScenario}, FailureRate: 2},
+			{Scenarios: []string{rateLimitScenario}},
+		} {
+			if _, err := newMockServer(cfg); err == nil {
+				t.Errorf("newMockServer(%+v) succeeded, want an error", cfg)
+			}
+		}
+	})
+}
+
+func TestMockServerConcurrentBooking(t *testing.T) {
+	s := newTestMockServer(t, mockConfig{Scenarios: []string{staticScenario}})
+	token := mockLogin(t, s)
+	// akola-civil-0 has 25 doses 1 left, so 5 of the requests for 5 beneficiaries can book
+	body := `{"center_id":561234,"session_id":"akola-civil-0","slot":"09:00AM-11:00AM","dose":1,` +
+		`"beneficiaries":["1","2","3","4","5"],"captcha":"` + mockCaptcha + `"}`
+	var wg sync.WaitGroup
+	codes := make(chan int, 20)
+	for i := 0; i < cap(codes); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- mockRequest(s, http.MethodPost, "/api/v2/appointment/schedule", token, body).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	booked := 0
+	for code := range codes {
+		switch code {
+		case http.StatusOK:
+			booked++
+		case http.StatusConflict:
+		default:
+			t.Errorf("schedule = %d, want 200 or 409", code)
+		}
+	}
+	if booked != 5 {
+		t.Errorf("%d bookings succeeded, want 5", booked)
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	resetFlags(t)
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "appointments.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	startCowin(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	prevDir, prevTransport := recordDir, httpClient.Transport
+	t.Cleanup(func() { recordDir, httpClient.Transport = prevDir, prevTransport })
+	recordDir = t.TempDir()
+	if err := setupRecording(); err != nil {
+		t.Fatalf("setupRecording() = %v", err)
+	}
+	ctx := context.Background()
+	week := dateRange{From: mustParseDate(t, "20-05-2021"), To: mustParseDate(t, "26-05-2021")}
+	recorded, err := fetchCalendar(ctx, week, calendarByPinPublicURLFormat, "444002", false)
+	if err != nil {
+		t.Fatalf("fetchCalendar() while recording = %v", err)
+	}
+	if len(recorded.Centers) == 0 {
+		t.Fatal("fetchCalendar() while recording found no centers")
+	}
+	httpClient.Transport = prevTransport
+
+	store, err := loadReplay(recordDir)
+	if err != nil {
+		t.Fatalf("loadReplay() = %v", err)
+	}
+	startCowin(t, newTestMockServer(t, mockConfig{Scenarios: []string{staticScenario}, Replay: store}))
+
+	// The same request is replayed as it was recorded
+	replayed, err := fetchCalendar(ctx, week, calendarByPinPublicURLFormat, "444002", false)
+	if err != nil {
+		t.Fatalf("fetchCalendar() of the recorded week = %v", err)
+	}
+	if got, want := sessionDates(replayed, 0), sessionDates(recorded, 0); got != want {
+		t.Errorf("replayed dates = %s, want %s", got, want)
+	}
+	// The sessions of another week are the recorded ones moved to it
+	later := dateRange{From: week.From.AddDate(0, 0, 7), To: week.To.AddDate(0, 0, 7)}
+	replayed, err = fetchCalendar(ctx, later, calendarByPinPublicURLFormat, "444002", false)
+	if err != nil {
+		t.Fatalf("fetchCalendar() of another week = %v", err)
+	}
+	if got, want := sessionDates(replayed, 0), sessionDates(recorded, 7); got != want {
+		t.Errorf("replayed dates = %s, want %s", got, want)
+	}
+	// The requests which were not recorded get the fixtures
+	if _, err := fetchStates(ctx); err != nil {
+		t.Errorf("fetchStates() = %v", err)
+	}
+}
+
+// sessionDates lists the session IDs and their dates moved by the number of days
+func sessionDates(appnts Appointments, days int) string {
+	var dates []string
+	for _, c := range appnts.Centers {
+		for _, s := range c.Sessions {
+			d, err := parseDate(s.Date)
+			if err != nil {
+				dates = append(dates, s.SessionID+"="+s.Date)
+				continue
+			}
+			dates = append(dates, s.SessionID+"="+formatDate(d.AddDate(0, 0, days)))
+		}
+	}
+	return strings.Join(dates, ",")
+}
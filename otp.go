@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/PrasadG193/covaccine-notifier/pkg/logging"
+)
+
+const (
+	otpSourceStdin = "stdin"
+	otpSourceHTTP  = "http"
+	otpSourceFile  = "file"
+
+	defaultOTPTimeout = 3 * time.Minute
+	otpFilePoll       = time.Second
+	maxOTPMessageSize = 4096
+)
+
+var (
+	// otpRegexp matches a message which is only the OTP, typed or written by another program
+	otpRegexp = regexp.MustCompile(`^\s*(\d{6})\s*$`)
+	// otpSMSRegexp finds the OTP in the SMS of CoWIN, "Your OTP to register/access CoWIN is
+	// 123456. It will be valid for 3 minutes.", and not the other numbers of a forwarded message
+	otpSMSRegexp = regexp.MustCompile(`(?i)\bCoWIN is (\d{6})\b`)
+)
+
+// OTPSource provides the OTP CoWIN sent for a login transaction
+type OTPSource interface {
+	// ReadOTP waits for the OTP sent to the mobile number after the given time
+	ReadOTP(ctx context.Context, mobile string, sentAt time.Time) (string, error)
+}
+
+// extractOTP returns the 6 digit OTP in a message, which can be the OTP
+// itself or the full text of the SMS
+func extractOTP(message string) (string, bool) {
+	for _, re := range []*regexp.Regexp{otpRegexp, otpSMSRegexp} {
+		if m := re.FindStringSubmatch(message); m != nil {
+			return m[1], true
+		}
+	}
+	return "", false
+}
+
+var otpSrc OTPSource
+
+// getOTPSource returns the OTPSource selected by the flags, creating it on first use
+func getOTPSource() (OTPSource, error) {
+	if otpSrc != nil {
+		return otpSrc, nil
+	}
+	src, err := newOTPSource()
+	if err != nil {
+		return nil, err
+	}
+	otpSrc = src
+	return src, nil
+}
+
+func newOTPSource() (OTPSource, error) {
+	switch otpSource {
+	case "", otpSourceStdin:
+		return &promptSource{in: os.Stdin, out: os.Stderr}, nil
+	case otpSourceHTTP:
+		if len(otpListen) == 0 {
+			return nil, errors.New("Missing --otp-listen address for the http OTP source")
+		}
+		if len(otpSecret) == 0 && !isLoopback(otpListen) {
+			return nil, errors.New("Missing --otp-secret, anyone who can reach the --otp-listen address could send an OTP")
+		}
+		return newHTTPSource(otpListen, otpSecret)
+	case otpSourceFile:
+		if len(otpFile) == 0 {
+			return nil, errors.New("Missing --otp-file path for the file OTP source")
+		}
+		return &fileSource{path: otpFile}, nil
+	}
+	return nil, errors.New("Invalid OTP source, please use stdin, http or file")
+}
+
+// isLoopback tells if the listening address only accepts local connections
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// promptSource asks for the OTP on a terminal
+type promptSource struct {
+	in  io.Reader
+	out io.Writer
+
+	once  sync.Once
+	lines chan promptLine
+}
+
+type promptLine struct {
+	text   string
+	err    error
+	readAt time.Time
+}
+
+// readLines reads the input in the background, a read cannot be interrupted
+// when ctx is done. A line entered after a timeout is kept for the next OTP.
+func (p *promptSource) readLines() {
+	r := bufio.NewReader(p.in)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && len(line) == 0 {
+			p.lines <- promptLine{err: err}
+			return
+		}
+		p.lines <- promptLine{text: line, readAt: time.Now()}
+	}
+}
+
+func (p *promptSource) ReadOTP(ctx context.Context, mobile string, sentAt time.Time) (string, error) {
+	p.once.Do(func() {
+		p.lines = make(chan promptLine)
+		go p.readLines()
+	})
+	fmt.Fprintf(p.out, "Enter the OTP sent to %s: ", mobile)
+	for {
+		select {
+		case <-ctx.Done():
+			return "", errors.Wrap(ctx.Err(), "No OTP entered")
+		case line := <-p.lines:
+			if line.err != nil {
+				// Keep failing the next reads too, the input is closed
+				go func() { p.lines <- line }()
+				return "", errors.Wrap(line.err, "Failed to read OTP")
+			}
+			// Skip what was typed before the OTP was sent
+			if line.readAt.Before(sentAt) {
+				continue
+			}
+			otp, ok := extractOTP(line.text)
+			if !ok {
+				return "", errors.New("Invalid OTP, please enter the 6 digit OTP")
+			}
+			return otp, nil
+		}
+	}
+}
+
+// httpSource receives the OTP from an SMS forwarding app which POSTs the
+// message body to the listening address. When a secret is set the request must
+// carry it in the X-OTP-Secret header or the secret query parameter.
+type httpSource struct {
+	secret   string
+	messages chan otpMessage
+	server   *http.Server
+	// mu serializes the requests replacing the message
+	mu sync.Mutex
+}
+
+type otpMessage struct {
+	text       string
+	receivedAt time.Time
+}
+
+func newHTTPSource(addr, secret string) (*httpSource, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to listen for OTP messages")
+	}
+	s := &httpSource{
+		secret:   secret,
+		messages: make(chan otpMessage, 1),
+	}
+	s.server = &http.Server{Handler: s}
+	go func() {
+		if err := s.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			logging.Error("OTP listener stopped", "err", err)
+		}
+	}()
+	logging.Info("Waiting for OTP messages", "addr", ln.Addr().String())
+	return s, nil
+}
+
+func (s *httpSource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(s.secret) != 0 && !secretEqual(r.Header.Get("X-OTP-Secret"), s.secret) && !secretEqual(r.URL.Query().Get("secret"), s.secret) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxOTPMessageSize))
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+	// The OTP is searched in the raw body, so plain text, form and JSON payloads all work
+	message := string(body)
+	if _, ok := extractOTP(message); !ok {
+		http.Error(w, "no OTP in the message", http.StatusUnprocessableEntity)
+		return
+	}
+	// Keep only the latest message, an older OTP is useless
+	s.mu.Lock()
+	select {
+	case <-s.messages:
+	default:
+	}
+	select {
+	case s.messages <- otpMessage{text: message, receivedAt: time.Now()}:
+	default:
+	}
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *httpSource) ReadOTP(ctx context.Context, mobile string, sentAt time.Time) (string, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return "", errors.Wrap(ctx.Err(), "No OTP received")
+		case message := <-s.messages:
+			// Only an OTP received after the request was sent can be the right one
+			if message.receivedAt.Before(sentAt) {
+				continue
+			}
+			if otp, ok := extractOTP(message.text); ok {
+				return otp, nil
+			}
+		}
+	}
+}
+
+func secretEqual(got, want string) bool {
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// Close stops listening for OTP messages
+func (s *httpSource) Close() error {
+	return s.server.Close()
+}
+
+// fileSource reads the OTP from a file rewritten by another program, or
+// from a FIFO the program writes the messages to
+type fileSource struct {
+	path string
+}
+
+func (f *fileSource) ReadOTP(ctx context.Context, mobile string, sentAt time.Time) (string, error) {
+	ticker := time.NewTicker(otpFilePoll)
+	defer ticker.Stop()
+	for {
+		fi, err := os.Stat(f.path)
+		if err != nil && !os.IsNotExist(err) {
+			return "", errors.Wrap(err, "Failed to read OTP file")
+		}
+		if err == nil {
+			if fi.Mode()&os.ModeNamedPipe != 0 {
+				return f.readFIFO(ctx)
+			}
+			// Only an OTP written after the request was sent can be the right one
+			if fi.ModTime().After(sentAt) {
+				data, err := ioutil.ReadFile(f.path)
+				if err != nil {
+					return "", errors.Wrap(err, "Failed to read OTP file")
+				}
+				if otp, ok := extractOTP(lastLine(string(data))); ok {
+					return otp, nil
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return "", errors.Wrap(ctx.Err(), "No OTP received")
+		case <-ticker.C:
+		}
+	}
+}
+
+// readFIFO returns the first OTP written to the FIFO. Opening a FIFO blocks
+// until a writer shows up, so it is done in the background to honor ctx.
+func (f *fileSource) readFIFO(ctx context.Context) (string, error) {
+	type result struct {
+		otp string
+		err error
+	}
+	done := make(chan result, 1)
+	var (
+		mu        sync.Mutex
+		fifo      *os.File
+		cancelled bool
+	)
+	go func() {
+		file, err := os.Open(f.path)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer file.Close()
+		mu.Lock()
+		if cancelled {
+			mu.Unlock()
+			return
+		}
+		fifo = file
+		mu.Unlock()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if otp, ok := extractOTP(scanner.Text()); ok {
+				done <- result{otp: otp}
+				return
+			}
+		}
+		done <- result{err: errors.New("FIFO closed without an OTP")}
+	}()
+	select {
+	case <-ctx.Done():
+		// Stop the reader: close the FIFO it reads, or open the FIFO for
+		// writing so that the open waiting for a writer returns
+		mu.Lock()
+		cancelled = true
+		opening := fifo == nil
+		if fifo != nil {
+			fifo.Close()
+		}
+		mu.Unlock()
+		if opening {
+			if w, err := os.OpenFile(f.path, os.O_WRONLY|syscall.O_NONBLOCK, 0); err == nil {
+				w.Close()
+			}
+		}
+		return "", errors.Wrap(ctx.Err(), "No OTP received")
+	case r := <-done:
+		return r.otp, r.err
+	}
+}
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return lines[len(lines)-1]
+}
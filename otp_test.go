@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPromptSourceTimeout(t *testing.T) {
+	in, typed := io.Pipe()
+	defer typed.Close()
+	p := &promptSource{in: in, out: ioutil.Discard}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.ReadOTP(ctx, "9999999999", time.Now())
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("ReadOTP() = nil, want an error when nothing is entered")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReadOTP() blocked after the timeout")
+	}
+
+	// The next OTP is read by the same prompt
+	sentAt := time.Now()
+	go typed.Write([]byte("123456\n"))
+	otp, err := p.ReadOTP(context.Background(), "9999999999", sentAt)
+	if err != nil || otp != "123456" {
+		t.Errorf("ReadOTP() = %q, %v, want 123456", otp, err)
+	}
+}
+
+func TestNewOTPSourceSecret(t *testing.T) {
+	resetFlags(t)
+	otpSource = otpSourceHTTP
+	for _, addr := range []string{":8090", "0.0.0.0:8090", "192.168.1.5:8090"} {
+		otpListen = addr
+		if _, err := newOTPSource(); err == nil {
+			t.Errorf("newOTPSource() on %s = nil, want an error without --otp-secret", addr)
+		}
+	}
+	otpListen = "127.0.0.1:0"
+	src, err := newOTPSource()
+	if err != nil {
+		t.Fatalf("newOTPSource() on the loopback = %v, want no error", err)
+	}
+	src.(*httpSource).Close()
+
+	for addr, want := range map[string]bool{"localhost:8090": true, "[::1]:8090": true, ":8090": false, "example.com:8090": false, "8090": false} {
+		if got := isLoopback(addr); got != want {
+			t.Errorf("isLoopback(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestExtractOTP(t *testing.T) {
+	for _, tc := range []struct {
+		message string
+		want    string
+		ok      bool
+	}{
+		{message: "123456", want: "123456", ok: true},
+		{message: "  654321\n", want: "654321", ok: true},
+		{message: "Your OTP to register/access CoWIN is 123456. It will be valid for 3 minutes. - CoWIN", want: "123456", ok: true},
+		{message: `{"from":"AX-NHPSMS","sent":"190521","text":"Your OTP to register/access CoWIN is 987654. It will be valid for 3 minutes."}`, want: "987654", ok: true},
+		{message: "Your bank OTP is 111111", ok: false},
+		{message: "Call 180012 for help", ok: false},
+		{message: "1234567", ok: false},
+	} {
+		got, ok := extractOTP(tc.message)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("extractOTP(%q) = %q, %v, want %q, %v", tc.message, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestHTTPSourceConcurrentMessages(t *testing.T) {
+	s := &httpSource{messages: make(chan otpMessage, 1)}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("123456"))
+			s.ServeHTTP(httptest.NewRecorder(), r)
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeHTTP() blocked on concurrent messages")
+	}
+	if len(s.messages) != 1 {
+		t.Errorf("%d messages kept, want the latest one", len(s.messages))
+	}
+}
@@ -0,0 +1,35 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFIFOSourceTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "otp")
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		t.Skipf("mkfifo: %v", err)
+	}
+	f := &fileSource{path: path}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	before := runtime.NumGoroutine()
+	if _, err := f.ReadOTP(ctx, "9999999999", time.Now()); err == nil {
+		t.Fatal("ReadOTP() = nil, want an error when nothing is written")
+	}
+	// The reader waiting for a writer stops after the timeout
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines after the timeout, want %d", n, before)
+	}
+}
@@ -0,0 +1,373 @@
+// Package expr implements a small expression language to filter records
+//
+// An expression compares the fields of an environment, which can be nested:
+//
+//	session.vaccine in ["COVAXIN", "SPUTNIK V"] && session.available_capacity_dose1 >= 5 && center.pincode != 411001
+//
+// It supports number, string, boolean and list literals, the comparisons
+// ==, !=, <, <=, >, >=, in and not in, the logical operators &&, || and !,
+// and parentheses. ! applies to the comparison following it.
+package expr
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Env holds the values of the identifiers of an expression. Nested fields
+// like session.vaccine are looked up in nested Envs.
+type Env map[string]interface{}
+
+// Expr is a compiled expression
+type Expr struct {
+	src  string
+	root node
+}
+
+// Compile parses an expression
+func Compile(src string) (*Expr, error) {
+	return compile(src, nil)
+}
+
+// CompileSchema parses an expression and checks it against schema, an Env
+// holding a value of the type of every field. Unknown fields and operands of
+// the wrong type are reported whatever the values and the operators evaluated.
+func CompileSchema(src string, schema Env) (*Expr, error) {
+	e, err := compile(src, schema)
+	if err != nil {
+		return nil, err
+	}
+	t, err := e.root.check(schema)
+	if err != nil {
+		return nil, err
+	}
+	if t != "boolean" {
+		return nil, fmt.Errorf("expression results in %s, not a boolean", t)
+	}
+	return e, nil
+}
+
+func compile(src string, schema Env) (*Expr, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens, schema: schema}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %s at %d", t, t.pos)
+	}
+	return &Expr{src: src, root: root}, nil
+}
+
+// MustCompile is like Compile but panics if the expression can not be parsed
+func MustCompile(src string) *Expr {
+	e, err := Compile(src)
+	if err != nil {
+		panic(fmt.Sprintf("expr: Compile(%q): %v", src, err))
+	}
+	return e
+}
+
+// String returns the source of the expression
+func (e *Expr) String() string {
+	return e.src
+}
+
+// Eval evaluates the expression with the values of env
+func (e *Expr) Eval(env Env) (interface{}, error) {
+	return e.root.eval(env)
+}
+
+// Match evaluates an expression which has to result in a boolean
+func (e *Expr) Match(env Env) (bool, error) {
+	v, err := e.Eval(env)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression results in %s, not a boolean", typeName(v))
+	}
+	return b, nil
+}
+
+type node interface {
+	eval(env Env) (interface{}, error)
+	// check returns the type of the result with the values of the schema
+	check(schema Env) (string, error)
+}
+
+type literal struct {
+	value interface{}
+}
+
+func (l literal) eval(Env) (interface{}, error) {
+	return l.value, nil
+}
+
+func (l literal) check(Env) (string, error) {
+	return typeName(l.value), nil
+}
+
+type list []node
+
+func (l list) eval(env Env) (interface{}, error) {
+	values := make([]interface{}, 0, len(l))
+	for _, n := range l {
+		v, err := n.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func (l list) check(schema Env) (string, error) {
+	for _, n := range l {
+		if _, err := n.check(schema); err != nil {
+			return "", err
+		}
+	}
+	return "list", nil
+}
+
+type identifier []string
+
+func (id identifier) check(schema Env) (string, error) {
+	v, err := id.eval(schema)
+	if err != nil {
+		return "", err
+	}
+	return typeName(v), nil
+}
+
+func (id identifier) eval(env Env) (interface{}, error) {
+	var v interface{} = env
+	for i, name := range id {
+		m, ok := normalize(v).(Env)
+		if !ok {
+			return nil, fmt.Errorf("%s is not an object", strings.Join(id[:i], "."))
+		}
+		if v, ok = m[name]; !ok {
+			return nil, fmt.Errorf("unknown field %s", strings.Join(id[:i+1], "."))
+		}
+	}
+	return normalize(v), nil
+}
+
+type not struct {
+	operand node
+}
+
+func (n not) eval(env Env) (interface{}, error) {
+	v, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return nil, fmt.Errorf("! needs a boolean, not %s", typeName(v))
+	}
+	return !b, nil
+}
+
+func (n not) check(schema Env) (string, error) {
+	t, err := n.operand.check(schema)
+	if err != nil {
+		return "", err
+	}
+	if t != "boolean" {
+		return "", fmt.Errorf("! needs a boolean, not %s", t)
+	}
+	return t, nil
+}
+
+type logical struct {
+	op          string
+	left, right node
+}
+
+func (l logical) eval(env Env) (interface{}, error) {
+	left, err := evalBool(l.op, l.left, env)
+	if err != nil {
+		return nil, err
+	}
+	// Short circuit like Go
+	if (l.op == "&&" && !left) || (l.op == "||" && left) {
+		return left, nil
+	}
+	return evalBool(l.op, l.right, env)
+}
+
+func (l logical) check(schema Env) (string, error) {
+	for _, n := range []node{l.left, l.right} {
+		t, err := n.check(schema)
+		if err != nil {
+			return "", err
+		}
+		if t != "boolean" {
+			return "", fmt.Errorf("%s needs booleans, not %s", l.op, t)
+		}
+	}
+	return "boolean", nil
+}
+
+func evalBool(op string, n node, env Env) (bool, error) {
+	v, err := n.eval(env)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("%s needs booleans, not %s", op, typeName(v))
+	}
+	return b, nil
+}
+
+type comparison struct {
+	op          string
+	left, right node
+}
+
+func (c comparison) eval(env Env) (interface{}, error) {
+	left, err := c.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	right, err := c.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch c.op {
+	case "in", "not in":
+		values, ok := right.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s needs a list, not %s", c.op, typeName(right))
+		}
+		found := false
+		for _, v := range values {
+			if equal(left, v) {
+				found = true
+				break
+			}
+		}
+		return found == (c.op == "in"), nil
+	case "==", "!=":
+		if typeName(left) != typeName(right) || typeName(left) == "list" || typeName(left) == "object" {
+			return nil, fmt.Errorf("can not compare %s with %s", typeName(left), typeName(right))
+		}
+		return equal(left, right) == (c.op == "=="), nil
+	}
+	cmp, err := order(left, right)
+	if err != nil {
+		return nil, err
+	}
+	switch c.op {
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	}
+	return cmp >= 0, nil
+}
+
+func (c comparison) check(schema Env) (string, error) {
+	left, err := c.left.check(schema)
+	if err != nil {
+		return "", err
+	}
+	right, err := c.right.check(schema)
+	if err != nil {
+		return "", err
+	}
+	switch c.op {
+	case "in", "not in":
+		if right != "list" {
+			return "", fmt.Errorf("%s needs a list, not %s", c.op, right)
+		}
+	case "==", "!=":
+		if left != right || left == "list" || left == "object" {
+			return "", fmt.Errorf("can not compare %s with %s", left, right)
+		}
+	default:
+		if left != right || (left != "number" && left != "string") {
+			return "", fmt.Errorf("can not order %s and %s", left, right)
+		}
+	}
+	return "boolean", nil
+}
+
+func equal(a, b interface{}) bool {
+	switch typeName(a) {
+	case "list", "object":
+		return false
+	}
+	return a == b
+}
+
+// order returns -1, 0 or 1 when a is less than, equal to or greater than b
+func order(a, b interface{}) (int, error) {
+	switch x := a.(type) {
+	case float64:
+		if y, ok := b.(float64); ok {
+			switch {
+			case x < y:
+				return -1, nil
+			case x > y:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), nil
+		}
+	}
+	return 0, fmt.Errorf("can not order %s and %s", typeName(a), typeName(b))
+}
+
+// normalize converts the Go values of an Env to the types of the language
+func normalize(v interface{}) interface{} {
+	switch x := v.(type) {
+	case int:
+		return float64(x)
+	case int64:
+		return float64(x)
+	case float32:
+		return float64(x)
+	case []string:
+		values := make([]interface{}, len(x))
+		for i, s := range x {
+			values[i] = s
+		}
+		return values
+	case map[string]interface{}:
+		return Env(x)
+	}
+	return v
+}
+
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case []interface{}:
+		return "list"
+	case Env:
+		return "object"
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("%T", v)
+}
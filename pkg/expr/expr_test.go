@@ -0,0 +1,152 @@
+package expr
+
+import (
+	"strings"
+	"testing"
+)
+
+func testEnv() Env {
+	return Env{
+		"center": map[string]interface{}{
+			"name":    "Zilla Parishad Shala, Akolā",
+			"pincode": 444002,
+		},
+		"session": Env{
+			"vaccine":                  "COVAXIN",
+			"available_capacity_dose1": 12.0,
+			"slots":                    []string{"09:00AM-11:00AM", "11:00AM-01:00PM"},
+			"paid":                     false,
+		},
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		{src: `session.vaccine == "COVAXIN"`, want: true},
+		{src: `session.vaccine != 'COVAXIN'`, want: false},
+		{src: `session.vaccine in ["COVAXIN", "SPUTNIK V"]`, want: true},
+		{src: `session.vaccine not in ["COVAXIN"]`, want: false},
+		{src: `"09:00AM-11:00AM" in session.slots`, want: true},
+		{src: `session.available_capacity_dose1 >= 12 && center.pincode < 444003`, want: true},
+		{src: `session.available_capacity_dose1 > 12 || center.pincode <= -1`, want: false},
+		{src: `center.pincode == 444002.0`, want: true},
+		{src: `!session.paid`, want: true},
+		{src: `!(session.paid || session.vaccine == "COVAXIN")`, want: false},
+		{src: `session.vaccine < "COVISHIELD"`, want: true},
+		{src: `center.name == "Zilla Parishad Shala, Akolā"`, want: true},
+		{src: `center.name in ['Zilla Parishad Shala, Akolā', "it\'s"]`, want: true},
+		// The right operand is not evaluated
+		{src: `false && unknown.field`, want: false},
+		{src: `true || 1`, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			e, err := Compile(tt.src)
+			if err != nil {
+				t.Fatalf("Compile() = %v", err)
+			}
+			got, err := e.Match(testEnv())
+			if err != nil {
+				t.Fatalf("Match() = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchErrors(t *testing.T) {
+	tests := []struct {
+		src string
+		err string
+	}{
+		{src: `session.vacine == "COVAXIN"`, err: "unknown field session.vacine"},
+		{src: `session.vaccine.name == "COVAXIN"`, err: "session.vaccine is not an object"},
+		{src: `session.vaccine == 1`, err: "can not compare string with number"},
+		{src: `session.slots == session.slots`, err: "can not compare list with list"},
+		{src: `session.vaccine in "COVAXIN"`, err: "in needs a list, not string"},
+		{src: `session.paid < true`, err: "can not order boolean and boolean"},
+		{src: `!session.vaccine`, err: "! needs a boolean, not string"},
+		{src: `!session.paid && 1`, err: "&& needs booleans, not number"},
+		{src: `center.pincode`, err: "results in number, not a boolean"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			e, err := Compile(tt.src)
+			if err != nil {
+				t.Fatalf("Compile() = %v", err)
+			}
+			if _, err := e.Match(testEnv()); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Match() = %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		src string
+		err string
+	}{
+		{src: ``, err: "unexpected end of expression at 0"},
+		{src: `session.vaccine ==`, err: "unexpected end of expression at 18"},
+		{src: `session.vaccine = "COVAXIN"`, err: `unexpected character '=' at 16`},
+		{src: `session.vaccine == "COVAXIN`, err: "unterminated string at 19"},
+		{src: `(session.paid`, err: `expected ")" at 13`},
+		{src: `session.vaccine in ["COVAXIN" "COVISHIELD"]`, err: `expected "," or "]" at 30`},
+		{src: `session. == 1`, err: "expected a field name at 9"},
+		{src: `session.vaccine not "COVAXIN"`, err: `expected "in" at 20`},
+		{src: `session.paid true`, err: `unexpected "true" at 13`},
+		{src: `1.2.3 == 1`, err: `invalid number "1.2.3" at 0`},
+		// Positions are in bytes, ā takes two
+		{src: `"ā" ≥ 1`, err: `unexpected character '≥' at 5`},
+		{src: "\xff", err: "invalid UTF-8 at 0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			if _, err := Compile(tt.src); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Compile() = %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCompileSchema(t *testing.T) {
+	schema := Env{
+		"center":  Env{"name": "", "pincode": 0},
+		"session": Env{"vaccine": "", "slots": []string(nil), "paid": false},
+	}
+	valid := []string{
+		`session.vaccine in ["COVAXIN"] && center.pincode != 411001`,
+		`"09:00AM-11:00AM" in session.slots || !session.paid`,
+		`center.name >= "Ā" && !(center.pincode in [])`,
+	}
+	for _, src := range valid {
+		if _, err := CompileSchema(src, schema); err != nil {
+			t.Errorf("CompileSchema(%q) = %v", src, err)
+		}
+	}
+
+	tests := []struct {
+		src string
+		err string
+	}{
+		// Found without evaluating the expression
+		{src: `false && session.vacine == "COVAXIN"`, err: "unknown field session.vacine at 9"},
+		{src: `true || session.vaccine >= 5`, err: "can not order string and number"},
+		{src: `center.名前 == "x"`, err: "unknown field center.名前 at 0"},
+		{src: `session.paid || center.pincode`, err: "|| needs booleans, not number"},
+		{src: `center.name`, err: "results in string, not a boolean"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			if _, err := CompileSchema(tt.src, schema); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("CompileSchema() = %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
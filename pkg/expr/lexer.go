@@ -0,0 +1,126 @@
+package expr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenNumber
+	tokenString
+	tokenOperator
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	num  float64
+	pos  int
+}
+
+func (t token) is(text string) bool {
+	return (t.kind == tokenOperator || t.kind == tokenIdent) && t.text == text
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of expression"
+	case tokenString:
+		return strconv.Quote(t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// operators are sorted longest first so that <= is not read as <
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", ",", "."}
+
+// lex splits the source into tokens. The positions are byte offsets in src.
+func lex(src string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(src); {
+		c, size := utf8.DecodeRuneInString(src[i:])
+		switch {
+		case c == utf8.RuneError && size == 1:
+			return nil, fmt.Errorf("invalid UTF-8 at %d", i)
+		case unicode.IsSpace(c):
+			i += size
+		case c == '"' || c == '\'':
+			end, text, err := lexString(src, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokenString, text: text, pos: i})
+			i = end
+		case isDigit(c) || (c == '-' && i+1 < len(src) && isDigit(rune(src[i+1]))):
+			j := i + 1
+			for j < len(src) && (isDigit(rune(src[j])) || src[j] == '.') {
+				j++
+			}
+			n, err := strconv.ParseFloat(src[i:j], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q at %d", src[i:j], i)
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: src[i:j], num: n, pos: i})
+			i = j
+		case c == '_' || unicode.IsLetter(c):
+			j := i + size
+			for j < len(src) {
+				r, n := utf8.DecodeRuneInString(src[j:])
+				if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					break
+				}
+				j += n
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: src[i:j], pos: i})
+			i = j
+		default:
+			op := ""
+			for _, o := range operators {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if len(op) == 0 {
+				return nil, fmt.Errorf("unexpected character %q at %d", c, i)
+			}
+			tokens = append(tokens, token{kind: tokenOperator, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(src)}), nil
+}
+
+// isDigit only accepts the ASCII digits, ParseFloat does not read the others
+func isDigit(c rune) bool {
+	return '0' <= c && c <= '9'
+}
+
+// lexString reads the string literal starting at i and returns the position
+// after it. The text is copied as is, so multibyte characters are kept whole.
+func lexString(src string, i int) (int, string, error) {
+	quote := src[i]
+	var b strings.Builder
+	for j := i + 1; j < len(src); j++ {
+		switch src[j] {
+		case '\\':
+			if j+1 < len(src) {
+				j++
+				b.WriteByte(src[j])
+			}
+		case quote:
+			return j + 1, b.String(), nil
+		default:
+			b.WriteByte(src[j])
+		}
+	}
+	return 0, "", fmt.Errorf("unterminated string at %d", i)
+}
@@ -0,0 +1,179 @@
+package expr
+
+import (
+	"fmt"
+)
+
+// parser is a recursive descent parser of the grammar
+//
+//	or         = and { "||" and }
+//	and        = unary { "&&" unary }
+//	unary      = "!" unary | comparison
+//	comparison = operand [ ( "==" | "!=" | "<" | "<=" | ">" | ">=" | "in" | "not" "in" ) operand ]
+//	operand    = number | string | "true" | "false" | list | identifier { "." identifier } | "(" or ")"
+//	list       = "[" [ operand { "," operand } ] "]"
+type parser struct {
+	tokens []token
+	pos    int
+	// schema resolves the identifiers when set, see CompileSchema
+	schema Env
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) expect(text string) error {
+	if t := p.next(); !t.is(text) {
+		return fmt.Errorf("expected %q at %d, found %s", text, t.pos, t)
+	}
+	return nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().is("||") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = logical{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().is("&&") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = logical{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.peek().is("!") {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return not{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (node, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	op := ""
+	switch {
+	case t.is("==") || t.is("!=") || t.is("<") || t.is("<=") || t.is(">") || t.is(">=") || t.is("in"):
+		op = t.text
+		p.next()
+	case t.is("not"):
+		p.next()
+		if err := p.expect("in"); err != nil {
+			return nil, err
+		}
+		op = "not in"
+	default:
+		return left, nil
+	}
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return comparison{op: op, left: left, right: right}, nil
+}
+
+func (p *parser) parseOperand() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenNumber:
+		return literal{value: t.num}, nil
+	case tokenString:
+		return literal{value: t.text}, nil
+	case tokenIdent:
+		switch t.text {
+		case "true":
+			return literal{value: true}, nil
+		case "false":
+			return literal{value: false}, nil
+		}
+		id := identifier{t.text}
+		for p.peek().is(".") {
+			p.next()
+			field := p.next()
+			if field.kind != tokenIdent {
+				return nil, fmt.Errorf("expected a field name at %d, found %s", field.pos, field)
+			}
+			id = append(id, field.text)
+		}
+		if p.schema != nil {
+			if _, err := id.eval(p.schema); err != nil {
+				return nil, fmt.Errorf("%v at %d", err, t.pos)
+			}
+		}
+		return id, nil
+	case tokenOperator:
+		switch t.text {
+		case "(":
+			n, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return n, nil
+		case "[":
+			return p.parseList()
+		}
+	}
+	return nil, fmt.Errorf("unexpected %s at %d", t, t.pos)
+}
+
+func (p *parser) parseList() (node, error) {
+	l := list{}
+	if p.peek().is("]") {
+		p.next()
+		return l, nil
+	}
+	for {
+		n, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, n)
+		t := p.next()
+		if t.is("]") {
+			return l, nil
+		}
+		if !t.is(",") {
+			return nil, fmt.Errorf("expected \",\" or \"]\" at %d, found %s", t.pos, t)
+		}
+	}
+}
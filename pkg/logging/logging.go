@@ -0,0 +1,323 @@
+// Package logging provides a small leveled, structured logger that redacts registered secrets
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log entry
+type Level int
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+// Format is the encoding of a log entry
+type Format string
+
+const (
+	LogfmtFormat Format = "logfmt"
+	JSONFormat   Format = "json"
+
+	redacted = "[REDACTED]"
+)
+
+var levelNames = map[Level]string{
+	DebugLevel: "debug",
+	InfoLevel:  "info",
+	WarnLevel:  "warn",
+	ErrorLevel: "error",
+}
+
+func (l Level) String() string {
+	if n, ok := levelNames[l]; ok {
+		return n
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+// ParseLevel returns the Level for the given name
+func ParseLevel(name string) (Level, error) {
+	for l, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return l, nil
+		}
+	}
+	if strings.EqualFold(name, "warning") {
+		return WarnLevel, nil
+	}
+	return InfoLevel, fmt.Errorf("invalid log level %q, please use debug, info, warn or error", name)
+}
+
+// ParseFormat returns the Format for the given name
+func ParseFormat(name string) (Format, error) {
+	switch f := Format(strings.ToLower(name)); f {
+	case LogfmtFormat, JSONFormat:
+		return f, nil
+	}
+	return LogfmtFormat, fmt.Errorf("invalid log format %q, please use logfmt or json", name)
+}
+
+// Logger writes leveled key-value log entries. Any registered secret is replaced
+// with a placeholder before the entry is written.
+type Logger struct {
+	mu      sync.Mutex
+	out     io.Writer
+	level   Level
+	format  Format
+	secrets []string
+}
+
+// New returns a Logger writing entries at or above level to out
+func New(out io.Writer, level Level, format Format) *Logger {
+	return &Logger{
+		out:    out,
+		level:  level,
+		format: format,
+	}
+}
+
+// SetLevel changes the minimum level of the entries written
+func (l *Logger) SetLevel(level Level) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.level = level
+}
+
+// SetFormat changes the encoding of the entries written
+func (l *Logger) SetFormat(format Format) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.format = format
+}
+
+// AddSecret registers a value that must never appear in the log output
+func (l *Logger) AddSecret(secret string) {
+	if len(secret) == 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, s := range l.secrets {
+		if s == secret {
+			return
+		}
+	}
+	l.secrets = append(l.secrets, secret)
+	// Replace longer secrets first so that a secret containing another is fully masked
+	sort.Slice(l.secrets, func(i, j int) bool { return len(l.secrets[i]) > len(l.secrets[j]) })
+}
+
+// Redact returns s with all the registered secrets masked
+func (l *Logger) Redact(s string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.redact(s)
+}
+
+func (l *Logger) redact(s string) string {
+	for _, secret := range l.secrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	// Mask secrets in logged JSON documents, such as API responses, before they get registered
+	return sensitiveJSONField.ReplaceAllString(s, `"$1":"`+redacted+`"`)
+}
+
+// Enabled reports whether entries at the given level are written
+func (l *Logger) Enabled(level Level) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return level >= l.level
+}
+
+// Debug logs msg with the key-value pairs at debug level
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(DebugLevel, msg, kv) }
+
+// Info logs msg with the key-value pairs at info level
+func (l *Logger) Info(msg string, kv ...interface{}) { l.log(InfoLevel, msg, kv) }
+
+// Warn logs msg with the key-value pairs at warn level
+func (l *Logger) Warn(msg string, kv ...interface{}) { l.log(WarnLevel, msg, kv) }
+
+// Error logs msg with the key-value pairs at error level
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(ErrorLevel, msg, kv) }
+
+// Fatal logs msg with the key-value pairs at error level and exits the process
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	l.log(ErrorLevel, msg, kv)
+	os.Exit(1)
+}
+
+// Writer returns an io.Writer that logs every line written to it at the given level.
+// It is used to route the standard library logger through the Logger.
+func (l *Logger) Writer(level Level) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+			l.log(level, line, nil)
+		}
+		return len(p), nil
+	})
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+type field struct {
+	key   string
+	value string
+}
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if level < l.level {
+		return
+	}
+	fields := []field{
+		{"time", time.Now().Format(time.RFC3339)},
+		{"level", level.String()},
+		{"msg", l.redact(msg)},
+	}
+	for i := 0; i < len(kv); i += 2 {
+		key := fmt.Sprint(kv[i])
+		if i+1 == len(kv) {
+			fields = append(fields, field{"!BADKEY", l.redact(key)})
+			break
+		}
+		value := redacted
+		if !isSensitiveKey(key) {
+			value = l.redact(toString(kv[i+1]))
+		}
+		fields = append(fields, field{l.redact(key), value})
+	}
+	var line string
+	if l.format == JSONFormat {
+		line = encodeJSON(fields)
+	} else {
+		line = encodeLogfmt(fields)
+	}
+	fmt.Fprintln(l.out, line)
+}
+
+// sensitiveJSONField matches the JSON string fields whose name marks them as secret
+var sensitiveJSONField = regexp.MustCompile(`(?i)"([^"]*(?:token|password|secret|otp)[^"]*)"\s*:\s*"(?:[^"\\]|\\.)*"`)
+
+// isSensitiveKey reports whether values logged under key are always masked,
+// even when they were never registered with AddSecret
+func isSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range []string{"token", "password", "secret", "otp"} {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func toString(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case error:
+		return t.Error()
+	case time.Duration:
+		return t.String()
+	case fmt.Stringer:
+		return t.String()
+	}
+	return fmt.Sprint(v)
+}
+
+func encodeLogfmt(fields []field) string {
+	parts := make([]string, 0, len(fields))
+	for _, f := range fields {
+		parts = append(parts, f.key+"="+quoteLogfmt(f.value))
+	}
+	return strings.Join(parts, " ")
+}
+
+func quoteLogfmt(v string) string {
+	if v == "" {
+		return `""`
+	}
+	if strings.ContainsAny(v, " =\"\t\r\n") {
+		return quoteJSON(v)
+	}
+	return v
+}
+
+func encodeJSON(fields []field) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, f := range fields {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(quoteJSON(f.key))
+		b.WriteByte(':')
+		b.WriteString(quoteJSON(f.value))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// quoteJSON returns v as a JSON string without escaping HTML characters,
+// which are common in the logged URLs
+func quoteJSON(v string) string {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+var std = New(os.Stderr, InfoLevel, LogfmtFormat)
+
+// Default returns the process wide Logger
+func Default() *Logger { return std }
+
+// SetLevel changes the minimum level of the default Logger
+func SetLevel(level Level) { std.SetLevel(level) }
+
+// SetFormat changes the encoding of the default Logger
+func SetFormat(format Format) { std.SetFormat(format) }
+
+// AddSecret registers a value that the default Logger must never write
+func AddSecret(secret string) { std.AddSecret(secret) }
+
+// Redact masks the secrets registered with the default Logger in s
+func Redact(s string) string { return std.Redact(s) }
+
+// Enabled reports whether the default Logger writes entries at the given level
+func Enabled(level Level) bool { return std.Enabled(level) }
+
+// Debug logs at debug level using the default Logger
+func Debug(msg string, kv ...interface{}) { std.log(DebugLevel, msg, kv) }
+
+// Info logs at info level using the default Logger
+func Info(msg string, kv ...interface{}) { std.log(InfoLevel, msg, kv) }
+
+// Warn logs at warn level using the default Logger
+func Warn(msg string, kv ...interface{}) { std.log(WarnLevel, msg, kv) }
+
+// Error logs at error level using the default Logger
+func Error(msg string, kv ...interface{}) { std.log(ErrorLevel, msg, kv) }
+
+// Fatal logs at error level using the default Logger and exits the process
+func Fatal(msg string, kv ...interface{}) {
+	std.log(ErrorLevel, msg, kv)
+	os.Exit(1)
+}
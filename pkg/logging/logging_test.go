@@ -0,0 +1,132 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	l := New(&bytes.Buffer{}, DebugLevel, LogfmtFormat)
+	l.AddSecret("")
+	l.AddSecret("hunter2")
+	l.AddSecret("hunter2hunter2")
+	l.AddSecret("hunter2")
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "no secret", in: "Searching 444002", want: "Searching 444002"},
+		{name: "secret", in: "password=hunter2 sent", want: "password=[REDACTED] sent"},
+		{name: "longer secret first", in: "key hunter2hunter2", want: "key [REDACTED]"},
+		{name: "every occurrence", in: "hunter2,hunter2", want: "[REDACTED],[REDACTED]"},
+		{name: "empty secret ignored", in: "", want: ""},
+		{
+			name: "JSON token field",
+			in:   `{"token":"eyJhbGciOi","txnId":"abc"}`,
+			want: `{"token":"[REDACTED]","txnId":"abc"}`,
+		},
+		{
+			name: "JSON fields named like secrets",
+			in:   `{"otp": "123456", "Password":"p\"w", "client_secret":"x", "name":"Asha"}`,
+			want: `{"otp":"[REDACTED]", "Password":"[REDACTED]", "client_secret":"[REDACTED]", "name":"Asha"}`,
+		},
+		{
+			name: "JSON non string field",
+			in:   `{"otp_length":6,"name":"token"}`,
+			want: `{"otp_length":6,"name":"token"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := l.Redact(tt.in); got != tt.want {
+				t.Errorf("Redact(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsSensitiveKey(t *testing.T) {
+	tests := map[string]bool{
+		"token":       true,
+		"authToken":   true,
+		"PASSWORD":    true,
+		"otp_secret":  true,
+		"otp":         true,
+		"pincode":     false,
+		"district_id": false,
+	}
+	for key, want := range tests {
+		if got := isSensitiveKey(key); got != want {
+			t.Errorf("isSensitiveKey(%q) = %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestLog(t *testing.T) {
+	var out bytes.Buffer
+	l := New(&out, InfoLevel, LogfmtFormat)
+	l.AddSecret("hunter2")
+
+	l.Debug("Not written")
+	l.Info("Sent hunter2", "pincode", "444002", "token", "abc", "err", errors.New("bad hunter2"), "dangling")
+	got := out.String()
+	for _, want := range []string{
+		`level=info`,
+		`msg="Sent [REDACTED]"`,
+		`pincode=444002`,
+		`token=[REDACTED]`,
+		`err="bad [REDACTED]"`,
+		`!BADKEY=dangling`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("log = %q, want it to contain %q", got, want)
+		}
+	}
+	if strings.Contains(got, "Not written") || strings.Contains(got, "hunter2") || strings.Contains(got, "abc") {
+		t.Errorf("log = %q, want no debug entry and no secret", got)
+	}
+
+	out.Reset()
+	l.SetFormat(JSONFormat)
+	l.Warn("Response", "body", `{"token":"abc","url":"/a?b=1&c=2"}`)
+	var entry map[string]string
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("Invalid JSON entry %q: %v", out.String(), err)
+	}
+	if entry["level"] != "warn" || entry["body"] != `{"token":"[REDACTED]","url":"/a?b=1&c=2"}` {
+		t.Errorf("entry = %v, want a warn entry with the token redacted", entry)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	var out bytes.Buffer
+	l := New(&out, InfoLevel, LogfmtFormat)
+	l.AddSecret("hunter2")
+	l.Writer(WarnLevel).Write([]byte("first hunter2\nsecond\n"))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("wrote %q, want 2 entries", out.String())
+	}
+	if !strings.Contains(lines[0], `level=warn msg="first [REDACTED]"`) || !strings.Contains(lines[1], "msg=second") {
+		t.Errorf("wrote %q, want the lines as redacted warn entries", lines)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for name, want := range map[string]Level{"debug": DebugLevel, "INFO": InfoLevel, "warning": WarnLevel, "error": ErrorLevel} {
+		if got, err := ParseLevel(name); err != nil || got != want {
+			t.Errorf("ParseLevel(%q) = %v, %v, want %v", name, got, err, want)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("ParseLevel(verbose) = nil, want an error")
+	}
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Error("ParseFormat(xml) = nil, want an error")
+	}
+}
@@ -2,42 +2,129 @@
 package notify
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"net"
 	"net/smtp"
+	"strings"
+	"time"
 )
 
 const (
-	smtpServerAddress = "smtp.gmail.com"
-	smtpServerPort    = "587"
+	// DefaultSMTPServer is the Gmail SMTP server the emails are sent with by default
+	DefaultSMTPServer = "smtp.gmail.com:587"
+	// defaultSubject is the subject of the messages without a title
+	defaultSubject = "covaccine-notifier"
 )
 
 type Email struct {
 	ID   string
 	Pass string
+
+	// server is the host:port of the SMTP server, tlsConfig the configuration
+	// of its STARTTLS, nil to verify the certificate of the host
+	server    string
+	tlsConfig *tls.Config
 }
 
 // NewEmail returns the instance of Email
 func NewEmail(id, pass string) Notifier {
+	return newEmail(id, pass, DefaultSMTPServer, nil)
+}
+
+// NewSMTPEmail returns the instance of Email sending with the SMTP server
+// host:port, which has to support STARTTLS
+func NewSMTPEmail(id, pass, server string) (Notifier, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		return nil, fmt.Errorf("invalid SMTP server %q, please use host:port", server)
+	}
+	return newEmail(id, pass, server, nil), nil
+}
+
+func newEmail(id, pass, server string, tlsConfig *tls.Config) *Email {
 	return &Email{
-		ID:   id,
-		Pass: pass,
+		ID:        id,
+		Pass:      pass,
+		server:    server,
+		tlsConfig: tlsConfig,
 	}
 }
 
-// SendMessage takes message body and send it to the given email-id
-func (e *Email) SendMessage(body string) error {
+// SendMessage takes message body and send it to the given email-id, with the title as subject
+func (e *Email) SendMessage(ctx context.Context, title, body string) error {
+	subject := strings.Join(strings.Fields(title), " ")
+	if len(subject) == 0 {
+		subject = defaultSubject
+	}
 	msg := "From: " + e.ID + "\n" +
 		"To: " + e.ID + "\n" +
-		"Subject: Vaccination slots are available\n\n" +
-		"Vaccination slots are available at the following centers:\n\n" +
+		"Subject: " + subject + "\n\n" +
 		body
 
-	err := smtp.SendMail(fmt.Sprintf("%s:%s", smtpServerAddress, smtpServerPort),
-		smtp.PlainAuth("", e.ID, e.Pass, smtpServerAddress),
-		e.ID, []string{e.ID}, []byte(msg))
+	server := e.server
+	if len(server) == 0 {
+		server = DefaultSMTPServer
+	}
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return err
+	}
+	tlsConfig := e.tlsConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{ServerName: host}
+	}
+	return sendMail(ctx, server, tlsConfig, smtp.PlainAuth("", e.ID, e.Pass, host), e.ID, []string{e.ID}, []byte(msg))
+}
 
+// sendMail is smtp.SendMail which stops when the context is done
+func sendMail(ctx context.Context, server string, tlsConfig *tls.Config, auth smtp.Auth, from string, to []string, msg []byte) error {
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(sendTimeout)
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if err := c.StartTLS(tlsConfig); err != nil {
+		return err
+	}
+	if err := c.Auth(auth); err != nil {
+		return err
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
 	if err != nil {
 		return err
 	}
-	return nil
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
 }
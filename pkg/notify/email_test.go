@@ -0,0 +1,221 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTP is an SMTP server with STARTTLS and AUTH PLAIN, it records the mails
+type fakeSMTP struct {
+	addr      string
+	user      string
+	pass      string
+	noTLS     bool
+	clientTLS *tls.Config
+
+	serverTLS *tls.Config
+	mu        sync.Mutex
+	mails     []fakeMail
+}
+
+type fakeMail struct {
+	from string
+	to   []string
+	data string
+}
+
+// startFakeSMTP listens on a local port with the certificate of an httptest server
+func startFakeSMTP(t *testing.T, f *fakeSMTP) {
+	t.Helper()
+	certSrv := httptest.NewTLSServer(nil)
+	t.Cleanup(certSrv.Close)
+	pool := x509.NewCertPool()
+	pool.AddCert(certSrv.Certificate())
+	f.serverTLS = &tls.Config{Certificates: certSrv.TLS.Certificates}
+	f.clientTLS = &tls.Config{ServerName: "127.0.0.1", RootCAs: pool}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	f.addr = l.Addr().String()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+}
+
+func (f *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost ESMTP fake")
+	secure, authenticated := false, false
+	var mail fakeMail
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch {
+		case cmd == "EHLO":
+			switch {
+			case !secure && !f.noTLS:
+				tp.PrintfLine("250-localhost\r\n250 STARTTLS")
+			case secure:
+				tp.PrintfLine("250-localhost\r\n250 AUTH PLAIN")
+			default:
+				tp.PrintfLine("250 localhost")
+			}
+		case cmd == "STARTTLS" && !f.noTLS:
+			tp.PrintfLine("220 Ready to start TLS")
+			tlsConn := tls.Server(conn, f.serverTLS)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, secure = tlsConn, true
+			tp = textproto.NewConn(conn)
+		case cmd == "AUTH" && secure:
+			fields := strings.Fields(line)
+			creds, err := base64.StdEncoding.DecodeString(fields[len(fields)-1])
+			if err != nil || string(creds) != "\x00"+f.user+"\x00"+f.pass {
+				tp.PrintfLine("535 5.7.8 Username and Password not accepted")
+				continue
+			}
+			authenticated = true
+			tp.PrintfLine("235 2.7.0 Accepted")
+		case cmd == "MAIL" && authenticated:
+			mail.from = strings.Trim(strings.TrimPrefix(line, "MAIL FROM:"), "<> ")
+			tp.PrintfLine("250 OK")
+		case cmd == "RCPT" && authenticated:
+			mail.to = append(mail.to, strings.Trim(strings.TrimPrefix(line, "RCPT TO:"), "<> "))
+			tp.PrintfLine("250 OK")
+		case cmd == "DATA" && authenticated:
+			tp.PrintfLine("354 Go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			mail.data = string(data)
+			f.mu.Lock()
+			f.mails = append(f.mails, mail)
+			f.mu.Unlock()
+			tp.PrintfLine("250 OK")
+		case cmd == "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("530 5.7.0 Must issue a STARTTLS command first")
+		}
+	}
+}
+
+func TestEmailSendMessage(t *testing.T) {
+	tests := []struct {
+		name  string
+		pass  string
+		title string
+		noTLS bool
+		err   string
+		// subject is the wanted subject of the mail
+		subject string
+	}{
+		{name: "sent", pass: "secret", title: "Vaccination slots are available", subject: "Vaccination slots are available"},
+		{name: "digest", pass: "secret", title: "Vaccination slots digest", subject: "Vaccination slots digest"},
+		{name: "title on lines", pass: "secret", title: "Slots\r\nBcc: eve@example.com", subject: "Slots Bcc: eve@example.com"},
+		{name: "no title", pass: "secret", subject: "covaccine-notifier"},
+		{name: "wrong password", pass: "wrong", err: "535"},
+		{name: "server without STARTTLS", pass: "secret", noTLS: true, err: "STARTTLS"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeSMTP{user: "asha@example.com", pass: "secret", noTLS: tt.noTLS}
+			startFakeSMTP(t, f)
+			n := newEmail("asha@example.com", tt.pass, f.addr, f.clientTLS)
+
+			body := "Center\tCivil Hospital\nPinCode\t444001\n"
+			err := n.SendMessage(context.Background(), tt.title, body)
+			if len(tt.err) != 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("SendMessage() = %v, want an error containing %q", err, tt.err)
+				}
+				if len(f.mails) != 0 {
+					t.Errorf("sent %d mails, want none", len(f.mails))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SendMessage() = %v", err)
+			}
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			if len(f.mails) != 1 {
+				t.Fatalf("sent %d mails, want 1", len(f.mails))
+			}
+			mail := f.mails[0]
+			if mail.from != "asha@example.com" || len(mail.to) != 1 || mail.to[0] != "asha@example.com" {
+				t.Errorf("mail from %q to %q, want from and to asha@example.com", mail.from, mail.to)
+			}
+			msg, err := textproto.NewReader(bufio.NewReader(strings.NewReader(mail.data))).ReadMIMEHeader()
+			if err != nil {
+				t.Fatalf("Invalid mail headers: %v", err)
+			}
+			headers := map[string]string{
+				"From":    "asha@example.com",
+				"To":      "asha@example.com",
+				"Subject": tt.subject,
+			}
+			for k, want := range headers {
+				if got := msg.Get(k); got != want {
+					t.Errorf("%s = %q, want %q", k, got, want)
+				}
+			}
+			if msg.Get("Bcc") != "" || !strings.HasSuffix(mail.data, "\n\n"+body) {
+				t.Errorf("mail = %q, want the headers and the body %q", mail.data, body)
+			}
+		})
+	}
+}
+
+func TestEmailSendMessageCancelled(t *testing.T) {
+	f := &fakeSMTP{user: "asha@example.com", pass: "secret"}
+	startFakeSMTP(t, f)
+	n := newEmail("asha@example.com", "secret", f.addr, f.clientTLS)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := n.SendMessage(ctx, "Slots", "slots"); err == nil {
+		t.Fatal("SendMessage() = nil, want an error for the cancelled context")
+	}
+}
+
+func TestNewSMTPEmail(t *testing.T) {
+	for _, server := range []string{"smtp.gmail.com", "", "smtp.gmail.com:587:1"} {
+		if _, err := NewSMTPEmail("asha@example.com", "secret", server); err == nil {
+			t.Errorf("NewSMTPEmail(%q) = nil, want an error for the server without a port", server)
+		}
+	}
+	n, err := NewSMTPEmail("asha@example.com", "secret", "smtp.example.com:2525")
+	if err != nil {
+		t.Fatalf("NewSMTPEmail() = %v", err)
+	}
+	if got := n.(*Email).server; got != "smtp.example.com:2525" {
+		t.Errorf("server = %q, want smtp.example.com:2525", got)
+	}
+}
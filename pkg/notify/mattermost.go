@@ -1,6 +1,7 @@
 package notify
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 
@@ -16,6 +17,7 @@ type Mattermost struct {
 // *mattermost.Client4 and the mattermost direct message channel ID
 func NewMattermost(url, token, username string) (Notifier, error) {
 	client := mattermost.NewAPIv4Client(url)
+	client.HttpClient = &http.Client{Timeout: sendTimeout}
 	client.AuthToken = token
 	client.AuthType = mattermost.HEADER_AUTH
 	client.HttpHeader = map[string]string{
@@ -23,7 +25,8 @@ func NewMattermost(url, token, username string) (Notifier, error) {
 	}
 	botUser, res := client.GetMe("")
 	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unable to authenticate bot user: %s, using token", botUser.Nickname)
+		// botUser is nil when the request fails
+		return nil, fmt.Errorf("unable to authenticate bot user using token: %v", res.Error)
 	}
 	sendUser, res := client.GetUserByUsername(username, "")
 	if res.StatusCode != http.StatusOK {
@@ -40,12 +43,19 @@ func NewMattermost(url, token, username string) (Notifier, error) {
 }
 
 // SendMessage sends the message to a mattermost user as a bot
-func (m *Mattermost) SendMessage(body string) error {
-	if _, res := m.Client.CreatePost(&mattermost.Post{
-		ChannelId: m.ChannelID,
-		Message:   body,
-	}); res.StatusCode != http.StatusCreated {
-		return fmt.Errorf("error sending message to channel: %s", m.ChannelID)
+func (m *Mattermost) SendMessage(ctx context.Context, title, body string) error {
+	// Client4 does not take a context
+	err := sendContext(ctx, func() error {
+		if _, res := m.Client.CreatePost(&mattermost.Post{
+			ChannelId: m.ChannelID,
+			Message:   messageText(title, body),
+		}); res.StatusCode != http.StatusCreated {
+			return fmt.Errorf("status %d: %v", res.StatusCode, res.Error)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error sending message to channel: %s: %v", m.ChannelID, err)
 	}
 	return nil
 }
@@ -0,0 +1,171 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testMattermostToken = "mm-token"
+
+// fakeMattermost is a Mattermost API with the bot and one user, it records the posts
+type fakeMattermost struct {
+	failPost bool
+	// hold delays the posts until it is closed, when set
+	hold chan struct{}
+
+	mu    sync.Mutex
+	posts []map[string]interface{}
+}
+
+func (f *fakeMattermost) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Header.Get("Authorization") != "Bearer "+testMattermostToken {
+		writeAppError(w, http.StatusUnauthorized, "Invalid or expired session, please login again.")
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v4/users/me":
+		fmt.Fprint(w, `{"id":"bot1","username":"slots-bot","nickname":"Slots"}`)
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v4/users/username/asha":
+		fmt.Fprint(w, `{"id":"user1","username":"asha"}`)
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v4/channels/direct":
+		var ids []string
+		if err := json.NewDecoder(r.Body).Decode(&ids); err != nil || len(ids) != 2 || ids[0] != "bot1" || ids[1] != "user1" {
+			writeAppError(w, http.StatusBadRequest, "Invalid user ids")
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"id":"channel1","type":"D"}`)
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v4/posts":
+		if f.hold != nil {
+			<-f.hold
+		}
+		if f.failPost {
+			writeAppError(w, http.StatusForbidden, "You do not have the appropriate permissions.")
+			return
+		}
+		var post map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&post); err != nil {
+			writeAppError(w, http.StatusBadRequest, "Invalid post")
+			return
+		}
+		f.mu.Lock()
+		f.posts = append(f.posts, post)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"id":"post1","channel_id":"channel1"}`)
+	default:
+		writeAppError(w, http.StatusNotFound, "Unable to find the user.")
+	}
+}
+
+func writeAppError(w http.ResponseWriter, status int, msg string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"id":"api.error","message":%q,"status_code":%d}`, msg, status)
+}
+
+func TestNewMattermost(t *testing.T) {
+	tests := []struct {
+		name     string
+		token    string
+		username string
+		err      string
+	}{
+		{name: "direct channel", token: testMattermostToken, username: "asha"},
+		{name: "invalid token", token: "wrong", username: "asha", err: "unable to authenticate bot user"},
+		{name: "unknown user", token: testMattermostToken, username: "ravi", err: "unable to find user id of user: ravi"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(&fakeMattermost{})
+			defer srv.Close()
+			n, err := NewMattermost(srv.URL, tt.token, tt.username)
+			if len(tt.err) != 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("NewMattermost() = %v, want an error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewMattermost() = %v", err)
+			}
+			if got := n.(*Mattermost).ChannelID; got != "channel1" {
+				t.Errorf("ChannelID = %q, want channel1", got)
+			}
+		})
+	}
+}
+
+func TestMattermostSendMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		failPost bool
+		err      string
+	}{
+		{name: "posted"},
+		{name: "post refused", failPost: true, err: "error sending message to channel: channel1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeMattermost{failPost: tt.failPost}
+			srv := httptest.NewServer(f)
+			defer srv.Close()
+			n, err := NewMattermost(srv.URL, testMattermostToken, "asha")
+			if err != nil {
+				t.Fatalf("NewMattermost() = %v", err)
+			}
+			body := "Center\tCivil Hospital\nPinCode\t444001\n"
+			err = n.SendMessage(context.Background(), testTitle, body)
+			if len(tt.err) != 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("SendMessage() = %v, want an error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SendMessage() = %v", err)
+			}
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			if len(f.posts) != 1 {
+				t.Fatalf("posted %d messages, want 1", len(f.posts))
+			}
+			if got := f.posts[0]["channel_id"]; got != "channel1" {
+				t.Errorf("channel_id = %v, want channel1", got)
+			}
+			if got, want := f.posts[0]["message"], testTitle+"\n\n"+body; got != want {
+				t.Errorf("message = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestMattermostSendMessageTimeout(t *testing.T) {
+	f := &fakeMattermost{hold: make(chan struct{})}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	defer close(f.hold)
+	n, err := NewMattermost(srv.URL, testMattermostToken, "asha")
+	if err != nil {
+		t.Fatalf("NewMattermost() = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- n.SendMessage(ctx, "Slots", "slots") }()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "deadline exceeded") {
+			t.Errorf("SendMessage() = %v, want the deadline error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SendMessage() ignored the deadline of the context")
+	}
+}
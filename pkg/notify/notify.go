@@ -1,7 +1,42 @@
 // Package notify has functions and types used for sending notifications on different communication channel
 package notify
 
-// Notifier can be any type that can SendMessage
+import (
+	"context"
+	"time"
+)
+
+// sendTimeout bounds a notification request when the caller's context has no deadline
+const sendTimeout = 30 * time.Second
+
+// Notifier can be any type that can SendMessage. The title tells what the
+// message is about, like the subject of an email.
 type Notifier interface {
-	SendMessage(string) error
+	SendMessage(ctx context.Context, title, body string) error
+}
+
+// messageText returns the text of a message for the notifiers without a
+// separate title
+func messageText(title, body string) string {
+	if len(title) == 0 {
+		return body
+	}
+	return title + "\n\n" + body
+}
+
+// sendContext runs send, a request of a client without context support, and
+// returns as soon as ctx is done. The request is then left to the timeout of
+// the client and the message may still be delivered.
+func sendContext(ctx context.Context, send func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- send() }()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-done:
+		return err
+	}
 }
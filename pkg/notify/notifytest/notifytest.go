@@ -0,0 +1,63 @@
+// Package notifytest has a notify.Notifier test double
+package notifytest
+
+import (
+	"context"
+	"sync"
+)
+
+// Recorder is a notify.Notifier keeping the messages sent with it
+type Recorder struct {
+	mu       sync.Mutex
+	titles   []string
+	messages []string
+	err      error
+}
+
+// NewRecorder returns a Recorder whose SendMessage returns err, nil to succeed
+func NewRecorder(err error) *Recorder {
+	return &Recorder{err: err}
+}
+
+// SendMessage records the message, even when it fails
+func (r *Recorder) SendMessage(ctx context.Context, title, body string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.titles = append(r.titles, title)
+	r.messages = append(r.messages, body)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return r.err
+}
+
+// SetError changes the error returned by SendMessage
+func (r *Recorder) SetError(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.err = err
+}
+
+// Messages returns the messages sent so far
+func (r *Recorder) Messages() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.messages...)
+}
+
+// Titles returns the titles of the messages sent so far
+func (r *Recorder) Titles() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.titles...)
+}
+
+// Last returns the last message sent, or an empty string
+func (r *Recorder) Last() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.messages) == 0 {
+		return ""
+	}
+	return r.messages[len(r.messages)-1]
+}
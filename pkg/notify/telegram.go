@@ -2,13 +2,16 @@
 package notify
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"net/http"
 	"strings"
 	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 	"github.com/pkg/errors"
+
+	"github.com/PrasadG193/covaccine-notifier/pkg/logging"
 )
 
 const (
@@ -26,12 +29,17 @@ type Telegram struct {
 // It requires a username to fetch the appropriate chatID and
 // a token provided by @BotFather on Telegram to create bot Instance
 func NewTelegram(username, token string) (Notifier, error) {
-	bot, err := tgbotapi.NewBotAPI(token)
+	return newTelegram(username, token, &http.Client{Timeout: sendTimeout})
+}
+
+// newTelegram is NewTelegram with the client sending the requests to the Bot API
+func newTelegram(username, token string, client *http.Client) (Notifier, error) {
+	bot, err := tgbotapi.NewBotAPIWithClient(token, client)
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf("Unable to find bot for the given botAPI token %s", token))
+		return nil, errors.Wrap(redactToken(err, token), "Unable to find bot for the given botAPI token")
 	}
 
-	log.Printf("Authorized on account %s", bot.Self.UserName)
+	logging.Info("Authorized on telegram account", "bot", bot.Self.UserName)
 
 	u := tgbotapi.NewUpdate(0)
 	u.Timeout = timeout
@@ -46,7 +54,7 @@ func NewTelegram(username, token string) (Notifier, error) {
 		}
 		if strings.ToLower(update.Message.Chat.UserName) == strings.ToLower(username) {
 			chatID := update.Message.Chat.ID
-			log.Printf("chatID for the conversation between username: %s and bot: %s is %d", username, bot.Self.UserName, chatID)
+			logging.Info("Found telegram chat", "username", username, "bot", bot.Self.UserName, "chat_id", chatID)
 			return &Telegram{
 				ChatID: chatID,
 				Bot:    bot,
@@ -57,23 +65,35 @@ func NewTelegram(username, token string) (Notifier, error) {
 }
 
 // SendMessage takes message body and send it to the given chatID as text message or file
-func (t *Telegram) SendMessage(body string) error {
-	if len(body) > maxOneMessageLength {
-		log.Printf("Message body too long, Message will be sent as file ")
+func (t *Telegram) SendMessage(ctx context.Context, title, body string) error {
+	text := messageText(title, body)
+	var c tgbotapi.Chattable = tgbotapi.NewMessage(t.ChatID, text)
+	if len(text) > maxOneMessageLength {
+		logging.Info("Message body too long, Message will be sent as file", "length", len(text))
 		fileBytes := tgbotapi.FileBytes{
 			Name:  fmt.Sprintf("slots-available-%d.txt", time.Now().Unix()),
 			Bytes: []byte(body),
 		}
-		documentConfig := tgbotapi.NewDocumentUpload(t.ChatID, fileBytes)
-		if _, err := t.Bot.Send(documentConfig); err != nil {
-			return errors.Wrap(err, "Unable to send message to telegram")
-		}
-		return nil
+		doc := tgbotapi.NewDocumentUpload(t.ChatID, fileBytes)
+		doc.Caption = title
+		c = doc
 	}
-	msg := tgbotapi.NewMessage(t.ChatID, body)
-	_, err := t.Bot.Send(msg)
+	// The bot API client does not take a context
+	err := sendContext(ctx, func() error {
+		_, err := t.Bot.Send(c)
+		return err
+	})
 	if err != nil {
-		return errors.Wrap(err, "Unable to send message to telegram")
+		return errors.Wrap(redactToken(err, t.Bot.Token), "Unable to send message to telegram")
 	}
 	return nil
 }
+
+// redactToken removes the bot token from the errors of the Bot API client,
+// which contain the request URL when the request fails
+func redactToken(err error, token string) error {
+	if len(token) == 0 || !strings.Contains(err.Error(), token) {
+		return err
+	}
+	return errors.New(strings.ReplaceAll(err.Error(), token, "[REDACTED]"))
+}
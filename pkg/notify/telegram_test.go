@@ -0,0 +1,258 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testBotToken = "123:secret"
+
+// fakeTelegram is a Bot API with one chat, it records the messages and the
+// documents sent to it
+type fakeTelegram struct {
+	chatUser string
+	failSend bool
+	// hold delays the messages until it is closed, when set
+	hold chan struct{}
+
+	mu        sync.Mutex
+	messages  []url.Values
+	documents map[string]string
+	captions  []string
+}
+
+func (f *fakeTelegram) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	prefix := "/bot" + testBotToken + "/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"ok":false,"error_code":401,"description":"Unauthorized"}`)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	switch strings.TrimPrefix(r.URL.Path, prefix) {
+	case "getMe":
+		fmt.Fprint(w, `{"ok":true,"result":{"id":1,"is_bot":true,"first_name":"Slots","username":"slots_bot"}}`)
+	case "getUpdates":
+		fmt.Fprintf(w, `{"ok":true,"result":[{"update_id":1},{"update_id":2,"message":{"message_id":1,"date":0,"chat":{"id":42,"type":"private","username":%q}}}]}`, f.chatUser)
+	case "sendMessage":
+		if f.hold != nil {
+			<-f.hold
+		}
+		if f.failSend {
+			fmt.Fprint(w, `{"ok":false,"error_code":400,"description":"Bad Request: chat not found"}`)
+			return
+		}
+		r.ParseForm()
+		f.mu.Lock()
+		f.messages = append(f.messages, r.PostForm)
+		f.mu.Unlock()
+		fmt.Fprint(w, `{"ok":true,"result":{"message_id":2,"date":0,"chat":{"id":42,"type":"private"}}}`)
+	case "sendDocument":
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		file, header, err := r.FormFile("document")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, _ := ioutil.ReadAll(file)
+		f.mu.Lock()
+		f.documents[r.FormValue("chat_id")+"/"+header.Filename] = string(data)
+		f.captions = append(f.captions, r.FormValue("caption"))
+		f.mu.Unlock()
+		fmt.Fprint(w, `{"ok":true,"result":{"message_id":3,"date":0,"chat":{"id":42,"type":"private"}}}`)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// roundTripFunc is an http.RoundTripper calling the function
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// startFakeTelegram returns a client sending the requests to the fake API
+// instead of api.telegram.org
+func startFakeTelegram(t *testing.T, f *fakeTelegram) *http.Client {
+	t.Helper()
+	f.documents = map[string]string{}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	target, _ := url.Parse(srv.URL)
+	return &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		r.URL.Scheme, r.URL.Host = target.Scheme, target.Host
+		return http.DefaultTransport.RoundTrip(r)
+	})}
+}
+
+func TestNewTelegram(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		token    string
+		chatID   int64
+		err      string
+	}{
+		{name: "chat found", username: "asha", token: testBotToken, chatID: 42},
+		{name: "username case", username: "ASHA", token: testBotToken, chatID: 42},
+		{name: "no chat with the bot", username: "ravi", token: testBotToken, err: "Send message to the bot slots_bot"},
+		{name: "invalid token", username: "asha", token: "456:wrong", err: "Unable to find bot"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := startFakeTelegram(t, &fakeTelegram{chatUser: "Asha"})
+			n, err := newTelegram(tt.username, tt.token, client)
+			if len(tt.err) != 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("NewTelegram() = %v, want an error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewTelegram() = %v", err)
+			}
+			if got := n.(*Telegram).ChatID; got != tt.chatID {
+				t.Errorf("ChatID = %d, want %d", got, tt.chatID)
+			}
+		})
+	}
+}
+
+const testTitle = "Vaccination slots are available"
+
+func TestTelegramSendMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		failSend bool
+		// document is true when the body has to be sent as a file
+		document bool
+		err      string
+	}{
+		{name: "short message", body: "Center\tCivil Hospital\n"},
+		{name: "longest message", body: strings.Repeat("a", maxOneMessageLength-len(testTitle)-2)},
+		{name: "too long for a message", body: strings.Repeat("a", maxOneMessageLength-len(testTitle)-1), document: true},
+		{name: "API error", body: "Center\tCivil Hospital\n", failSend: true, err: "chat not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeTelegram{chatUser: "asha", failSend: tt.failSend}
+			client := startFakeTelegram(t, f)
+			n, err := newTelegram("asha", testBotToken, client)
+			if err != nil {
+				t.Fatalf("NewTelegram() = %v", err)
+			}
+			err = n.SendMessage(context.Background(), testTitle, tt.body)
+			if len(tt.err) != 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("SendMessage() = %v, want an error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SendMessage() = %v", err)
+			}
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			if tt.document {
+				if len(f.messages) != 0 || len(f.documents) != 1 {
+					t.Fatalf("sent %d messages and %d documents, want 1 document", len(f.messages), len(f.documents))
+				}
+				if len(f.captions) != 1 || f.captions[0] != testTitle {
+					t.Errorf("captions = %q, want the title", f.captions)
+				}
+				for name, content := range f.documents {
+					if !strings.HasPrefix(name, "42/slots-available-") || !strings.HasSuffix(name, ".txt") {
+						t.Errorf("document = %q, want 42/slots-available-*.txt", name)
+					}
+					if content != tt.body {
+						t.Errorf("document has %d bytes, want the %d of the body", len(content), len(tt.body))
+					}
+				}
+				return
+			}
+			if len(f.messages) != 1 || len(f.documents) != 0 {
+				t.Fatalf("sent %d messages and %d documents, want 1 message", len(f.messages), len(f.documents))
+			}
+			if got := f.messages[0].Get("chat_id"); got != "42" {
+				t.Errorf("chat_id = %q, want 42", got)
+			}
+			if got, want := f.messages[0].Get("text"), testTitle+"\n\n"+tt.body; got != want {
+				t.Errorf("text = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestTelegramSendMessageCancelled(t *testing.T) {
+	f := &fakeTelegram{chatUser: "asha"}
+	client := startFakeTelegram(t, f)
+	n, err := newTelegram("asha", testBotToken, client)
+	if err != nil {
+		t.Fatalf("NewTelegram() = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := n.SendMessage(ctx, "Slots", "slots"); err == nil {
+		t.Fatal("SendMessage() = nil, want an error for the cancelled context")
+	}
+	if len(f.messages) != 0 {
+		t.Errorf("sent %d messages, want none", len(f.messages))
+	}
+}
+
+func TestTelegramErrorsRedactToken(t *testing.T) {
+	down := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	})
+	_, err := newTelegram("asha", testBotToken, &http.Client{Transport: down})
+	if err == nil || strings.Contains(err.Error(), testBotToken) {
+		t.Errorf("newTelegram() = %v, want an error without the token", err)
+	}
+
+	client := startFakeTelegram(t, &fakeTelegram{chatUser: "asha"})
+	n, err := newTelegram("asha", testBotToken, client)
+	if err != nil {
+		t.Fatalf("NewTelegram() = %v", err)
+	}
+	client.Transport = down
+	for _, body := range []string{"slots", strings.Repeat("a", maxOneMessageLength+1)} {
+		err := n.SendMessage(context.Background(), "Slots", body)
+		if err == nil || strings.Contains(err.Error(), testBotToken) {
+			t.Errorf("SendMessage() = %v, want an error without the token", err)
+		}
+	}
+}
+
+func TestTelegramSendMessageTimeout(t *testing.T) {
+	f := &fakeTelegram{chatUser: "asha", hold: make(chan struct{})}
+	client := startFakeTelegram(t, f)
+	defer close(f.hold)
+	n, err := newTelegram("asha", testBotToken, client)
+	if err != nil {
+		t.Fatalf("NewTelegram() = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- n.SendMessage(ctx, "Slots", "slots") }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("SendMessage() = %v, want the deadline error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SendMessage() ignored the deadline of the context")
+	}
+}
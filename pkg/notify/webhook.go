@@ -0,0 +1,56 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Webhook posts the messages as JSON like {"text": "..."} to a URL, which
+// Slack and Mattermost incoming webhooks accept
+type Webhook struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewWebhook returns a Notifier posting to the webhook URL
+func NewWebhook(rawURL string) (Notifier, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		// The URL is left out, its path is the secret of the webhook
+		return nil, fmt.Errorf("invalid webhook URL, please use an http or https URL")
+	}
+	return &Webhook{
+		URL:    rawURL,
+		Client: &http.Client{Timeout: sendTimeout},
+	}, nil
+}
+
+// SendMessage posts the message to the webhook
+func (w *Webhook) SendMessage(ctx context.Context, title, body string) error {
+	data, err := json.Marshal(map[string]string{"text": messageText(title, body)})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		// The url.Error has the URL of the webhook, keep only the cause
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("error posting to webhook: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("error posting to webhook: status %d", resp.StatusCode)
+	}
+	return nil
+}
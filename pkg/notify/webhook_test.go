@@ -0,0 +1,78 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewWebhook(t *testing.T) {
+	for _, rawURL := range []string{"", "hooks.slack.com/services/T0", "ftp://example.com/hook", "https://"} {
+		if _, err := NewWebhook(rawURL); err == nil {
+			t.Errorf("NewWebhook(%q) = nil, want an error", rawURL)
+		}
+	}
+}
+
+func TestWebhookSendMessage(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		err    string
+	}{
+		{name: "posted", status: http.StatusOK},
+		{name: "no content", status: http.StatusNoContent},
+		{name: "refused", status: http.StatusForbidden, err: "status 403"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got map[string]string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				json.NewDecoder(r.Body).Decode(&got)
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+			n, err := NewWebhook(srv.URL + "/hooks/abc")
+			if err != nil {
+				t.Fatalf("NewWebhook() = %v", err)
+			}
+			body := "Center\tCivil Hospital\nPinCode\t444001\n"
+			err = n.SendMessage(context.Background(), testTitle, body)
+			if len(tt.err) != 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("SendMessage() = %v, want an error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SendMessage() = %v", err)
+			}
+			if want := testTitle + "\n\n" + body; got["text"] != want {
+				t.Errorf("text = %q, want %q", got["text"], want)
+			}
+		})
+	}
+}
+
+func TestWebhookErrorsLeaveOutURL(t *testing.T) {
+	if _, err := NewWebhook("hooks.slack.com/services/T0/B0/secret"); err == nil || strings.Contains(err.Error(), "secret") {
+		t.Errorf("NewWebhook() = %v, want an error without the URL", err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	n, err := NewWebhook(srv.URL + "/hooks/secret")
+	if err != nil {
+		t.Fatalf("NewWebhook() = %v", err)
+	}
+	srv.Close()
+	err = n.SendMessage(context.Background(), "Slots", "text")
+	if err == nil || strings.Contains(err.Error(), "secret") || strings.Contains(err.Error(), srv.URL) {
+		t.Errorf("SendMessage() = %v, want an error without the URL", err)
+	}
+}
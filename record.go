@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/PrasadG193/covaccine-notifier/pkg/logging"
+)
+
+const recordTimeLayout = "20060102T150405.000000000"
+
+// recordedPaths are the endpoints whose responses are recorded, the ones with
+// the tokens and the beneficiaries are never written to disk
+var recordedPaths = []string{"/v2/appointment/sessions/", "/v2/admin/location/"}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9=-]+`)
+
+// recordedResponse is a CoWIN response captured with --record
+type recordedResponse struct {
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	RecordedAt time.Time `json:"recorded_at"`
+	// Body is the JSON response, or a JSON string for the other ones
+	Body json.RawMessage `json:"body"`
+}
+
+// recordingTransport saves the responses of the CoWIN endpoints to a directory
+// so that they can be replayed with mock-server --replay
+type recordingTransport struct {
+	dir  string
+	next http.RoundTripper
+}
+
+// setupRecording records the CoWIN responses with --record
+func setupRecording() error {
+	if len(recordDir) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(recordDir, 0700); err != nil {
+		return errors.Wrap(err, "Failed to create the record directory")
+	}
+	next := httpClient.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	httpClient.Transport = &recordingTransport{dir: recordDir, next: next}
+	logging.Info("Recording the CoWIN responses", "dir", recordDir)
+	return nil
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	path := relativePath(req.URL)
+	if err != nil || req.Method != http.MethodGet || !recordable(path) {
+		return resp, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	rec := recordedResponse{Method: req.Method, Path: path, Status: resp.StatusCode, RecordedAt: time.Now(), Body: body}
+	if !json.Valid(body) {
+		if rec.Body, err = json.Marshal(string(body)); err != nil {
+			return resp, nil
+		}
+	}
+	if err := t.save(rec); err != nil {
+		logging.Warn("Failed to record response", "path", path, "err", err)
+	}
+	return resp, nil
+}
+
+func (t *recordingTransport) save(rec recordedResponse) error {
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := strings.Trim(unsafeFileChars.ReplaceAllString(rec.Path, "_"), "_")
+	name += "-" + rec.RecordedAt.Format(recordTimeLayout) + ".json"
+	logging.Debug("Recording response", "path", rec.Path, "file", name)
+	return writeFileAtomic(filepath.Join(t.dir, name), data, 0600)
+}
+
+func recordable(path string) bool {
+	for _, p := range recordedPaths {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// relativePath returns the path and query of the request relative to the base URL
+func relativePath(u *url.URL) string {
+	path := u.Path
+	if base, err := url.Parse(baseURL); err == nil {
+		path = strings.TrimPrefix(path, strings.TrimSuffix(base.Path, "/"))
+	}
+	if len(u.RawQuery) != 0 {
+		path += "?" + u.RawQuery
+	}
+	return path
+}
+
+// replayStore has the responses recorded with --record. The responses to the
+// same request are replayed in the order they were recorded, and the last one
+// is repeated once they are exhausted.
+type replayStore struct {
+	mu sync.Mutex
+	// exact has the responses by method and path
+	exact map[string][]recordedResponse
+	// undated has them by method and path without the date, to replay the
+	// sessions recorded on another day
+	undated map[string][]recordedResponse
+	next    map[string]int
+}
+
+func loadReplay(dir string) (*replayStore, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var all []recordedResponse
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var rec recordedResponse
+		if err := json.Unmarshal(data, &rec); err != nil || len(rec.Method) == 0 || len(rec.Path) == 0 {
+			return nil, errors.Errorf("Invalid recorded response %s", f)
+		}
+		all = append(all, rec)
+	}
+	if len(all) == 0 {
+		return nil, errors.Errorf("No recorded responses in %s, please record them with --record", dir)
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].RecordedAt.Before(all[j].RecordedAt)
+	})
+	s := &replayStore{exact: map[string][]recordedResponse{}, undated: map[string][]recordedResponse{}, next: map[string]int{}}
+	for _, rec := range all {
+		u, err := url.Parse(rec.Path)
+		if err != nil {
+			return nil, errors.Errorf("Invalid recorded path %q", rec.Path)
+		}
+		exact, undated := replayKeys(rec.Method, u)
+		s.exact[exact] = append(s.exact[exact], rec)
+		s.undated[undated] = append(s.undated[undated], rec)
+	}
+	logging.Info("Loaded the recorded responses", "dir", dir, "responses", len(all))
+	return s, nil
+}
+
+func replayKeys(method string, u *url.URL) (string, string) {
+	q := u.Query()
+	exact := method + " " + u.Path + "?" + q.Encode()
+	q.Del("date")
+	return exact, method + " " + u.Path + "?" + q.Encode()
+}
+
+// lookup returns the next recorded response to the request. The sessions
+// recorded for another date are moved to the requested one.
+func (s *replayStore) lookup(method string, u *url.URL) (recordedResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	exact, undated := replayKeys(method, u)
+	key, recs := exact, s.exact[exact]
+	if len(recs) == 0 {
+		key, recs = "~"+undated, s.undated[undated]
+	}
+	if len(recs) == 0 {
+		return recordedResponse{}, false
+	}
+	i := s.next[key]
+	if i < len(recs)-1 {
+		s.next[key] = i + 1
+	} else {
+		i = len(recs) - 1
+	}
+	rec := recs[i]
+	if recorded, err := url.Parse(rec.Path); err == nil {
+		from, err1 := parseDate(recorded.Query().Get("date"))
+		to, err2 := parseDate(u.Query().Get("date"))
+		if err1 == nil && err2 == nil && !from.Equal(to) {
+			rec.Body = shiftDates(rec.Body, int(to.Sub(from).Hours()/24+0.5))
+		}
+	}
+	return rec, true
+}
+
+// shiftDates moves the "date" fields of the response by the number of days
+func shiftDates(body json.RawMessage, days int) json.RawMessage {
+	var v interface{}
+	if json.Unmarshal(body, &v) != nil {
+		return body
+	}
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for k, field := range v {
+				if s, ok := field.(string); ok && k == "date" {
+					if d, err := parseDate(s); err == nil {
+						v[k] = formatDate(d.AddDate(0, 0, days))
+					}
+					continue
+				}
+				walk(field)
+			}
+		case []interface{}:
+			for _, e := range v {
+				walk(e)
+			}
+		}
+	}
+	walk(v)
+	shifted, err := json.Marshal(v)
+	if err != nil {
+		return body
+	}
+	return shifted
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/PrasadG193/covaccine-notifier/pkg/logging"
+)
+
+const (
+	defaultFastInterval = 10
+
+	// learnPeriod is the history used to learn the release windows
+	learnPeriod = 28 * 24 * time.Hour
+	// learnRefresh is how often the release windows are learned again
+	learnRefresh = time.Hour
+	// releaseLead starts the fast polling ahead of a release window
+	releaseLead = 5 * time.Minute
+)
+
+// scheduler decides when the searches run
+type scheduler interface {
+	// Next returns the time of the search following the one at now
+	Next(now time.Time) time.Time
+}
+
+// clockRange is a range of minutes since midnight, wrapping around midnight
+// when From is after To
+type clockRange struct {
+	From, To int
+}
+
+func (c clockRange) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if c.From <= c.To {
+		return m >= c.From && m < c.To
+	}
+	return m >= c.From || m < c.To
+}
+
+// parseClockRange parses a range like 07:00-22:00, 10:00PM-06:00AM or 22-6
+func parseClockRange(s string) (clockRange, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return clockRange{}, errors.New("invalid time range")
+	}
+	from, err := parseHourOrClock(parts[0])
+	if err != nil {
+		return clockRange{}, err
+	}
+	to, err := parseHourOrClock(parts[1])
+	if err != nil {
+		return clockRange{}, err
+	}
+	if from == to {
+		return clockRange{}, errors.New("empty time range")
+	}
+	return clockRange{From: from, To: to}, nil
+}
+
+// parseHourOrClock returns the minutes since midnight of an hour like 22 or a time like 22:30
+func parseHourOrClock(s string) (int, error) {
+	if h, err := strconv.Atoi(strings.TrimSpace(s)); err == nil {
+		if h < 0 || h > 24 {
+			return 0, errors.New("invalid hour")
+		}
+		return (h % 24) * 60, nil
+	}
+	return parseClock(s)
+}
+
+func parseClockRanges(values []string, flag string) ([]clockRange, error) {
+	var ranges []clockRange
+	for _, v := range values {
+		r, err := parseClockRange(v)
+		if err != nil {
+			return nil, errors.Errorf("Invalid %s %q, please use a range like 07:00-22:00", flag, v)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// inRanges reports whether t is in one of the ranges, any time is when there is none
+func inRanges(ranges []clockRange, t time.Time) bool {
+	if len(ranges) == 0 {
+		return true
+	}
+	for _, r := range ranges {
+		if r.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextInRanges returns the first minute from t which is in one of the ranges
+func nextInRanges(ranges []clockRange, t time.Time) time.Time {
+	if inRanges(ranges, t) {
+		return t
+	}
+	day := truncateDay(t)
+	var next time.Time
+	for _, r := range ranges {
+		start := day.Add(time.Duration(r.From) * time.Minute)
+		if !start.After(t) {
+			start = start.AddDate(0, 0, 1)
+		}
+		if next.IsZero() || start.Before(next) {
+			next = start
+		}
+	}
+	return next
+}
+
+// fixedScheduler searches every interval
+type fixedScheduler struct {
+	interval time.Duration
+}
+
+func (f fixedScheduler) Next(now time.Time) time.Time {
+	return now.Add(f.interval)
+}
+
+// activeScheduler only lets the searches of the inner scheduler run in the active hours
+type activeScheduler struct {
+	inner  scheduler
+	active []clockRange
+}
+
+func (a activeScheduler) Next(now time.Time) time.Time {
+	return nextInRanges(a.active, a.inner.Next(now))
+}
+
+// adaptiveScheduler searches every fast interval around the hours slots were
+// released in the history and every base interval otherwise
+type adaptiveScheduler struct {
+	base, fast time.Duration
+	// windows are the hours of the day slots are usually released in
+	windows   [24]bool
+	learnedAt time.Time
+	learn     func() ([24]bool, error)
+}
+
+func (a *adaptiveScheduler) Next(now time.Time) time.Time {
+	if now.Sub(a.learnedAt) >= learnRefresh {
+		a.learnedAt = now
+		windows, err := a.learn()
+		if err != nil {
+			logging.Warn("Failed to learn the release windows", "err", err)
+		} else {
+			a.windows = windows
+			logging.Debug("Learned the release windows", "hours", fmt.Sprint(hoursOf(windows)))
+		}
+	}
+	if a.inWindow(now.Add(a.fast)) || a.inWindow(now.Add(releaseLead)) {
+		return now.Add(a.fast)
+	}
+	next := now.Add(a.base)
+	// Do not sleep through the start of a window. Truncate would round to
+	// the hours of UTC, which are half past the hour in India.
+	hour := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 0, 0, 0, now.Location())
+	for h := hour.Add(time.Hour); h.Before(next); h = h.Add(time.Hour) {
+		if a.inWindow(h) {
+			start := h.Add(-releaseLead)
+			if start.Before(now.Add(a.fast)) {
+				start = now.Add(a.fast)
+			}
+			return start
+		}
+	}
+	return next
+}
+
+func (a *adaptiveScheduler) inWindow(t time.Time) bool {
+	return a.windows[t.Hour()]
+}
+
+func hoursOf(windows [24]bool) []int {
+	var hours []int
+	for h, ok := range windows {
+		if ok {
+			hours = append(hours, h)
+		}
+	}
+	return hours
+}
+
+// learnWindows returns the hours with at least half the drops of the busiest
+// hour in the recent history of the searched centers
+func learnWindows() ([24]bool, error) {
+	var windows [24]bool
+	h, err := getHistory()
+	if err != nil {
+		return windows, err
+	}
+	stats, err := h.analyze(intSet(centerIDs), learnPeriod)
+	if err != nil {
+		return windows, err
+	}
+	var hours [24]int
+	busiest := 0
+	for _, s := range stats {
+		for i, n := range s.Hours {
+			hours[i] += n
+			if hours[i] > busiest {
+				busiest = hours[i]
+			}
+		}
+	}
+	for i, n := range hours {
+		windows[i] = busiest > 0 && n*2 >= busiest
+	}
+	return windows, nil
+}
+
+// minInterval returns the shortest interval in seconds keeping the searches of
+// the date range under the rate limit
+func minInterval(r dateRange) int {
+	calls := callsPerPoll(calendarEndpoint, r)
+	if rateLimit <= 0 || calls == 0 {
+		return 1
+	}
+	return (rateLimitWindow*calls + rateLimit - 1) / rateLimit
+}
+
+// newScheduler returns the scheduler selected by the flags
+func newScheduler() scheduler {
+	var s scheduler = fixedScheduler{interval: time.Duration(interval) * time.Second}
+	if searchCron != nil {
+		s = searchCron
+	}
+	if adaptive {
+		fast := fastInterval
+		if m := minInterval(searchWindow(time.Now())); fast < m {
+			logging.Warn("Fast interval exceeds the CoWIN rate budget, using the shortest interval within it", "fast_interval", fast, "interval", m)
+			fast = m
+		}
+		s = &adaptiveScheduler{
+			base:  time.Duration(interval) * time.Second,
+			fast:  time.Duration(fast) * time.Second,
+			learn: learnWindows,
+		}
+	}
+	if len(activeRanges) != 0 {
+		s = activeScheduler{inner: s, active: activeRanges}
+	}
+	return s
+}
+
+var (
+	activeRanges, quietRanges []clockRange
+	searchCron, digestCron    *cronSchedule
+	// pollInterval is the time in seconds until the next search, it is used
+	// instead of the interval for the rate budget once the searches are scheduled.
+	// It is guarded by endpointMu.
+	pollInterval int
+)
+
+// setPollInterval records the time until the next search at now
+func setPollInterval(next, now time.Time) {
+	endpointMu.Lock()
+	defer endpointMu.Unlock()
+	pollInterval = int((next.Sub(now) + time.Second - 1) / time.Second)
+}
+
+func getPollInterval() int {
+	endpointMu.Lock()
+	defer endpointMu.Unlock()
+	return pollInterval
+}
+
+// checkScheduleFlags validates the scheduling flags
+func checkScheduleFlags() error {
+	var err error
+	if activeRanges, err = parseClockRanges(activeHours, "active hours"); err != nil {
+		return err
+	}
+	if quietRanges, err = parseClockRanges(quietHours, "quiet hours"); err != nil {
+		return err
+	}
+	if fastInterval == 0 {
+		fastInterval = defaultFastInterval
+	}
+	if fastInterval < 0 {
+		return errors.New("Invalid fast interval, please use a positive number of seconds")
+	}
+	if adaptive && len(historyPath) == 0 {
+		return errors.New("Adaptive polling learns from the history, please pass --history")
+	}
+	if searchCron, err = parseCronFlag(scheduleArg, "schedule"); err != nil {
+		return err
+	}
+	if searchCron != nil && adaptive {
+		return errors.New("Please use either --schedule or --adaptive")
+	}
+	if digestCron, err = parseCronFlag(digestArg, "digest"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseCronFlag parses the cron expression of a flag, if set
+func parseCronFlag(value, flag string) (*cronSchedule, error) {
+	if len(value) == 0 {
+		return nil, nil
+	}
+	c, err := parseCron(value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid %s %q", flag, value)
+	}
+	if c.Next(time.Now()).IsZero() {
+		return nil, errors.Errorf("Invalid %s %q, it never matches", flag, value)
+	}
+	return c, nil
+}
+
+// quiet reports whether notifications are muted at t
+func quiet(t time.Time) bool {
+	return len(quietRanges) != 0 && inRanges(quietRanges, t)
+}
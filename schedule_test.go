@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdaptiveSchedulerNext(t *testing.T) {
+	ist := time.FixedZone("IST", 5*3600+30*60)
+	var windows [24]bool
+	windows[9] = true
+	tests := []struct {
+		name string
+		now  time.Time
+		want time.Time
+	}{
+		{
+			name: "outside a window",
+			now:  time.Date(2021, 5, 20, 6, 10, 0, 0, ist),
+			want: time.Date(2021, 5, 20, 6, 40, 0, 0, ist),
+		},
+		{
+			name: "ahead of a window",
+			now:  time.Date(2021, 5, 20, 8, 40, 0, 0, ist),
+			want: time.Date(2021, 5, 20, 8, 55, 0, 0, ist),
+		},
+		{
+			name: "close to a window",
+			now:  time.Date(2021, 5, 20, 8, 56, 0, 0, ist),
+			want: time.Date(2021, 5, 20, 8, 57, 0, 0, ist),
+		},
+		{
+			name: "in a window",
+			now:  time.Date(2021, 5, 20, 9, 20, 0, 0, ist),
+			want: time.Date(2021, 5, 20, 9, 21, 0, 0, ist),
+		},
+		{
+			name: "after a window",
+			now:  time.Date(2021, 5, 20, 10, 0, 0, 0, ist),
+			want: time.Date(2021, 5, 20, 10, 30, 0, 0, ist),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &adaptiveScheduler{
+				base:  30 * time.Minute,
+				fast:  time.Minute,
+				learn: func() ([24]bool, error) { return windows, nil },
+			}
+			if got := a.Next(tt.now); !got.Equal(tt.want) {
+				t.Errorf("Next(%s) = %s, want %s", tt.now.Format("15:04"), got.In(ist).Format("15:04"), tt.want.Format("15:04"))
+			}
+		})
+	}
+}
@@ -2,111 +2,151 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"net/url"
 	"strings"
 	"text/tabwriter"
 	"time"
 
 	"github.com/pkg/errors"
 
+	"github.com/PrasadG193/covaccine-notifier/pkg/expr"
+	"github.com/PrasadG193/covaccine-notifier/pkg/logging"
 	"github.com/PrasadG193/covaccine-notifier/pkg/notify"
 )
 
 // https://apisetu.gov.in/public/api/cowin
 const (
-	baseURL = "https://cdn-api.co-vin.in/api"
-	// Public endpoints for calendarByPin and calendarByDistrict return cached results which can be 30 mins late
-	// That's why we are using the endpoints which are called after login. These endpoints return 403 sometimes
-	// but works after retry. This tradeoff is acceptable as we are getting the correct availability.
-	// FIXME: Now, these endpoints requires authentication. We will switch to public endpoints for now
+	defaultBaseURL = "https://cdn-api.co-vin.in/api"
+	// Public endpoints for calendarByPin and calendarByDistrict return cached results which can be 30 mins late.
+	// The endpoints which are called after login return the correct availability but require a token,
+	// see chooseEndpoint for how the endpoint is picked.
 	calendarByPinURLFormat      = "/v2/appointment/sessions/calendarByPin?pincode=%s&date=%s"
 	calendarByDistrictURLFormat = "/v2/appointment/sessions/calendarByDistrict?district_id=%d&date=%s"
 
 	// Public endpoints
 	calendarByPinPublicURLFormat      = "/v2/appointment/sessions/public/calendarByPin?pincode=%s&date=%s"
 	calendarByDistrictPublicURLFormat = "/v2/appointment/sessions/public/calendarByDistrict?district_id=%d&date=%s"
+	// The find endpoints return the sessions of a single day with fresher results than the public calendars
+	findByPinPublicURLFormat      = "/v2/appointment/sessions/public/findByPin?pincode=%s&date=%s"
+	findByDistrictPublicURLFormat = "/v2/appointment/sessions/public/findByDistrict?district_id=%d&date=%s"
 
 	listStatesURLFormat    = "/v2/admin/location/states"
 	listDistrictsURLFormat = "/v2/admin/location/districts/%d"
 )
 
 var (
-	stateID, districtID int
+	districtID int
+	// baseURL is the CoWIN API, or a mock-server with --base-url
+	baseURL = defaultBaseURL
+
+	httpClient = &http.Client{}
+
+	// errUnauthorized is returned when CoWIN answers a request with 401. The
+	// public endpoints sometimes do so, the callers decide whether to go on.
+	errUnauthorized = errors.New("Request failed with statusCode: 401: Unauthenticated access")
 )
 
-type StateList struct {
-	States []struct {
-		StateID    int    `json:"state_id"`
-		StateName  string `json:"state_name"`
-		StateNameL string `json:"state_name_l"`
-	} `json:"states"`
-	TTL int `json:"ttl"`
+type Appointments struct {
+	Centers []Center `json:"centers"`
 }
 
-type DistrictList struct {
-	Districts []struct {
-		StateID       int    `json:"state_id"`
-		DistrictID    int    `json:"district_id"`
-		DistrictName  string `json:"district_name"`
-		DistrictNameL string `json:"district_name_l"`
-	} `json:"districts"`
-	TTL int `json:"ttl"`
+type Center struct {
+	CenterID      int          `json:"center_id"`
+	Name          string       `json:"name"`
+	NameL         string       `json:"name_l"`
+	StateName     string       `json:"state_name"`
+	StateNameL    string       `json:"state_name_l"`
+	DistrictName  string       `json:"district_name"`
+	DistrictNameL string       `json:"district_name_l"`
+	BlockName     string       `json:"block_name"`
+	BlockNameL    string       `json:"block_name_l"`
+	Pincode       int          `json:"pincode"`
+	Lat           float64      `json:"lat"`
+	Long          float64      `json:"long"`
+	From          string       `json:"from"`
+	To            string       `json:"to"`
+	FeeType       string       `json:"fee_type"`
+	VaccineFees   []VaccineFee `json:"vaccine_fees"`
+	Sessions      []Session    `json:"sessions"`
 }
 
-type Appointments struct {
-	Centers []struct {
-		CenterID      int     `json:"center_id"`
-		Name          string  `json:"name"`
-		NameL         string  `json:"name_l"`
-		StateName     string  `json:"state_name"`
-		StateNameL    string  `json:"state_name_l"`
-		DistrictName  string  `json:"district_name"`
-		DistrictNameL string  `json:"district_name_l"`
-		BlockName     string  `json:"block_name"`
-		BlockNameL    string  `json:"block_name_l"`
-		Pincode       int     `json:"pincode"`
-		Lat           float64 `json:"lat"`
-		Long          float64 `json:"long"`
-		From          string  `json:"from"`
-		To            string  `json:"to"`
-		FeeType       string  `json:"fee_type"`
-		VaccineFees   []struct {
-			Vaccine string `json:"vaccine"`
-			Fee     string `json:"fee"`
-		} `json:"vaccine_fees"`
-		Sessions []struct {
-			SessionID              string   `json:"session_id"`
-			Date                   string   `json:"date"`
-			AvailableCapacity      float64  `json:"available_capacity"`
-			AvailableCapacityDose1 float64  `json:"available_capacity_dose1"`
-			AvailableCapacityDose2 float64  `json:"available_capacity_dose2"`
-			MinAgeLimit            int      `json:"min_age_limit"`
-			Vaccine                string   `json:"vaccine"`
-			Slots                  []string `json:"slots"`
-		} `json:"sessions"`
-	} `json:"centers"`
+type VaccineFee struct {
+	Vaccine string `json:"vaccine"`
+	Fee     string `json:"fee"`
+}
+
+type Session struct {
+	SessionID              string   `json:"session_id"`
+	Date                   string   `json:"date"`
+	AvailableCapacity      float64  `json:"available_capacity"`
+	AvailableCapacityDose1 float64  `json:"available_capacity_dose1"`
+	AvailableCapacityDose2 float64  `json:"available_capacity_dose2"`
+	MinAgeLimit            int      `json:"min_age_limit"`
+	Vaccine                string   `json:"vaccine"`
+	Slots                  []string `json:"slots"`
+}
+
+// Slot is a session matching the search preferences along with its center
+type Slot struct {
+	Center  Center
+	Session Session
+	// Beneficiaries are the names of the beneficiaries the session is available for
+	Beneficiaries []string
+}
+
+// checkBaseURL validates --base-url
+func checkBaseURL() error {
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return errors.Errorf("Invalid base URL %q, please use an http or https URL", baseURL)
+	}
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	return nil
 }
 
-func timeNow() string {
-	return time.Now().Format("02-01-2006")
+func queryServer(ctx context.Context, path string) ([]byte, error) {
+	return requestServer(ctx, http.MethodGet, path, nil)
 }
 
-func queryServer(path string) ([]byte, error) {
-	req, err := http.NewRequest("GET", baseURL+path, nil)
+// postServer sends body encoded as JSON to the endpoint
+func postServer(ctx context.Context, path string, body interface{}) ([]byte, error) {
+	data, err := json.Marshal(body)
 	if err != nil {
 		return nil, err
 	}
+	return requestServer(ctx, http.MethodPost, path, data)
+}
+
+func requestServer(ctx context.Context, method, path string, body []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, baseURL+path, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
 	req.Header.Set("Accept", "application/json")
 	req.Header.Set("Accept-Language", "hi_IN")
 	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/90.0.4430.93 Safari/537.36 Edg/90.0.818.51")
+	if token := bearerToken(); len(token) != 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
 
-	log.Print("Querying endpoint: ", baseURL+path)
+	logging.Debug("Querying endpoint", "url", baseURL+path)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -116,157 +156,211 @@ func queryServer(path string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	log.Print("Response: ", string(bodyBytes))
+	logging.Debug("Received response", "url", baseURL+path, "status", resp.StatusCode, "body", string(bodyBytes))
 
 	if resp.StatusCode != http.StatusOK {
-		// Sometimes the API returns "Unauthenticated access!", do not fail in that case
 		if resp.StatusCode == http.StatusUnauthorized {
-			return nil, nil
+			return nil, errUnauthorized
+		}
+		// Errors come with a message like {"errorCode":"USRAUT0014","error":"Invalid OTP"}
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(bodyBytes, &apiErr) == nil && len(apiErr.Error) != 0 {
+			return nil, errors.New(fmt.Sprintf("Request failed with statusCode: %d: %s", resp.StatusCode, apiErr.Error))
 		}
 		return nil, errors.New(fmt.Sprintf("Request failed with statusCode: %d", resp.StatusCode))
 	}
 	return bodyBytes, nil
 }
 
-func searchByPincode(notifier notify.Notifier, pinCode string) error {
-	response, err := queryServer(fmt.Sprintf(calendarByPinPublicURLFormat, pinCode, timeNow()))
+func searchByPincode(ctx context.Context, r dateRange, pinCode string, crits []criteria) ([]Slot, error) {
+	loc := location{PinCode: pinCode}
+	appnts, err := fetchAppointments(ctx, r, loc, 1)
 	if err != nil {
-		return errors.Wrap(err, "Failed to fetch appointment sessions")
+		return nil, err
 	}
-	return getAvailableSessions(notifier, response, age, minCapacity)
+	recordHistory(appnts, loc)
+	learnValues(appnts)
+	return getAvailableSessions(appnts, r, crits), nil
 }
 
-func getStateIDByName(state string) (int, error) {
-	response, err := queryServer(listStatesURLFormat)
+func searchByStateDistrict(ctx context.Context, r dateRange, crits []criteria) ([]Slot, error) {
+	id, err := resolveDistrictID(ctx)
 	if err != nil {
-		return 0, errors.Wrap(err, "Failed to list states")
-	}
-	states := StateList{}
-	if err := json.Unmarshal(response, &states); err != nil {
-		return 0, err
+		return nil, err
 	}
-	for _, s := range states.States {
-		if strings.ToLower(s.StateName) == strings.ToLower(state) {
-			log.Printf("State Details - ID: %d, Name: %s", s.StateID, s.StateName)
-			return s.StateID, nil
-		}
+	loc := location{DistrictID: id}
+	appnts, err := fetchAppointments(ctx, r, loc, 1)
+	if err != nil {
+		return nil, err
 	}
-	return 0, errors.New("Invalid state name passed")
+	recordHistory(appnts, loc)
+	learnValues(appnts)
+	return getAvailableSessions(appnts, r, crits), nil
 }
 
-func getDistrictIDByName(stateID int, district string) (int, error) {
-	response, err := queryServer(fmt.Sprintf(listDistrictsURLFormat, stateID))
-	if err != nil {
-		return 0, errors.Wrap(err, "Failed to list states")
-	}
-	dl := DistrictList{}
-	if err := json.Unmarshal(response, &dl); err != nil {
-		return 0, err
-	}
-	for _, d := range dl.Districts {
-		if strings.ToLower(d.DistrictName) == strings.ToLower(district) {
-			log.Printf("District Details - ID: %d, Name: %s", d.DistrictID, d.DistrictName)
-			return d.DistrictID, nil
-		}
-	}
-	return 0, errors.New("Invalid district name passed")
+// criteria are the preferences a session has to match
+type criteria struct {
+	Age         int
+	Dose        int
+	Vaccines    []string
+	MinCapacity int
+	// FirstDose is the day of the first dose, sessions before the second dose
+	// of the session vaccine is due are skipped
+	FirstDose time.Time
+	// Beneficiary is the name of the person the criteria are for, if any
+	Beneficiary string
 }
 
-func searchByStateDistrict(notifier notify.Notifier, state, district string) error {
-	var err1 error
-	if stateID == 0 {
-		stateID, err1 = getStateIDByName(state)
-		if err1 != nil {
-			return err1
-		}
-	}
-	if districtID == 0 {
-		districtID, err1 = getDistrictIDByName(stateID, district)
-		if err1 != nil {
-			return err1
-		}
+// flagCriteria returns the criteria set by the flags
+func flagCriteria() criteria {
+	return criteria{
+		Age:         age,
+		Dose:        dose,
+		Vaccines:    vaccines,
+		MinCapacity: minCapacity,
+		FirstDose:   firstDose,
 	}
-	response, err := queryServer(fmt.Sprintf(calendarByDistrictPublicURLFormat, districtID, timeNow()))
-	if err != nil {
-		return errors.Wrap(err, "Failed to fetch appointment sessions")
-	}
-	return getAvailableSessions(notifier, response, age, minCapacity)
 }
 
-// isPreferredAvailable checks for availability of preferences
-func isPreferredAvailable(current, preference string) bool {
-	if preference == "" {
-		return true
-	} else {
-		return strings.ToLower(current) == preference
+// doseExprs check the capacity of the session for the dose preference
+var doseExprs = map[int]*expr.Expr{
+	0: expr.MustCompile("session.available_capacity >= search.min_capacity"),
+	1: expr.MustCompile("session.available_capacity_dose1 >= search.min_capacity"),
+	2: expr.MustCompile("session.available_capacity_dose2 >= search.min_capacity"),
+}
+
+// env returns the fields of the criteria available to the expressions
+func (c criteria) env() expr.Env {
+	return expr.Env{
+		"age":          c.Age,
+		"dose":         c.Dose,
+		"vaccines":     c.Vaccines,
+		"min_capacity": c.MinCapacity,
+		"beneficiary":  c.Beneficiary,
 	}
 }
 
-func getAvailableSessions(notifier notify.Notifier, response []byte, age int, minCapacity int) error {
-	if response == nil {
-		log.Printf("Received unexpected response, rechecking after %v seconds", interval)
-		return nil
+// matches reports whether the session is available for the criteria. env
+// holds the fields of the center and the session, see sessionEnv.
+func (c criteria) matches(s Session, env expr.Env) bool {
+	if s.MinAgeLimit > c.Age || s.AvailableCapacity <= 0 || !isPreferred(s.Vaccine, c.Vaccines) {
+		return false
 	}
-	appnts := Appointments{}
-	err := json.Unmarshal(response, &appnts)
-	if err != nil {
-		return err
+	if !c.FirstDose.IsZero() {
+		d, err := parseDate(s.Date)
+		from, ok := eligibleFrom(c.FirstDose, s.Vaccine)
+		if err != nil || !ok || d.Before(from) {
+			return false
+		}
 	}
-	var buf bytes.Buffer
-	w := tabwriter.NewWriter(&buf, 1, 8, 1, '\t', 0)
+	env["search"] = c.env()
+	for _, e := range []*expr.Expr{doseExprs[c.Dose], filterExpr} {
+		if e == nil {
+			continue
+		}
+		ok, err := e.Match(env)
+		if err != nil {
+			logging.Warn("Failed to evaluate filter", "filter", e.String(), "err", err)
+			return false
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// getAvailableSessions returns the sessions in the date range matching any of the criteria
+func getAvailableSessions(appnts Appointments, r dateRange, crits []criteria) []Slot {
+	var slots []Slot
 	for _, center := range appnts.Centers {
-		if !isPreferredAvailable(center.FeeType, fee) {
+		if !isPreferred(center.FeeType, fees) || !filters.matchesCenter(center) {
 			continue
 		}
 		for _, s := range center.Sessions {
-			if s.MinAgeLimit <= age && s.AvailableCapacity > 0 && isPreferredAvailable(s.Vaccine, vaccine) {
-				switch dose {
-				case 1:
-					if s.AvailableCapacityDose1 < float64(minCapacity) {
-						continue
-					}
-				case 2:
-					if s.AvailableCapacityDose2 < float64(minCapacity) {
-						continue
-					}
-				case 0:
-					if s.AvailableCapacity < float64(minCapacity) {
-						continue
-					}
-				}
-				fmt.Fprintln(w, fmt.Sprintf("Center\t%s", center.Name))
-				fmt.Fprintln(w, fmt.Sprintf("State\t%s", center.StateName))
-				fmt.Fprintln(w, fmt.Sprintf("District\t%s", center.DistrictName))
-				fmt.Fprintln(w, fmt.Sprintf("PinCode\t%d", center.Pincode))
-				fmt.Fprintln(w, fmt.Sprintf("Fee\t%s", center.FeeType))
-				if len(center.VaccineFees) != 0 {
-					fmt.Fprintln(w, fmt.Sprintf("Vaccine\t"))
-				}
-				for _, v := range center.VaccineFees {
-					fmt.Fprintln(w, fmt.Sprintf("\tName\t%s", v.Vaccine))
-					fmt.Fprintln(w, fmt.Sprintf("\tFees\t%s", v.Fee))
+			if !r.contains(s.Date) {
+				continue
+			}
+			s, ok := filters.filterSession(center, s)
+			if !ok {
+				continue
+			}
+			env := sessionEnv(center, s)
+			matched := false
+			var beneficiaries []string
+			for _, c := range crits {
+				if !c.matches(s, env) {
+					continue
 				}
-				fmt.Fprintln(w, fmt.Sprintf("Sessions\t"))
-				fmt.Fprintln(w, fmt.Sprintf("\tDate\t%s", s.Date))
-				fmt.Fprintln(w, fmt.Sprintf("\tAvailable Dose-1\t%f", s.AvailableCapacityDose1))
-				fmt.Fprintln(w, fmt.Sprintf("\tAvailable Dose-2\t%f", s.AvailableCapacityDose2))
-				fmt.Fprintln(w, fmt.Sprintf("\tMinAgeLimit\t%d", s.MinAgeLimit))
-				fmt.Fprintln(w, fmt.Sprintf("\tVaccine\t%s", s.Vaccine))
-				fmt.Fprintln(w, fmt.Sprintf("\tSlots"))
-				for _, slot := range s.Slots {
-					fmt.Fprintln(w, fmt.Sprintf("\t\t%s", slot))
+				matched = true
+				if len(c.Beneficiary) != 0 {
+					beneficiaries = append(beneficiaries, c.Beneficiary)
 				}
-				fmt.Fprintln(w, "-----------------------------")
+			}
+			if matched {
+				slots = append(slots, Slot{Center: center, Session: s, Beneficiaries: beneficiaries})
 			}
 		}
 	}
+	return slots
+}
+
+// formatSlots renders the slots as the body of a notification
+func formatSlots(slots []Slot) (string, error) {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 1, 8, 1, '\t', 0)
+	for _, slot := range slots {
+		center, s := slot.Center, slot.Session
+		fmt.Fprintln(w, fmt.Sprintf("Center\t%s", center.Name))
+		fmt.Fprintln(w, fmt.Sprintf("State\t%s", center.StateName))
+		fmt.Fprintln(w, fmt.Sprintf("District\t%s", center.DistrictName))
+		fmt.Fprintln(w, fmt.Sprintf("PinCode\t%d", center.Pincode))
+		fmt.Fprintln(w, fmt.Sprintf("Fee\t%s", center.FeeType))
+		if len(slot.Beneficiaries) != 0 {
+			fmt.Fprintln(w, fmt.Sprintf("For\t%s", strings.Join(slot.Beneficiaries, ", ")))
+		}
+		if len(center.VaccineFees) != 0 {
+			fmt.Fprintln(w, fmt.Sprintf("Vaccine\t"))
+		}
+		for _, v := range center.VaccineFees {
+			fmt.Fprintln(w, fmt.Sprintf("\tName\t%s", v.Vaccine))
+			fmt.Fprintln(w, fmt.Sprintf("\tFees\t%s", v.Fee))
+		}
+		fmt.Fprintln(w, fmt.Sprintf("Sessions\t"))
+		fmt.Fprintln(w, fmt.Sprintf("\tDate\t%s", s.Date))
+		fmt.Fprintln(w, fmt.Sprintf("\tAvailable Dose-1\t%f", s.AvailableCapacityDose1))
+		fmt.Fprintln(w, fmt.Sprintf("\tAvailable Dose-2\t%f", s.AvailableCapacityDose2))
+		fmt.Fprintln(w, fmt.Sprintf("\tMinAgeLimit\t%d", s.MinAgeLimit))
+		fmt.Fprintln(w, fmt.Sprintf("\tVaccine\t%s", s.Vaccine))
+		fmt.Fprintln(w, fmt.Sprintf("\tSlots"))
+		for _, slot := range s.Slots {
+			fmt.Fprintln(w, fmt.Sprintf("\t\t%s", slot))
+		}
+		fmt.Fprintln(w, "-----------------------------")
+	}
 	if err := w.Flush(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// slotsTitle is the title of the notifications of available slots
+const slotsTitle = "Vaccination slots are available"
+
+// notifySlots sends the details of the slots using the notifier
+func notifySlots(ctx context.Context, notifier notify.Notifier, slots []Slot) error {
+	body, err := formatSlots(slots)
+	if err != nil {
 		return err
 	}
-	if buf.Len() == 0 {
-		log.Printf("No slots available, min required: %d, rechecking after %v seconds", minCapacity, interval)
-		return nil
+	logging.Info("Found available slots, sending notification", "count", len(slots))
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	if err := notifier.SendMessage(ctx, slotsTitle, body); err != nil {
+		return err
 	}
-	log.Print("Found available slots, sending notification")
-	return notifier.SendMessage(buf.String())
+	pstate.LastNotified = time.Now()
+	return nil
 }
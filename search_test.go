@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadAppointments reads a calendar response from testdata
+func loadAppointments(t *testing.T, name string) Appointments {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var appnts Appointments
+	if err := json.Unmarshal(data, &appnts); err != nil {
+		t.Fatal(err)
+	}
+	return appnts
+}
+
+func sessionIDs(slots []Slot) []string {
+	ids := []string{}
+	for _, s := range slots {
+		ids = append(ids, s.Session.SessionID)
+	}
+	return ids
+}
+
+func TestGetAvailableSessions(t *testing.T) {
+	appnts := loadAppointments(t, "appointments.json")
+	tests := []struct {
+		name  string
+		flags func()
+		want  []string
+	}{
+		{
+			name:  "age 18",
+			flags: func() { age = 18 },
+			want:  []string{"s1", "s4", "s5", "s8"},
+		},
+		{
+			name:  "age 45",
+			flags: func() { age = 45 },
+			want:  []string{"s1", "s3", "s4", "s5", "s7", "s8"},
+		},
+		{
+			name:  "first dose",
+			flags: func() { age, dose = 45, 1 },
+			want:  []string{"s1", "s4", "s5", "s7", "s8"},
+		},
+		{
+			name:  "second dose",
+			flags: func() { age, dose = 45, 2 },
+			want:  []string{"s1", "s3", "s5"},
+		},
+		{
+			name:  "vaccine",
+			flags: func() { age, vaccines = 45, []string{"covaxin"} },
+			want:  []string{"s3", "s7"},
+		},
+		{
+			name:  "vaccine spelled differently",
+			flags: func() { age, vaccines = 18, []string{"sputnik-v"} },
+			want:  []string{"s5"},
+		},
+		{
+			name:  "several vaccines",
+			flags: func() { age, vaccines = 18, []string{"Covishield", "Sputnik V"} },
+			want:  []string{"s1", "s4", "s5", "s8"},
+		},
+		{
+			name:  "free",
+			flags: func() { age, fees = 45, []string{"free"} },
+			want:  []string{"s1", "s3", "s7"},
+		},
+		{
+			name:  "paid",
+			flags: func() { age, fees = 18, []string{"Paid"} },
+			want:  []string{"s4", "s5", "s8"},
+		},
+		{
+			name:  "maximum fee",
+			flags: func() { age, maxFee = 18, 1000 },
+			want:  []string{"s1", "s4"},
+		},
+		{
+			name:  "minimum capacity",
+			flags: func() { age, minCapacity = 18, 5 },
+			want:  []string{"s1", "s5"},
+		},
+		{
+			name:  "minimum capacity of the second dose",
+			flags: func() { age, dose, minCapacity = 45, 2, 5 },
+			want:  []string{"s3", "s5"},
+		},
+		{
+			name:  "dose gap after the first dose",
+			flags: func() { age, dose, firstDoseDate = 45, 2, "01-03-2021" },
+			want:  []string{"s3", "s5"},
+		},
+		{
+			name:  "custom dose gap",
+			flags: func() { age, dose, firstDoseDate, doseGapArg = 45, 2, "01-03-2021", map[string]int{"covaxin": 90} },
+			want:  []string{"s5"},
+		},
+		{
+			name:  "days of week",
+			flags: func() { age, daysOfWeek = 45, []string{"sat", "sunday"} },
+			want:  []string{"s3", "s5"},
+		},
+		{
+			name:  "slot window",
+			flags: func() { age, slotWindows = 18, []string{"09:00AM-11:00AM"} },
+			want:  []string{"s1"},
+		},
+		{
+			name:  "block",
+			flags: func() { age, blocks = 45, []string{"murtizapur"} },
+			want:  []string{"s7"},
+		},
+		{
+			name:  "excluded block",
+			flags: func() { age, excludeBlocks = 45, []string{"Akola"} },
+			want:  []string{"s7"},
+		},
+		{
+			name:  "centers",
+			flags: func() { age, centerIDs = 45, []int{1, 3} },
+			want:  []string{"s1", "s3", "s7"},
+		},
+		{
+			name:  "excluded center",
+			flags: func() { age, excludeCenterIDs = 18, []int{2} },
+			want:  []string{"s1", "s8"},
+		},
+		{
+			name:  "radius",
+			flags: func() { age, near, radius = 45, "20.70,77.00", 5 },
+			want:  []string{"s1", "s3", "s4", "s5"},
+		},
+		{
+			name:  "filter",
+			flags: func() { age, filterArg = 18, `session.available_capacity >= 10 || session.fee == -1` },
+			want:  []string{"s1", "s5", "s8"},
+		},
+		{
+			name:  "filter on the search",
+			flags: func() { age, filterArg = 45, `search.age == session.min_age_limit && search.dose == 0` },
+			want:  []string{"s3", "s7"},
+		},
+		{
+			name:  "nothing matches",
+			flags: func() { age, vaccines = 18, []string{"covaxin"} },
+			want:  []string{},
+		},
+	}
+	r := dateRange{From: mustParseDate(t, "20-05-2021"), To: mustParseDate(t, "26-05-2021")}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetFlags(t)
+			pinCode = "444002"
+			tt.flags()
+			if err := checkFlags(); err != nil {
+				t.Fatalf("checkFlags() = %v", err)
+			}
+			got := sessionIDs(getAvailableSessions(appnts, r, []criteria{flagCriteria()}))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getAvailableSessions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetAvailableSessionsSlotWindow(t *testing.T) {
+	resetFlags(t)
+	age, pinCode, slotWindows = 18, "444002", []string{"09:00-11:00"}
+	if err := checkFlags(); err != nil {
+		t.Fatalf("checkFlags() = %v", err)
+	}
+	r := dateRange{From: mustParseDate(t, "20-05-2021"), To: mustParseDate(t, "20-05-2021")}
+	slots := getAvailableSessions(loadAppointments(t, "appointments.json"), r, []criteria{flagCriteria()})
+	if len(slots) != 1 {
+		t.Fatalf("getAvailableSessions() = %v, want s1 only", sessionIDs(slots))
+	}
+	if want := []string{"09:00AM-11:00AM"}; !reflect.DeepEqual(slots[0].Session.Slots, want) {
+		t.Errorf("slots = %v, want the ones in the window %v", slots[0].Session.Slots, want)
+	}
+}
+
+func TestGetAvailableSessionsBeneficiaries(t *testing.T) {
+	resetFlags(t)
+	age, pinCode = 18, "444002"
+	if err := checkFlags(); err != nil {
+		t.Fatalf("checkFlags() = %v", err)
+	}
+	crits := []criteria{
+		{Age: 30, Dose: 1, MinCapacity: 1, Beneficiary: "Asha"},
+		{Age: 60, Dose: 2, MinCapacity: 1, Vaccines: []string{"covaxin"}, Beneficiary: "Ravi"},
+	}
+	r := dateRange{From: mustParseDate(t, "20-05-2021"), To: mustParseDate(t, "26-05-2021")}
+	got := map[string][]string{}
+	for _, slot := range getAvailableSessions(loadAppointments(t, "appointments.json"), r, crits) {
+		got[slot.Session.SessionID] = slot.Beneficiaries
+	}
+	want := map[string][]string{
+		"s1": {"Asha"},
+		"s3": {"Ravi"},
+		"s4": {"Asha"},
+		"s5": {"Asha"},
+		"s8": {"Asha"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("getAvailableSessions() = %v, want %v", got, want)
+	}
+}
+
+func TestFormatSlots(t *testing.T) {
+	resetFlags(t)
+	age, pinCode, centerIDs = 18, "444002", []int{2}
+	if err := checkFlags(); err != nil {
+		t.Fatalf("checkFlags() = %v", err)
+	}
+	r := dateRange{From: mustParseDate(t, "20-05-2021"), To: mustParseDate(t, "20-05-2021")}
+	body, err := formatSlots(getAvailableSessions(loadAppointments(t, "appointments.json"), r, []criteria{flagCriteria()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Sai Hospital", "444002", "Paid", "COVISHIELD", "780", "20-05-2021", "02:00PM-04:00PM"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("formatSlots() = %q, want it to contain %q", body, want)
+		}
+	}
+}
+
+func mustParseDate(t *testing.T, s string) time.Time {
+	t.Helper()
+	d, err := parseDate(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestUnauthorizedResponses(t *testing.T) {
+	resetFlags(t)
+	startCowin(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Unauthenticated access!"))
+	}))
+	ctx := context.Background()
+	r := dateRange{From: mustParseDate(t, "20-05-2021"), To: mustParseDate(t, "26-05-2021")}
+
+	if _, err := fetchStates(ctx); !errors.Is(err, errUnauthorized) {
+		t.Errorf("fetchStates() = %v, want errUnauthorized", err)
+	}
+	if _, err := fetchDistricts(ctx, 21); !errors.Is(err, errUnauthorized) {
+		t.Errorf("fetchDistricts() = %v, want errUnauthorized", err)
+	}
+	if _, err := fetchCalendar(ctx, r, calendarByPinURLFormat, "444002", true); !errors.Is(err, errUnauthenticated) {
+		t.Errorf("fetchCalendar() of the authenticated endpoint = %v, want errUnauthenticated", err)
+	}
+	// The public endpoints skip the rejected requests
+	if appnts, err := fetchCalendar(ctx, r, calendarByPinPublicURLFormat, "444002", false); err != nil || len(appnts.Centers) != 0 {
+		t.Errorf("fetchCalendar() of the public endpoint = %v, %v, want no centers", appnts, err)
+	}
+	if appnts, err := fetchDays(ctx, r, findByPinPublicURLFormat, "444002"); err != nil || len(appnts.Centers) != 0 {
+		t.Errorf("fetchDays() = %v, %v, want no centers", appnts, err)
+	}
+	if _, err := schedule(ctx, scheduleRequest{}); !errors.Is(err, errUnauthenticated) {
+		t.Errorf("schedule() = %v, want errUnauthenticated", err)
+	}
+}
@@ -0,0 +1,566 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/PrasadG193/covaccine-notifier/pkg/logging"
+	"github.com/PrasadG193/covaccine-notifier/pkg/notify"
+)
+
+const (
+	defaultListen         = "localhost:8080"
+	subscriptionsFileName = "subscriptions.json"
+	// shutdownTimeout bounds the requests in progress when the server stops
+	shutdownTimeout = 10 * time.Second
+	maxRequestBody  = 1 << 16
+	// maxRecentNotifications is the number of notifications kept for the dashboard
+	maxRecentNotifications = 50
+)
+
+// subscription is a search registered through the API. The poller keeps its
+// location up to date and posts the matching slots to the webhook, if any.
+type subscription struct {
+	ID          string    `json:"id"`
+	PinCode     string    `json:"pincode,omitempty"`
+	DistrictID  int       `json:"district_id,omitempty"`
+	Age         int       `json:"age"`
+	Dose        int       `json:"dose,omitempty"`
+	Vaccines    []string  `json:"vaccines,omitempty"`
+	Fees        []string  `json:"fees,omitempty"`
+	MinCapacity int       `json:"min_capacity,omitempty"`
+	Webhook     string    `json:"webhook,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func (s *subscription) validate() error {
+	if (len(s.PinCode) == 0) == (s.DistrictID == 0) {
+		return errors.New("Please pass either a pincode or a district_id")
+	}
+	if len(s.PinCode) != 0 {
+		if _, err := strconv.Atoi(s.PinCode); err != nil || len(s.PinCode) != 6 {
+			return errors.New("Invalid pincode, please use 6 digits")
+		}
+	}
+	if s.DistrictID < 0 {
+		return errors.New("Invalid district_id")
+	}
+	if s.Age <= 0 {
+		return errors.New("Missing age")
+	}
+	if s.Dose < 0 || s.Dose > 2 {
+		return errors.New("Invalid dose preference, please use 1 or 2")
+	}
+	if s.MinCapacity < 0 {
+		return errors.New("Invalid min_capacity")
+	}
+	if len(s.Webhook) != 0 {
+		if _, err := notify.NewWebhook(s.Webhook); err != nil {
+			return errors.New("Invalid webhook, please use an http or https URL")
+		}
+		// Without --api-token anyone reaching the API can add a webhook, do
+		// not let them make the server post to the hosts of its network
+		if len(apiToken) == 0 && isInternalURL(s.Webhook) {
+			return errors.New("Invalid webhook, local and private addresses are only allowed with --api-token")
+		}
+	}
+	return nil
+}
+
+// privateNetworks are the address ranges not reachable from the internet,
+// besides the loopback and link-local ones
+var privateNetworks = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"}
+
+// isInternalURL reports whether the host of the URL is a name or an address
+// of the local host or of a private network
+func isInternalURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return true
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() {
+		return true
+	}
+	for _, cidr := range privateNetworks {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// redacted returns the subscription with the path of the webhook masked, it
+// is the secret of the Slack and Mattermost webhooks
+func (s *subscription) redacted() *subscription {
+	r := *s
+	if len(r.Webhook) != 0 {
+		r.Webhook = "[REDACTED]"
+		if u, err := url.Parse(s.Webhook); err == nil && len(u.Host) != 0 {
+			r.Webhook = u.Scheme + "://" + u.Host + "/[REDACTED]"
+		}
+	}
+	return &r
+}
+
+func (s *subscription) location() location {
+	return location{PinCode: s.PinCode, DistrictID: s.DistrictID}
+}
+
+func (s *subscription) criteria() criteria {
+	c := criteria{Age: s.Age, Dose: s.Dose, Vaccines: s.Vaccines, MinCapacity: s.MinCapacity}
+	if c.MinCapacity == 0 {
+		c.MinCapacity = minCapacity
+	}
+	return c
+}
+
+// snapshot is the latest response of CoWIN for a location
+type snapshot struct {
+	appnts  Appointments
+	r       dateRange
+	takenAt time.Time
+}
+
+// pollerHealth tells whether the searches of the server work
+type pollerHealth struct {
+	LastPoll    time.Time `json:"last_poll,omitempty"`
+	LastSuccess time.Time `json:"last_success,omitempty"`
+	NextPoll    time.Time `json:"next_poll,omitempty"`
+	// Failures is the number of polls in a row with a failed search
+	Failures  int    `json:"failures"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// notificationRecord is a notification sent by the server
+type notificationRecord struct {
+	Time         time.Time `json:"time"`
+	Subscription string    `json:"subscription"`
+	Slots        int       `json:"slots"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// server exposes the availability found by the poller over HTTP. The
+// searches use the global state of the notifier, searchMu serializes them.
+// mu guards the fields and is never held during a search, so that the API
+// stays responsive while CoWIN is slow.
+type server struct {
+	searchMu sync.Mutex
+
+	mu            sync.Mutex
+	snapshots     map[location]snapshot
+	subscriptions map[string]*subscription
+	// notified is the key of the slots last posted to each subscription webhook
+	notified map[string]string
+	path     string
+
+	health pollerHealth
+	// locationErrors are the errors of the last search of each location
+	locationErrors map[location]string
+	// notifications are the most recent notifications, the latest last
+	notifications []notificationRecord
+	events        *eventBroker
+	// polled is the number of locations searched by each poll, for the rate budget
+	polled int
+}
+
+func newServer(dir string) *server {
+	s := &server{
+		snapshots:      map[location]snapshot{},
+		subscriptions:  map[string]*subscription{},
+		notified:       map[string]string{},
+		locationErrors: map[location]string{},
+		events:         newEventBroker(),
+	}
+	if len(dir) != 0 {
+		s.path = filepath.Join(dir, subscriptionsFileName)
+	}
+	return s
+}
+
+// Serve polls CoWIN for the flag location and the subscriptions and serves
+// the API until ctx is cancelled
+func Serve(ctx context.Context) error {
+	if len(pinCode) == 0 && districtID == 0 && (len(state) == 0) != (len(district) == 0) {
+		return errors.New("Missing state or district name option")
+	}
+	if err := checkOptionFlags(); err != nil {
+		return err
+	}
+	if err := loadState(); err != nil {
+		logging.Warn("Ignoring the saved state", "err", err)
+	}
+	defer func() {
+		if err := saveState(); err != nil {
+			logging.Error("Failed to save state", "err", err)
+		}
+	}()
+	defer closeHistory()
+
+	s := newServer(dataDir)
+	if err := s.loadSubscriptions(); err != nil {
+		return err
+	}
+	srv := &http.Server{Addr: listen, Handler: s.routes()}
+	errCh := make(chan error, 1)
+	go func() {
+		logging.Info("Serving the API", "listen", listen)
+		errCh <- srv.ListenAndServe()
+	}()
+	defer func() {
+		// The event streams never end by themselves
+		s.events.close()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			logging.Error("Failed to stop the API server", "err", err)
+		}
+	}()
+
+	// Like Run, the searches are not bound to ctx
+	workCtx := context.Background()
+	sched := newScheduler()
+	next := time.Now()
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			logging.Info("Shutting down", "reason", ctx.Err())
+			return nil
+		case err := <-errCh:
+			timer.Stop()
+			return errors.Wrap(err, "Failed to serve the API")
+		case <-timer.C:
+		}
+		s.poll(workCtx)
+		now := time.Now()
+		next = sched.Next(now)
+		setPollInterval(next, now)
+		s.mu.Lock()
+		s.health.NextPoll = next
+		s.mu.Unlock()
+	}
+}
+
+// poll refreshes the locations of the flags and the subscriptions and posts
+// the new slots to the subscription webhooks
+func (s *server) poll(ctx context.Context) {
+	locs, failure := s.locations(ctx)
+	s.mu.Lock()
+	s.polled = len(locs)
+	if failure == nil {
+		s.forget(locs)
+	}
+	s.mu.Unlock()
+	if failure != nil {
+		logging.Error("Search failed, retrying later", "err", failure)
+	}
+	for _, loc := range locs {
+		if _, err := s.refresh(ctx, loc); err != nil {
+			logging.Error("Search failed, retrying later", "location", loc.String(), "err", err)
+			failure = err
+		}
+	}
+	s.mu.Lock()
+	s.health.LastPoll = time.Now()
+	if failure != nil {
+		s.health.Failures++
+		s.health.LastError = failure.Error()
+	} else {
+		s.health.Failures, s.health.LastError = 0, ""
+		s.health.LastSuccess = s.health.LastPoll
+	}
+	s.mu.Unlock()
+	s.notifySubscriptions(ctx)
+}
+
+// locations returns the location of the flags, if any, and the ones of the subscriptions
+func (s *server) locations(ctx context.Context) ([]location, error) {
+	seen := map[location]bool{}
+	var locs []location
+	add := func(loc location) {
+		if !seen[loc] {
+			seen[loc] = true
+			locs = append(locs, loc)
+		}
+	}
+	// Resolving the district of the flags may query CoWIN, s.mu is not held for it
+	loc, ok, err := flagLocation(ctx)
+	if ok {
+		add(loc)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sub := range s.sortedSubscriptions() {
+		add(sub.location())
+	}
+	return locs, err
+}
+
+// monitored reports whether the location is the one of the flags or of a subscription
+func (s *server) monitored(ctx context.Context, loc location) bool {
+	locs, _ := s.locations(ctx)
+	for _, l := range locs {
+		if l == loc {
+			return true
+		}
+	}
+	return false
+}
+
+// forget drops the searches of the locations no longer polled, like the ones
+// of deleted subscriptions, s.mu has to be held
+func (s *server) forget(polled []location) {
+	keep := map[location]bool{}
+	for _, loc := range polled {
+		keep[loc] = true
+	}
+	for loc := range s.snapshots {
+		if !keep[loc] {
+			delete(s.snapshots, loc)
+		}
+	}
+	for loc := range s.locationErrors {
+		if !keep[loc] {
+			delete(s.locationErrors, loc)
+		}
+	}
+}
+
+// flagLocation returns the location passed with the flags, if any
+func flagLocation(ctx context.Context) (location, bool, error) {
+	if len(pinCode) != 0 {
+		return location{PinCode: pinCode}, true, nil
+	}
+	if districtID == 0 && len(district) == 0 {
+		return location{}, false, nil
+	}
+	id, err := resolveDistrictID(ctx)
+	if err != nil {
+		return location{}, false, err
+	}
+	return location{DistrictID: id}, true, nil
+}
+
+// refresh fetches the sessions of the location from CoWIN
+func (s *server) refresh(ctx context.Context, loc location) (snapshot, error) {
+	s.searchMu.Lock()
+	defer s.searchMu.Unlock()
+	return s.fetch(ctx, loc)
+}
+
+// fetch searches the location and swaps its snapshot in, s.searchMu has to be held
+func (s *server) fetch(ctx context.Context, loc location) (snapshot, error) {
+	now := time.Now()
+	r := searchWindow(now)
+	s.mu.Lock()
+	locations := s.polled
+	s.mu.Unlock()
+	if locations == 0 {
+		locations = 1
+	}
+	appnts, err := fetchAppointments(ctx, r, loc, locations)
+	pstate.LastChecked = now
+	if err != nil {
+		s.mu.Lock()
+		s.locationErrors[loc] = err.Error()
+		s.mu.Unlock()
+		return snapshot{}, err
+	}
+	recordHistory(appnts, loc)
+	learnValues(appnts)
+	warnPreferences()
+	snap := snapshot{appnts: appnts, r: r, takenAt: now}
+	s.mu.Lock()
+	delete(s.locationErrors, loc)
+	events := diffSnapshots(loc, s.snapshots[loc], snap)
+	s.snapshots[loc] = snap
+	s.mu.Unlock()
+	s.events.publish(events)
+	return snap, nil
+}
+
+// get returns the sessions of the location, fetching them when they are
+// older than the interval or were never fetched
+func (s *server) get(ctx context.Context, loc location) (snapshot, error) {
+	if snap, ok := s.fresh(loc); ok {
+		return snap, nil
+	}
+	s.searchMu.Lock()
+	defer s.searchMu.Unlock()
+	// The poller may have searched the location in the meantime
+	if snap, ok := s.fresh(loc); ok {
+		return snap, nil
+	}
+	return s.fetch(ctx, loc)
+}
+
+// fresh returns the snapshot of the location unless it is older than the interval
+func (s *server) fresh(loc location) (snapshot, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap, ok := s.snapshots[loc]
+	return snap, ok && time.Since(snap.takenAt) < time.Duration(interval)*time.Second
+}
+
+// availableSlots applies the filters of the flags and the subscription to the snapshot
+func availableSlots(snap snapshot, sub *subscription) []Slot {
+	var slots []Slot
+	for _, slot := range getAvailableSessions(snap.appnts, snap.r, []criteria{sub.criteria()}) {
+		if isPreferred(slot.Center.FeeType, sub.Fees) {
+			slots = append(slots, slot)
+		}
+	}
+	return slots
+}
+
+// notifySubscriptions posts the slots of the subscriptions with a webhook when they changed
+func (s *server) notifySubscriptions(ctx context.Context) {
+	type pending struct {
+		sub   *subscription
+		slots []Slot
+		key   string
+	}
+	var posts []pending
+	s.mu.Lock()
+	for _, sub := range s.sortedSubscriptions() {
+		if len(sub.Webhook) == 0 {
+			continue
+		}
+		snap, ok := s.snapshots[sub.location()]
+		if !ok {
+			continue
+		}
+		slots := availableSlots(snap, sub)
+		key := slotsKey(slots)
+		if key == s.notified[sub.ID] {
+			continue
+		}
+		if len(slots) == 0 {
+			s.notified[sub.ID] = key
+			continue
+		}
+		posts = append(posts, pending{sub: sub, slots: slots, key: key})
+	}
+	s.mu.Unlock()
+
+	for _, p := range posts {
+		err := postSlots(ctx, p.sub.Webhook, p.slots)
+		record := notificationRecord{Time: time.Now(), Subscription: p.sub.ID, Slots: len(p.slots)}
+		if err != nil {
+			logging.Error("Failed to notify subscription", "id", p.sub.ID, "err", err)
+			record.Error = err.Error()
+		} else {
+			logging.Info("Notified subscription", "id", p.sub.ID, "count", len(p.slots))
+		}
+		s.mu.Lock()
+		if err == nil {
+			s.notified[p.sub.ID] = p.key
+		}
+		s.notifications = append(s.notifications, record)
+		if len(s.notifications) > maxRecentNotifications {
+			s.notifications = s.notifications[len(s.notifications)-maxRecentNotifications:]
+		}
+		s.mu.Unlock()
+	}
+}
+
+func postSlots(ctx context.Context, webhook string, slots []Slot) error {
+	notifier, err := notify.NewWebhook(webhook)
+	if err != nil {
+		return err
+	}
+	return notifySlots(ctx, notifier, slots)
+}
+
+// slotsKey identifies a set of slots to post them only once
+func slotsKey(slots []Slot) string {
+	ids := make([]string, 0, len(slots))
+	for _, s := range slots {
+		ids = append(ids, s.Session.SessionID)
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+func (s *server) sortedSubscriptions() []*subscription {
+	subs := make([]*subscription, 0, len(s.subscriptions))
+	for _, sub := range s.subscriptions {
+		subs = append(subs, sub)
+	}
+	sort.Slice(subs, func(i, j int) bool {
+		if !subs[i].CreatedAt.Equal(subs[j].CreatedAt) {
+			return subs[i].CreatedAt.Before(subs[j].CreatedAt)
+		}
+		return subs[i].ID < subs[j].ID
+	})
+	return subs
+}
+
+func (s *server) loadSubscriptions() error {
+	if len(s.path) == 0 {
+		return nil
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrap(err, "Failed to read subscriptions")
+	}
+	var subs []*subscription
+	if err := json.Unmarshal(data, &subs); err != nil {
+		return errors.Wrap(err, "Failed to parse subscriptions")
+	}
+	for _, sub := range subs {
+		logging.AddSecret(sub.Webhook)
+		s.subscriptions[sub.ID] = sub
+	}
+	return nil
+}
+
+// saveSubscriptions persists the subscriptions, s.mu has to be held
+func (s *server) saveSubscriptions() error {
+	if len(s.path) == 0 {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.sortedSubscriptions(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, data, 0600); err != nil {
+		return errors.Wrap(err, "Failed to save subscriptions")
+	}
+	return nil
+}
+
+func newSubscriptionID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
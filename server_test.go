@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PrasadG193/covaccine-notifier/pkg/logging"
+)
+
+// startCowin points the searches at a fake CoWIN API for the test
+func startCowin(t *testing.T, h http.Handler) {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	prev := baseURL
+	baseURL = srv.URL
+	t.Cleanup(func() { baseURL = prev })
+}
+
+// serveCalendar replies to the session requests with the appointments of
+// testdata, moved to start today
+func serveCalendar(t *testing.T) http.HandlerFunc {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "appointments.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	days := int(math.Round(truncateDay(time.Now()).Sub(mustParseDate(t, "20-05-2021")).Hours() / 24))
+	body := shiftDates(data, days)
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}
+}
+
+// newTestServer returns a server searching 444002 with the flags of the tests
+func newTestServer(t *testing.T) *server {
+	t.Helper()
+	resetFlags(t)
+	age, pinCode, endpointArg = 18, "444002", calendarEndpoint
+	if err := checkFlags(); err != nil {
+		t.Fatalf("checkFlags() = %v", err)
+	}
+	return newServer(t.TempDir())
+}
+
+func serveRequest(s *server, method, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	return w
+}
+
+func TestServerStatusDuringSearch(t *testing.T) {
+	s := newTestServer(t)
+	release := make(chan struct{})
+	searching := make(chan struct{}, 1)
+	calendar := serveCalendar(t)
+	startCowin(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case searching <- struct{}{}:
+		default:
+		}
+		<-release
+		calendar(w, r)
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		s.poll(context.Background())
+		close(done)
+	}()
+	<-searching
+
+	status := make(chan int, 1)
+	go func() { status <- serveRequest(s, http.MethodGet, "/status").Code }()
+	select {
+	case code := <-status:
+		if code != http.StatusOK {
+			t.Errorf("GET /status = %d, want 200", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("GET /status blocked by the search in progress")
+	}
+	close(release)
+	<-done
+
+	var resp statusResponse
+	if err := json.Unmarshal(serveRequest(s, http.MethodGet, "/status").Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Locations) != 1 || resp.Locations[0].Location.PinCode != "444002" || resp.Poller.Failures != 0 {
+		t.Errorf("status = %+v, want the searched 444002", resp)
+	}
+}
+
+func TestServerAvailabilityOfSearchedLocations(t *testing.T) {
+	s := newTestServer(t)
+	requests := 0
+	calendar := serveCalendar(t)
+	startCowin(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		calendar(w, r)
+	}))
+
+	if w := serveRequest(s, http.MethodGet, "/availability?pincode=444001"); w.Code != http.StatusNotFound {
+		t.Errorf("GET /availability of another pincode = %d %s, want 404", w.Code, w.Body)
+	}
+	if requests != 0 {
+		t.Errorf("searched CoWIN %d times for a location not polled, want none", requests)
+	}
+	w := serveRequest(s, http.MethodGet, "/availability")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /availability = %d %s, want 200", w.Code, w.Body)
+	}
+	var resp availabilityResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Location.PinCode != "444002" || len(resp.Slots) == 0 {
+		t.Errorf("availability = %+v, want the slots of 444002", resp)
+	}
+
+	// The location of a subscription is served until the subscription is deleted
+	sub := &subscription{ID: "s1", PinCode: "444001", Age: 45}
+	s.mu.Lock()
+	s.subscriptions[sub.ID] = sub
+	s.mu.Unlock()
+	if w := serveRequest(s, http.MethodGet, "/availability?pincode=444001"); w.Code != http.StatusOK {
+		t.Errorf("GET /availability of a subscription = %d %s, want 200", w.Code, w.Body)
+	}
+	if w := serveRequest(s, http.MethodDelete, "/subscriptions/s1"); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE /subscriptions/s1 = %d %s, want 204", w.Code, w.Body)
+	}
+	s.poll(context.Background())
+	s.mu.Lock()
+	_, kept := s.snapshots[location{PinCode: "444001"}]
+	s.mu.Unlock()
+	if kept {
+		t.Error("kept the search of the deleted subscription")
+	}
+}
+
+func TestServerAPIToken(t *testing.T) {
+	s := newTestServer(t)
+	apiToken = "s3cret"
+	tests := []struct {
+		name   string
+		target string
+		auth   string
+		want   int
+	}{
+		{name: "no token", target: "/status", want: http.StatusUnauthorized},
+		{name: "wrong token", target: "/status", auth: "Bearer wrong", want: http.StatusUnauthorized},
+		{name: "not a bearer token", target: "/status", auth: "s3cret", want: http.StatusUnauthorized},
+		{name: "token", target: "/status", auth: "Bearer s3cret", want: http.StatusOK},
+		{name: "access_token of another endpoint", target: "/status?access_token=s3cret", want: http.StatusUnauthorized},
+		{name: "wrong access_token of the events", target: "/events?access_token=wrong", want: http.StatusUnauthorized},
+		{name: "dashboard", target: "/", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if len(tt.auth) != 0 {
+				r.Header.Set("Authorization", tt.auth)
+			}
+			w := httptest.NewRecorder()
+			s.routes().ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("GET %s = %d %s, want %d", tt.target, w.Code, w.Body, tt.want)
+			}
+			if w.Code == http.StatusUnauthorized && len(w.Header().Get("WWW-Authenticate")) == 0 {
+				t.Error("401 without WWW-Authenticate")
+			}
+		})
+	}
+
+	// The event stream takes the token as a parameter, it runs until cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/events?access_token=s3cret", nil).WithContext(ctx))
+	if w.Code != http.StatusOK {
+		t.Errorf("GET /events with access_token = %d %s, want 200", w.Code, w.Body)
+	}
+}
+
+func TestServerSubscriptionRequests(t *testing.T) {
+	s := newTestServer(t)
+	startCowin(t, serveCalendar(t))
+	send := func(method, target, contentType, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if len(contentType) != 0 {
+			r.Header.Set("Content-Type", contentType)
+		}
+		w := httptest.NewRecorder()
+		s.routes().ServeHTTP(w, r)
+		return w
+	}
+	body := `{"pincode": "444001", "age": 45, "webhook": "https://hooks.example.com/services/T0/B0/xyz"}`
+
+	for _, contentType := range []string{"", "text/plain", "application/x-www-form-urlencoded"} {
+		if w := send(http.MethodPost, "/subscriptions", contentType, body); w.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("POST /subscriptions as %q = %d %s, want 415", contentType, w.Code, w.Body)
+		}
+	}
+	w := send(http.MethodPost, "/subscriptions", "application/json; charset=utf-8", body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST /subscriptions = %d %s, want 201", w.Code, w.Body)
+	}
+	var created subscription
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	const redacted = "https://hooks.example.com/[REDACTED]"
+	if created.Webhook != redacted {
+		t.Errorf("webhook = %q, want %q", created.Webhook, redacted)
+	}
+
+	w = serveRequest(s, http.MethodGet, "/subscriptions")
+	if strings.Contains(w.Body.String(), "xyz") || !strings.Contains(w.Body.String(), redacted) {
+		t.Errorf("GET /subscriptions = %s, want the webhook redacted", w.Body)
+	}
+
+	// Sending back the redacted webhook keeps the one of the subscription
+	target := "/subscriptions/" + created.ID
+	update := `{"pincode": "444001", "age": 18, "webhook": "` + redacted + `"}`
+	if w := send(http.MethodPut, target, "text/plain", update); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("PUT %s as text/plain = %d %s, want 415", target, w.Code, w.Body)
+	}
+	if w := send(http.MethodPut, target, "application/json", update); w.Code != http.StatusOK {
+		t.Fatalf("PUT %s = %d %s, want 200", target, w.Code, w.Body)
+	}
+	s.mu.Lock()
+	sub := s.subscriptions[created.ID]
+	s.mu.Unlock()
+	if sub.Age != 18 || sub.Webhook != "https://hooks.example.com/services/T0/B0/xyz" {
+		t.Errorf("subscription = %+v, want age 18 and the webhook kept", sub)
+	}
+	if got := logging.Redact(sub.Webhook); strings.Contains(got, "xyz") {
+		t.Errorf("Redact(webhook) = %q, want the webhook registered as a secret", got)
+	}
+}
+
+func TestServerLocations(t *testing.T) {
+	s := newTestServer(t)
+	prev := locations
+	t.Cleanup(func() { locations = prev })
+	locations = newLocationCache(t.TempDir())
+	startCowin(t, newTestMockServer(t, mockConfig{Scenarios: []string{staticScenario}}))
+
+	w := serveRequest(s, http.MethodGet, "/locations")
+	var states StateList
+	if err := json.Unmarshal(w.Body.Bytes(), &states); err != nil || w.Code != http.StatusOK || len(states.States) == 0 {
+		t.Errorf("GET /locations = %d %s, want the states", w.Code, w.Body)
+	}
+	w = serveRequest(s, http.MethodGet, "/locations?state_id=21")
+	var dl DistrictList
+	if err := json.Unmarshal(w.Body.Bytes(), &dl); err != nil || w.Code != http.StatusOK || len(dl.Districts) == 0 {
+		t.Errorf("GET /locations?state_id=21 = %d %s, want the districts of Maharashtra", w.Code, w.Body)
+	}
+	for _, target := range []string{"/locations?state_id=x", "/locations?state_id=0"} {
+		if w := serveRequest(s, http.MethodGet, target); w.Code != http.StatusBadRequest {
+			t.Errorf("GET %s = %d, want 400", target, w.Code)
+		}
+	}
+	if w := serveRequest(s, http.MethodPost, "/locations"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /locations = %d, want 405", w.Code)
+	}
+}
+
+func TestServerSubscriptionAvailability(t *testing.T) {
+	s := newTestServer(t)
+	startCowin(t, serveCalendar(t))
+	s.mu.Lock()
+	s.subscriptions["s1"] = &subscription{ID: "s1", PinCode: "444002", Age: 18}
+	s.mu.Unlock()
+
+	w := serveRequest(s, http.MethodGet, "/subscriptions/s1/availability")
+	var resp availabilityResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("GET /subscriptions/s1/availability = %d %s, want 200", w.Code, w.Body)
+	}
+	if resp.Location.PinCode != "444002" || len(resp.Slots) == 0 {
+		t.Errorf("availability = %+v, want the slots of 444002", resp)
+	}
+	tests := []struct {
+		method, target string
+		want           int
+	}{
+		{http.MethodPost, "/subscriptions/s1/availability", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/subscriptions/s2/availability", http.StatusNotFound},
+		{http.MethodGet, "/subscriptions/s1/slots", http.StatusNotFound},
+		{http.MethodGet, "/subscriptions/s1/availability/today", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if w := serveRequest(s, tt.method, tt.target); w.Code != tt.want {
+			t.Errorf("%s %s = %d, want %d", tt.method, tt.target, w.Code, tt.want)
+		}
+	}
+}
+
+func TestServerEvents(t *testing.T) {
+	s := newTestServer(t)
+	srv := httptest.NewServer(s.routes())
+	t.Cleanup(srv.Close)
+	t.Cleanup(s.events.close)
+
+	event := func(typ, pinCode, id string) slotEvent {
+		return slotEvent{Type: typ, Location: location{PinCode: pinCode}, Session: slotRecord{SessionID: id}}
+	}
+	s.events.publish([]slotEvent{event(slotAppeared, "444002", "s1"), event(slotAppeared, "444002", "s2")})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/events?pincode=444002", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The client missed the second event
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); resp.StatusCode != http.StatusOK || ct != "text/event-stream" {
+		t.Fatalf("GET /events = %d %s, want 200 text/event-stream", resp.StatusCode, ct)
+	}
+	lines := bufio.NewScanner(resp.Body)
+	next := func() string {
+		for lines.Scan() {
+			if line := lines.Text(); strings.HasPrefix(line, "data: ") {
+				var e slotEvent
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+					t.Fatalf("event data %q: %v", line, err)
+				}
+				return fmt.Sprintf("%d %s %s", e.ID, e.Type, e.Session.SessionID)
+			}
+		}
+		t.Fatalf("stream ended: %v", lines.Err())
+		return ""
+	}
+	if got := next(); got != "2 slot-appeared s2" {
+		t.Errorf("replayed event = %q, want 2 slot-appeared s2", got)
+	}
+	// The events of the other locations are filtered out
+	s.events.publish([]slotEvent{event(slotGone, "444001", "s3"), event(slotGone, "444002", "s1")})
+	if got := next(); got != "4 slot-gone s1" {
+		t.Errorf("event = %q, want 4 slot-gone s1", got)
+	}
+
+	if w := serveRequest(s, http.MethodGet, "/events?district_id=x"); w.Code != http.StatusBadRequest {
+		t.Errorf("GET /events?district_id=x = %d, want 400", w.Code)
+	}
+}
+
+func TestSubscriptionInternalWebhook(t *testing.T) {
+	resetFlags(t)
+	tests := []struct {
+		webhook  string
+		internal bool
+	}{
+		{"https://hooks.slack.com/services/T0/B0/xyz", false},
+		{"http://203.0.113.7:8080/hook", false},
+		{"http://localhost:8080/hook", true},
+		{"http://api.localhost/hook", true},
+		{"http://127.0.0.1/hook", true},
+		{"http://[::1]/hook", true},
+		{"http://0.0.0.0/hook", true},
+		{"http://10.1.2.3/hook", true},
+		{"http://172.20.0.1/hook", true},
+		{"http://192.168.1.1/hook", true},
+		{"http://169.254.169.254/latest/meta-data", true},
+		{"http://[fd00::1]/hook", true},
+	}
+	for _, tt := range tests {
+		sub := &subscription{PinCode: "444001", Age: 18, Webhook: tt.webhook}
+		if err := sub.validate(); (err != nil) != tt.internal {
+			t.Errorf("validate() of %s = %v, want an error %v", tt.webhook, err, tt.internal)
+		}
+	}
+	// With an API token the webhooks can be on the local network
+	apiToken = "secret"
+	sub := &subscription{PinCode: "444001", Age: 18, Webhook: "http://192.168.1.1/hook"}
+	if err := sub.validate(); err != nil {
+		t.Errorf("validate() with an API token = %v", err)
+	}
+}
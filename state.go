@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const stateFileName = "state.json"
+
+// pollerState is the part of the poller state which survives restarts
+type pollerState struct {
+	LastChecked  time.Time `json:"last_checked,omitempty"`
+	LastNotified time.Time `json:"last_notified,omitempty"`
+	// LastFound is the last search which found slots, FoundSinceDigest counts
+	// them since LastDigest
+	LastFound        time.Time `json:"last_found,omitempty"`
+	LastDigest       time.Time `json:"last_digest,omitempty"`
+	FoundSinceDigest int       `json:"found_since_digest,omitempty"`
+	// Vaccines and FeeTypes are the values seen in the CoWIN responses
+	Vaccines []string `json:"vaccines,omitempty"`
+	FeeTypes []string `json:"fee_types,omitempty"`
+}
+
+var pstate pollerState
+
+// defaultDataDir returns the directory used to persist the state between runs
+func defaultDataDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "covaccine-notifier")
+}
+
+// loadState reads the state saved by the previous run, if any
+func loadState() error {
+	if len(dataDir) == 0 {
+		return nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dataDir, stateFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrap(err, "Failed to read state")
+	}
+	if err := json.Unmarshal(data, &pstate); err != nil {
+		return errors.Wrap(err, "Failed to parse state")
+	}
+	return nil
+}
+
+// saveState writes the state to the data directory so that the next run can pick it up
+func saveState() error {
+	if len(dataDir) == 0 {
+		return nil
+	}
+	data, err := json.MarshalIndent(pstate, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dataDir, stateFileName), data, 0644)
+}
+
+// writeFileAtomic writes data to a temporary file and renames it over path so
+// that an interrupted write never leaves a truncated file behind
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
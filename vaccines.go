@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/PrasadG193/covaccine-notifier/pkg/logging"
+)
+
+// warnedPreferences avoids repeating the warning about an unknown preference on every poll
+var warnedPreferences = map[string]bool{}
+
+// isPreferred reports whether the value matches one of the preferences, ignoring
+// case, spaces and punctuation. Any value matches when there is no preference.
+func isPreferred(value string, preferences []string) bool {
+	if len(preferences) == 0 {
+		return true
+	}
+	v := normalizeName(value)
+	for _, p := range preferences {
+		if normalizeName(p) == v {
+			return true
+		}
+	}
+	return false
+}
+
+// learnValues remembers the vaccines and fee types of the CoWIN response, so
+// that the preferences can be checked against the values CoWIN really uses
+func learnValues(appnts Appointments) {
+	for _, c := range appnts.Centers {
+		pstate.FeeTypes = addValue(pstate.FeeTypes, c.FeeType)
+		for _, vf := range c.VaccineFees {
+			pstate.Vaccines = addValue(pstate.Vaccines, vf.Vaccine)
+		}
+		for _, s := range c.Sessions {
+			pstate.Vaccines = addValue(pstate.Vaccines, s.Vaccine)
+		}
+	}
+}
+
+func addValue(values []string, v string) []string {
+	if len(normalizeName(v)) == 0 {
+		return values
+	}
+	for _, known := range values {
+		if normalizeName(known) == normalizeName(v) {
+			return values
+		}
+	}
+	values = append(values, v)
+	sort.Strings(values)
+	return values
+}
+
+// checkPreferences returns an error for the first vaccine or fee preference
+// which matches none of the values seen in the CoWIN responses, as it would
+// never match a session. Nothing is checked before a response is seen.
+func checkPreferences() error {
+	if errs := preferenceErrors(); len(errs) != 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// warnPreferences logs the preferences matching no known value, once each
+func warnPreferences() {
+	for _, err := range preferenceErrors() {
+		if warnedPreferences[err.Error()] {
+			continue
+		}
+		warnedPreferences[err.Error()] = true
+		logging.Warn("Preference matches no session", "err", err)
+	}
+}
+
+func preferenceErrors() []error {
+	errs := checkPreference("vaccine", vaccines, pstate.Vaccines)
+	return append(errs, checkPreference("fee", fees, pstate.FeeTypes)...)
+}
+
+func checkPreference(kind string, preferences, known []string) []error {
+	if len(known) == 0 {
+		return nil
+	}
+	var errs []error
+	for _, p := range preferences {
+		if isPreferred(p, known) {
+			continue
+		}
+		msg := fmt.Sprintf("No session of CoWIN has the %s %q, the known ones are %s", kind, p, strings.Join(known, ", "))
+		if s := suggest(p, known); len(s) != 0 {
+			msg += ", did you mean " + strings.Join(s, " or ") + "?"
+		}
+		errs = append(errs, errors.New(msg))
+	}
+	return errs
+}
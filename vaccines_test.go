@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckPreferences(t *testing.T) {
+	resetFlags(t)
+	prev := pstate
+	t.Cleanup(func() { pstate = prev })
+	pstate = pollerState{}
+
+	vaccines, fees = []string{"covishild"}, []string{"free"}
+	if err := checkPreferences(); err != nil {
+		t.Errorf("checkPreferences() = %v, want nil before any CoWIN response", err)
+	}
+
+	appnts := loadAppointments(t, "appointments.json")
+	learnValues(appnts)
+	for _, v := range []string{"COVISHIELD", "COVAXIN"} {
+		if !isPreferred(v, pstate.Vaccines) {
+			t.Errorf("learned vaccines %q, want %s", pstate.Vaccines, v)
+		}
+	}
+	err := checkPreferences()
+	if err == nil || !strings.Contains(err.Error(), `"covishild"`) || !strings.Contains(err.Error(), "did you mean COVISHIELD?") {
+		t.Errorf("checkPreferences() = %v, want an error suggesting COVISHIELD", err)
+	}
+
+	vaccines, fees = []string{"covishield", "Covaxin"}, []string{"paid"}
+	if err := checkPreferences(); err != nil {
+		t.Errorf("checkPreferences() = %v, want nil for known values", err)
+	}
+	fees = []string{"freee"}
+	if err := checkPreferences(); err == nil || !strings.Contains(err.Error(), "fee") {
+		t.Errorf("checkPreferences() = %v, want an error for the fee", err)
+	}
+}
@@ -0,0 +1,274 @@
+// Dashboard of the serve command, it only uses the JSON API
+'use strict';
+
+const refreshInterval = 15000;
+
+function el(tag, text, className) {
+  const e = document.createElement(tag);
+  if (text !== undefined) {
+    e.textContent = text;
+  }
+  if (className) {
+    e.className = className;
+  }
+  return e;
+}
+
+function row(cells) {
+  const tr = el('tr');
+  for (const c of cells) {
+    const td = el('td');
+    if (c instanceof Node) {
+      td.appendChild(c);
+    } else {
+      td.textContent = c;
+    }
+    tr.appendChild(td);
+  }
+  return tr;
+}
+
+function formatTime(value) {
+  if (!value || value.startsWith('0001-')) {
+    return '-';
+  }
+  return new Date(value).toLocaleString();
+}
+
+// Token of --api-token, asked for once per tab when the API requires one
+function apiToken() {
+  return sessionStorage.getItem('apiToken') || '';
+}
+
+async function api(method, path, body) {
+  const opts = {method: method, headers: {}};
+  if (body !== undefined) {
+    opts.headers['Content-Type'] = 'application/json';
+    opts.body = JSON.stringify(body);
+  }
+  const token = apiToken();
+  if (token) {
+    opts.headers['Authorization'] = 'Bearer ' + token;
+  }
+  const resp = await fetch(path, opts);
+  if (resp.status === 401) {
+    // Another request may have asked for the token meanwhile
+    if (apiToken() === token) {
+      const entered = prompt('API token of the server');
+      if (!entered) {
+        throw new Error('The API requires a token');
+      }
+      sessionStorage.setItem('apiToken', entered);
+    }
+    return api(method, path, body);
+  }
+  if (resp.status === 204) {
+    return null;
+  }
+  const data = await resp.json();
+  if (!resp.ok) {
+    throw new Error(data.error || resp.statusText);
+  }
+  return data;
+}
+
+function renderHealth(poller) {
+  const health = document.getElementById('health');
+  if (poller.failures > 0) {
+    health.className = 'health failing';
+    health.textContent = 'Searches failing (' + poller.failures + ' in a row): ' + poller.last_error;
+  } else {
+    health.className = 'health ok';
+    health.textContent = 'Last search ' + formatTime(poller.last_success) + ', next ' + formatTime(poller.next_poll);
+  }
+}
+
+function renderLocations(locations) {
+  const root = document.getElementById('locations');
+  root.replaceChildren();
+  if (locations.length === 0) {
+    root.appendChild(el('p', 'No location searched yet.', 'empty'));
+    return;
+  }
+  for (const loc of locations) {
+    root.appendChild(el('h3', loc.name));
+    if (loc.error) {
+      root.appendChild(el('p', 'Last search failed: ' + loc.error, 'error'));
+    }
+    if (loc.sessions.length === 0) {
+      root.appendChild(el('p', 'No open session as of ' + formatTime(loc.taken_at) + '.', 'empty'));
+      continue;
+    }
+    const table = el('table');
+    const head = row(['Center', 'Pin code', 'Date', 'Vaccine', 'Min age', 'Dose 1', 'Dose 2', 'Fee']);
+    head.querySelectorAll('td').forEach(function (td) {
+      const th = el('th', td.textContent);
+      td.replaceWith(th);
+    });
+    table.appendChild(head);
+    for (const s of loc.sessions) {
+      table.appendChild(row([s.center, String(s.pincode), s.date, s.vaccine, String(s.min_age_limit),
+        el('span', String(s.available_capacity_dose1), s.available_capacity_dose1 > 0 ? 'open' : ''),
+        el('span', String(s.available_capacity_dose2), s.available_capacity_dose2 > 0 ? 'open' : ''),
+        s.fee_type]));
+    }
+    root.appendChild(table);
+    root.appendChild(el('p', 'As of ' + formatTime(loc.taken_at), 'empty'));
+  }
+}
+
+function renderNotifications(notifications) {
+  const body = document.getElementById('notifications');
+  body.replaceChildren();
+  document.getElementById('no-notifications').hidden = notifications.length !== 0;
+  for (const n of notifications) {
+    body.appendChild(row([formatTime(n.time), n.subscription, String(n.slots),
+      n.error ? el('span', n.error, 'error') : 'Sent']));
+  }
+}
+
+function renderSubscriptions(subscriptions) {
+  const body = document.getElementById('subscriptions');
+  body.replaceChildren();
+  document.getElementById('no-subscriptions').hidden = subscriptions.length !== 0;
+  for (const s of subscriptions) {
+    const remove = el('button', 'Remove');
+    remove.addEventListener('click', async function () {
+      if (!confirm('Remove this alert?')) {
+        return;
+      }
+      try {
+        await api('DELETE', '/subscriptions/' + encodeURIComponent(s.id));
+      } catch (e) {
+        alert(e.message);
+      }
+      refresh();
+    });
+    const where = s.pincode ? s.pincode : 'District ' + s.district_id;
+    const dose = s.dose ? String(s.dose) : 'Any';
+    body.appendChild(row([where, String(s.age), dose, (s.vaccines || []).join(', ') || 'Any',
+      (s.fees || []).join(', ') || 'Any', s.min_capacity ? String(s.min_capacity) : 'Default',
+      s.webhook || '-', remove]));
+  }
+}
+
+async function refresh() {
+  try {
+    const [status, subscriptions] = await Promise.all([api('GET', '/status'), api('GET', '/subscriptions')]);
+    renderHealth(status.poller);
+    renderLocations(status.locations);
+    renderNotifications(status.notifications);
+    renderSubscriptions(subscriptions);
+  } catch (e) {
+    const health = document.getElementById('health');
+    health.className = 'health failing';
+    health.textContent = 'Server unreachable: ' + e.message;
+  }
+}
+
+async function loadStates(form) {
+  try {
+    const data = await api('GET', '/locations');
+    form.state.replaceChildren(el('option', 'Choose a state'));
+    form.state.firstChild.value = '';
+    for (const s of data.states) {
+      const opt = el('option', s.state_name);
+      opt.value = s.state_id;
+      form.state.appendChild(opt);
+    }
+  } catch (e) {
+    form.state.replaceChildren(el('option', 'Failed to load the states'));
+  }
+}
+
+async function loadDistricts(form) {
+  form.district_id.replaceChildren();
+  if (!form.state.value) {
+    return;
+  }
+  try {
+    const data = await api('GET', '/locations?state_id=' + encodeURIComponent(form.state.value));
+    for (const d of data.districts) {
+      const opt = el('option', d.district_name);
+      opt.value = d.district_id;
+      form.district_id.appendChild(opt);
+    }
+  } catch (e) {
+    form.district_id.replaceChildren(el('option', 'Failed to load the districts'));
+  }
+}
+
+function setupForm() {
+  const form = document.getElementById('subscription-form');
+  const error = document.getElementById('form-error');
+  let statesLoaded = false;
+  form.querySelectorAll('input[name=by]').forEach(function (radio) {
+    radio.addEventListener('change', function () {
+      const byDistrict = form.by.value === 'district';
+      document.getElementById('by-pincode').hidden = byDistrict;
+      document.getElementById('by-district').hidden = !byDistrict;
+      if (byDistrict && !statesLoaded) {
+        statesLoaded = true;
+        loadStates(form);
+      }
+    });
+  });
+  form.state.addEventListener('change', function () {
+    loadDistricts(form);
+  });
+  form.addEventListener('submit', async function (event) {
+    event.preventDefault();
+    error.textContent = '';
+    const sub = {
+      age: parseInt(form.age.value, 10),
+      dose: parseInt(form.dose.value, 10),
+      min_capacity: parseInt(form.min_capacity.value, 10) || 0,
+      vaccines: form.vaccines.value.split(',').map(function (v) { return v.trim(); }).filter(Boolean),
+      fees: Array.from(form.querySelectorAll('input[name=fees]:checked')).map(function (c) { return c.value; }),
+    };
+    if (form.by.value === 'district') {
+      sub.district_id = parseInt(form.district_id.value, 10) || 0;
+    } else {
+      sub.pincode = form.pincode.value.trim();
+    }
+    if (form.webhook.value) {
+      sub.webhook = form.webhook.value;
+    }
+    try {
+      await api('POST', '/subscriptions', sub);
+      form.reset();
+      form.by.value = 'pincode';
+      document.getElementById('by-pincode').hidden = false;
+      document.getElementById('by-district').hidden = true;
+    } catch (e) {
+      error.textContent = e.message;
+    }
+    refresh();
+  });
+}
+
+// Refresh as soon as the server sees the sessions change
+function watchEvents() {
+  if (!window.EventSource) {
+    return;
+  }
+  const token = apiToken();
+  const events = new EventSource(token ? '/events?access_token=' + encodeURIComponent(token) : '/events');
+  let pending = null;
+  const onEvent = function () {
+    if (pending === null) {
+      pending = setTimeout(function () {
+        pending = null;
+        refresh();
+      }, 500);
+    }
+  };
+  for (const type of ['slot-appeared', 'slot-changed', 'slot-gone']) {
+    events.addEventListener(type, onEvent);
+  }
+}
+
+setupForm();
+refresh();
+watchEvents();
+setInterval(refresh, refreshInterval);